@@ -17,6 +17,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/golang/glog"
 	"gopkg.in/yaml.v2"
@@ -43,6 +44,139 @@ type Config struct {
 	// When Debug is true all CRI requests and responses will be logged. When false
 	// only requests with error responses will be logged.
 	Debug bool `yaml:"debug"`
+	// When LiveRestore is true all pods and containers are left running
+	// on shutdown and are picked up again after restart. When false
+	// all pods are stopped and removed on shutdown.
+	LiveRestore bool `yaml:"liveRestore"`
+	// GCInterval is an interval between garbage collections of orphaned
+	// pod and container artifacts, e.g. left after crash.
+	GCInterval time.Duration `yaml:"gcInterval"`
+	// When FsckOnStartup is true image storage directory is checked
+	// for consistency on startup and all found problems are repaired.
+	FsckOnStartup bool `yaml:"fsckOnStartup"`
+	// ImportDir is a directory SIF images are imported from in place and
+	// tagged after their file names, e.g. app_v3.sif as app:v3.
+	ImportDir string `yaml:"importDir"`
+	// MaxParallelPulls is the maximum number of images pulled
+	// at the same time, the rest are queued. Zero means no limit.
+	MaxParallelPulls int `yaml:"maxParallelPulls"`
+	// PullTimeout bounds a single image pull including retries,
+	// but not time spent in queue. Zero means no timeout.
+	PullTimeout time.Duration `yaml:"pullTimeout"`
+	// PullRetry controls how failed image pulls are retried.
+	PullRetry PullRetryConfig `yaml:"pullRetry"`
+	// Platform is os/arch[/variant] images are pulled for unless overridden
+	// with pod annotation. Empty means platform sycri is running on.
+	Platform string `yaml:"platform"`
+	// Registries configures where images are pulled from.
+	Registries RegistriesConfig `yaml:"registries"`
+	// Library configures Singularity library endpoints.
+	Library LibraryConfig `yaml:"library"`
+	// Credentials configures credentials for pulls that come without ones.
+	Credentials CredentialsConfig `yaml:"credentials"`
+	// Verification configures image signature verification.
+	Verification VerificationConfig `yaml:"verification"`
+	// Admission configures which images may be pulled.
+	Admission AdmissionConfig `yaml:"admission"`
+}
+
+// PullRetryConfig describes exponential backoff between image pull attempts.
+type PullRetryConfig struct {
+	// Attempts is the maximum number of attempts including the first one.
+	Attempts int `yaml:"attempts"`
+	// InitialBackoff is a delay before the first retry, doubled after each attempt.
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	// MaxBackoff is the upper bound of delay between attempts.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+// RegistriesConfig holds registry mirrors and reference rewrite rules.
+type RegistriesConfig struct {
+	// Hosts holds per registry settings keyed by registry domain.
+	Hosts map[string]RegistryHostConfig `yaml:"hosts"`
+	// Rewrites are applied to image references before pulling.
+	Rewrites []RewriteConfig `yaml:"rewrites"`
+}
+
+// RegistryHostConfig holds settings of a single registry.
+type RegistryHostConfig struct {
+	// Mirrors are endpoints tried in order before the registry itself.
+	Mirrors []string `yaml:"mirrors"`
+	// CAFile is a path to CA bundle to verify registry certificate with.
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are paths to client certificate and key.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// Insecure disables verification of registry certificate.
+	Insecure bool `yaml:"insecure"`
+	// PlainHTTP makes registry be accessed over plain HTTP.
+	PlainHTTP bool `yaml:"plainHTTP"`
+}
+
+// RewriteConfig replaces image reference prefix with another one.
+type RewriteConfig struct {
+	Prefix      string `yaml:"prefix"`
+	Replacement string `yaml:"replacement"`
+}
+
+// LibraryConfig describes Singularity library and key server endpoints.
+type LibraryConfig struct {
+	// URL is a base URL of the default library API.
+	URL string `yaml:"url"`
+	// KeyServer is a URL of the key server signatures are verified with.
+	KeyServer string `yaml:"keyServer"`
+	// TokenFile is a path to a file holding default library token.
+	TokenFile string `yaml:"tokenFile"`
+	// Domains maps additional library domains to their API base URLs.
+	Domains map[string]string `yaml:"domains"`
+}
+
+// CredentialsConfig describes where fallback registry credentials are looked up.
+type CredentialsConfig struct {
+	// DockerConfig is a path to docker config.json.
+	DockerConfig string `yaml:"dockerConfig"`
+	// Helpers maps registry domain to docker credential helper name.
+	Helpers map[string]string `yaml:"helpers"`
+}
+
+// VerificationConfig describes which images are admitted by signature verification.
+type VerificationConfig struct {
+	// Mode is one of disabled, warn or require-signed.
+	Mode string `yaml:"mode"`
+	// KeyServer is used to fetch keys that are not found in Keyring.
+	KeyServer string `yaml:"keyServer"`
+	// Offline disables key server lookups.
+	Offline bool `yaml:"offline"`
+	// Keyring is a path to a local public keyring.
+	Keyring string `yaml:"keyring"`
+	// TrustedKeys are fingerprints of keys images should be signed with.
+	TrustedKeys []string `yaml:"trustedKeys"`
+	// Rules override verification mode and trusted keys per registry or namespace.
+	Rules []VerificationRuleConfig `yaml:"rules"`
+}
+
+// VerificationRuleConfig overrides verification settings for images with matching prefix.
+type VerificationRuleConfig struct {
+	Prefix      string   `yaml:"prefix"`
+	Mode        string   `yaml:"mode"`
+	TrustedKeys []string `yaml:"trustedKeys"`
+}
+
+// AdmissionConfig describes which images may be pulled.
+type AdmissionConfig struct {
+	// Default is one of allow or deny and is applied when no rule matches.
+	Default string `yaml:"default"`
+	// Rules are evaluated in order, the first matching rule wins.
+	Rules []AdmissionRuleConfig `yaml:"rules"`
+}
+
+// AdmissionRuleConfig allows or denies pulls of matching images.
+type AdmissionRuleConfig struct {
+	URI           string   `yaml:"uri"`
+	Repository    string   `yaml:"repository"`
+	Namespaces    []string `yaml:"namespaces"`
+	Action        string   `yaml:"action"`
+	RequireDigest bool     `yaml:"requireDigest"`
 }
 
 var defaultConfig = Config{
@@ -81,5 +215,34 @@ func validConfig(config Config) (Config, error) {
 	if config.BaseRunDir == "" {
 		return Config{}, fmt.Errorf("directory to run containers cannot be empty")
 	}
+	if config.MaxParallelPulls < 0 {
+		return Config{}, fmt.Errorf("number of parallel pulls cannot be negative")
+	}
+	if config.PullRetry.Attempts < 0 {
+		return Config{}, fmt.Errorf("number of pull attempts cannot be negative")
+	}
+	for domain, host := range config.Registries.Hosts {
+		if (host.CertFile == "") != (host.KeyFile == "") {
+			return Config{}, fmt.Errorf("both client certificate and key should be set for %s", domain)
+		}
+	}
+	for _, rule := range config.Registries.Rewrites {
+		if rule.Prefix == "" {
+			return Config{}, fmt.Errorf("rewrite rule prefix cannot be empty")
+		}
+	}
+	if config.Verification.Offline && config.Verification.Keyring == "" {
+		return Config{}, fmt.Errorf("keyring is required for offline verification")
+	}
+	for _, rule := range config.Verification.Rules {
+		if rule.Prefix == "" {
+			return Config{}, fmt.Errorf("verification rule prefix cannot be empty")
+		}
+	}
+	for i, rule := range config.Admission.Rules {
+		if rule.URI == "" && rule.Repository == "" && len(rule.Namespaces) == 0 {
+			return Config{}, fmt.Errorf("admission rule %d matches all images", i)
+		}
+	}
 	return config, nil
 }
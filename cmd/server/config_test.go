@@ -19,6 +19,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -36,6 +37,64 @@ streamingURL: 127.0.0.12:8080
 cniBinDir: /opt/cni/bin
 cniConfDir: /etc/cni/net.d
 baseRunDir: /var/run/cri
+liveRestore: true
+gcInterval: 5m
+fsckOnStartup: true
+importDir: /shared/images
+maxParallelPulls: 2
+pullTimeout: 10m
+pullRetry:
+  attempts: 5
+  initialBackoff: 2s
+  maxBackoff: 1m
+platform: arm64/v8
+registries:
+  hosts:
+    docker.io:
+      mirrors:
+        - http://mirror.local:5000
+        - mirror.gcr.io
+    registry.local:
+      caFile: /etc/sycri/ca.pem
+      certFile: /etc/sycri/client.pem
+      keyFile: /etc/sycri/client-key.pem
+    lab.local:5000:
+      insecure: true
+      plainHTTP: true
+  rewrites:
+    - prefix: docker.io/myorg/
+      replacement: registry.local/myorg/
+library:
+  url: https://library.example.com
+  keyServer: https://keys.example.com
+  tokenFile: /etc/sycri/library-token
+  domains:
+    library.lab.local: https://library.lab.local:8443
+credentials:
+  dockerConfig: /var/lib/kubelet/config.json
+  helpers:
+    gcr.io: gcr
+verification:
+  mode: require-signed
+  offline: true
+  keyring: /etc/sycri/pgp-public
+  trustedKeys:
+    - 8883491F4268F173C6E5DC49EDECE4F3F38D871E
+  rules:
+    - prefix: docker.io/
+      mode: warn
+    - prefix: cloud.sylabs.io/myorg/
+      trustedKeys:
+        - 9F4268F173C6E5DC49EDECE4F3F38D871E888349
+admission:
+  default: deny
+  rules:
+    - repository: docker.io/evil/*
+      action: deny
+    - namespaces:
+        - production
+      requireDigest: true
+    - uri: docker.io
 `)
 
 	require.NoError(t, err, "could not write test YAML config")
@@ -59,12 +118,92 @@ baseRunDir: /var/run/cri
 			name:       "all ok",
 			configPath: tempConfig.Name(),
 			expectConfig: Config{
-				ListenSocket: "/home/user/singularity.sock",
-				StorageDir:   "/var/lib/cri-images",
-				StreamingURL: "127.0.0.12:8080",
-				CNIBinDir:    "/opt/cni/bin",
-				CNIConfDir:   "/etc/cni/net.d",
-				BaseRunDir:   "/var/run/cri",
+				ListenSocket:     "/home/user/singularity.sock",
+				StorageDir:       "/var/lib/cri-images",
+				StreamingURL:     "127.0.0.12:8080",
+				CNIBinDir:        "/opt/cni/bin",
+				CNIConfDir:       "/etc/cni/net.d",
+				BaseRunDir:       "/var/run/cri",
+				LiveRestore:      true,
+				GCInterval:       5 * time.Minute,
+				FsckOnStartup:    true,
+				ImportDir:        "/shared/images",
+				MaxParallelPulls: 2,
+				PullTimeout:      10 * time.Minute,
+				PullRetry: PullRetryConfig{
+					Attempts:       5,
+					InitialBackoff: 2 * time.Second,
+					MaxBackoff:     time.Minute,
+				},
+				Platform: "arm64/v8",
+				Registries: RegistriesConfig{
+					Hosts: map[string]RegistryHostConfig{
+						"docker.io": {
+							Mirrors: []string{"http://mirror.local:5000", "mirror.gcr.io"},
+						},
+						"registry.local": {
+							CAFile:   "/etc/sycri/ca.pem",
+							CertFile: "/etc/sycri/client.pem",
+							KeyFile:  "/etc/sycri/client-key.pem",
+						},
+						"lab.local:5000": {
+							Insecure:  true,
+							PlainHTTP: true,
+						},
+					},
+					Rewrites: []RewriteConfig{
+						{
+							Prefix:      "docker.io/myorg/",
+							Replacement: "registry.local/myorg/",
+						},
+					},
+				},
+				Library: LibraryConfig{
+					URL:       "https://library.example.com",
+					KeyServer: "https://keys.example.com",
+					TokenFile: "/etc/sycri/library-token",
+					Domains: map[string]string{
+						"library.lab.local": "https://library.lab.local:8443",
+					},
+				},
+				Credentials: CredentialsConfig{
+					DockerConfig: "/var/lib/kubelet/config.json",
+					Helpers: map[string]string{
+						"gcr.io": "gcr",
+					},
+				},
+				Verification: VerificationConfig{
+					Mode:        "require-signed",
+					Offline:     true,
+					Keyring:     "/etc/sycri/pgp-public",
+					TrustedKeys: []string{"8883491F4268F173C6E5DC49EDECE4F3F38D871E"},
+					Rules: []VerificationRuleConfig{
+						{
+							Prefix: "docker.io/",
+							Mode:   "warn",
+						},
+						{
+							Prefix:      "cloud.sylabs.io/myorg/",
+							TrustedKeys: []string{"9F4268F173C6E5DC49EDECE4F3F38D871E888349"},
+						},
+					},
+				},
+				Admission: AdmissionConfig{
+					Default: "deny",
+					Rules: []AdmissionRuleConfig{
+						{
+							Repository: "docker.io/evil/*",
+							Action:     "deny",
+						},
+						{
+							Namespaces:    []string{"production"},
+							RequireDigest: true,
+						},
+						{
+							URI: "docker.io",
+						},
+					},
+				},
 			},
 			expectError: nil,
 		},
@@ -134,6 +273,32 @@ func TestValidConfig(t *testing.T) {
 			expectConfig: Config{},
 			expectError:  fmt.Errorf("directory to run containers cannot be empty"),
 		},
+		{
+			name: "offline verification without keyring",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Verification: VerificationConfig{
+					Offline: true,
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("keyring is required for offline verification"),
+		},
+		{
+			name: "admission rule matching all images",
+			input: Config{
+				ListenSocket: "/var/run/sycri.sock",
+				StorageDir:   "/var/lib/singularity",
+				BaseRunDir:   "/var/run/cri",
+				Admission: AdmissionConfig{
+					Rules: []AdmissionRuleConfig{{Action: "deny"}},
+				},
+			},
+			expectConfig: Config{},
+			expectError:  fmt.Errorf("admission rule 0 matches all images"),
+		},
 		{
 			name: "minimum valid",
 			input: Config{
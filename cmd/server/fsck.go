@@ -0,0 +1,89 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sylabs/singularity-cri/pkg/server/image"
+)
+
+// fsck checks image storage directory for consistency and, if asked, repairs it.
+// Sycri must be stopped while fsck is running. Returned value is an exit
+// code: 0 when storage is consistent or was repaired, 1 when problems were
+// found but not repaired and 2 when check could not be completed.
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	configPath := flags.String("config", "/usr/local/etc/sycri/sycri.yaml", "path to config file")
+	repair := flags.Bool("repair", false, "repair found problems")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s fsck [options]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Check image storage directory for consistency. Sycri must be stopped.\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	config, err := parseConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse config: %v\n", err)
+		return 2
+	}
+
+	report, err := image.Fsck(config.StorageDir, *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not check image storage: %v\n", err)
+		return 2
+	}
+	if report.IsClean() {
+		fmt.Printf("%s: no problems found\n", config.StorageDir)
+		return 0
+	}
+	fmt.Print(formatFsckReport(report))
+	if *repair {
+		fmt.Printf("%s: all problems are repaired\n", config.StorageDir)
+		return 0
+	}
+	fmt.Printf("%s: run with -repair to fix problems\n", config.StorageDir)
+	return 1
+}
+
+// formatFsckReport returns human readable representation of fsck report.
+func formatFsckReport(report *image.FsckReport) string {
+	var b strings.Builder
+	if report.Corrupted {
+		b.WriteString("registry info file is corrupted, registry needs to be rebuilt\n")
+	}
+	for _, path := range report.TempFiles {
+		fmt.Fprintf(&b, "dangling temporary file: %s\n", path)
+	}
+	for _, path := range report.Unreferenced {
+		fmt.Fprintf(&b, "unreferenced image file: %s\n", path)
+	}
+	for _, id := range report.Missing {
+		fmt.Fprintf(&b, "image file is missing: %s\n", id)
+	}
+	for _, id := range report.CorruptedImages {
+		fmt.Fprintf(&b, "image checksum mismatch: %s\n", id)
+	}
+	for _, path := range report.Expired {
+		fmt.Fprintf(&b, "expired partial download or quarantined image: %s\n", path)
+	}
+	return b.String()
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/sylabs/singularity-cri/pkg/fs"
+	pkgImage "github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/server/device"
 	"github.com/sylabs/singularity-cri/pkg/server/image"
@@ -61,6 +62,9 @@ func main() {
 		fmt.Println(version)
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsck(os.Args[2:]))
+	}
 
 	flag.Parse()
 	logs.InitLogs()
@@ -151,17 +155,142 @@ func main() {
 }
 
 func startCRI(ctx context.Context, wg *sync.WaitGroup, config Config) error {
-	imageIndex := index.NewImageIndex()
-	syImage, err := image.NewSingularityRegistry(config.StorageDir, imageIndex)
+	if config.FsckOnStartup {
+		report, err := image.Fsck(config.StorageDir, true)
+		if err != nil {
+			return fmt.Errorf("could not check image storage: %v", err)
+		}
+		if !report.IsClean() {
+			glog.Warningf("Image storage inconsistencies were found and repaired:\n%s", formatFsckReport(report))
+		}
+	}
+
+	pullPolicy := pkgImage.NewPullPolicy(pkgImage.PullPolicy{
+		MaxParallel: config.MaxParallelPulls,
+		Timeout:     config.PullTimeout,
+		Retry: pkgImage.RetryPolicy{
+			Attempts:       config.PullRetry.Attempts,
+			InitialBackoff: config.PullRetry.InitialBackoff,
+			MaxBackoff:     config.PullRetry.MaxBackoff,
+		},
+	})
+
+	var platform pkgImage.Platform
+	if config.Platform != "" {
+		var err error
+		platform, err = pkgImage.ParsePlatform(config.Platform)
+		if err != nil {
+			return fmt.Errorf("could not configure platform: %v", err)
+		}
+	}
+	registries := pkgImage.RegistryConfig{
+		Hosts: make(map[string]pkgImage.HostConfig, len(config.Registries.Hosts)),
+	}
+	for domain, host := range config.Registries.Hosts {
+		registries.Hosts[domain] = pkgImage.HostConfig{
+			Mirrors:   host.Mirrors,
+			CAFile:    host.CAFile,
+			CertFile:  host.CertFile,
+			KeyFile:   host.KeyFile,
+			Insecure:  host.Insecure,
+			PlainHTTP: host.PlainHTTP,
+		}
+	}
+	for _, rule := range config.Registries.Rewrites {
+		registries.Rewrites = append(registries.Rewrites, pkgImage.RewriteRule{
+			Prefix:      rule.Prefix,
+			Replacement: rule.Replacement,
+		})
+	}
+	syRegistries, err := pkgImage.NewRegistries(registries)
+	if err != nil {
+		return fmt.Errorf("could not configure registries: %v", err)
+	}
+	library := pkgImage.LibraryConfig{
+		URL:       config.Library.URL,
+		TokenFile: config.Library.TokenFile,
+		Domains:   config.Library.Domains,
+	}
+	syLibraries, err := pkgImage.NewLibraries(library)
+	if err != nil {
+		return fmt.Errorf("could not configure library: %v", err)
+	}
+	credentials := pkgImage.CredentialConfig{
+		DockerConfig: config.Credentials.DockerConfig,
+		Helpers:      config.Credentials.Helpers,
+	}
+	syCredentials, err := pkgImage.NewCredentials(credentials)
+	if err != nil {
+		return fmt.Errorf("could not configure credentials: %v", err)
+	}
+
+	keyServer := config.Verification.KeyServer
+	if keyServer == "" {
+		keyServer = config.Library.KeyServer
+	}
+	verification := pkgImage.VerifyPolicy{
+		Mode:        pkgImage.VerifyMode(config.Verification.Mode),
+		KeyServer:   keyServer,
+		Offline:     config.Verification.Offline,
+		Keyring:     config.Verification.Keyring,
+		TrustedKeys: config.Verification.TrustedKeys,
+	}
+	for _, rule := range config.Verification.Rules {
+		verification.Rules = append(verification.Rules, pkgImage.VerifyRule{
+			Prefix:      rule.Prefix,
+			Mode:        pkgImage.VerifyMode(rule.Mode),
+			TrustedKeys: rule.TrustedKeys,
+		})
+	}
+	syVerification, err := pkgImage.NewVerifyPolicy(verification)
+	if err != nil {
+		return fmt.Errorf("could not configure verification: %v", err)
+	}
+	admission := pkgImage.AdmissionPolicy{
+		Default: pkgImage.AdmissionAction(config.Admission.Default),
+	}
+	for _, rule := range config.Admission.Rules {
+		admission.Rules = append(admission.Rules, pkgImage.AdmissionRule{
+			URI:           rule.URI,
+			Repository:    rule.Repository,
+			Namespaces:    rule.Namespaces,
+			Action:        pkgImage.AdmissionAction(rule.Action),
+			RequireDigest: rule.RequireDigest,
+		})
+	}
+	syAdmission, err := pkgImage.NewAdmissionPolicy(admission)
+	if err != nil {
+		return fmt.Errorf("could not configure admission: %v", err)
+	}
+
+	imageIndex := index.NewImageIndex(syLibraries)
+	syImage, err := image.NewSingularityRegistry(
+		config.StorageDir,
+		imageIndex,
+		image.WithPlatform(platform),
+		image.WithPullPolicy(pullPolicy),
+		image.WithAdmissionPolicy(syAdmission),
+		image.WithVerifyPolicy(syVerification),
+		image.WithRegistries(syRegistries),
+		image.WithLibraries(syLibraries),
+		image.WithCredentials(syCredentials),
+	)
 	if err != nil {
 		return fmt.Errorf("could not create Singularity image service: %v", err)
 	}
+	if config.ImportDir != "" {
+		if err := syImage.WatchImportDir(ctx, config.ImportDir); err != nil {
+			return fmt.Errorf("could not import images: %v", err)
+		}
+	}
 	syRuntime, err := runtime.NewSingularityRuntime(
 		imageIndex,
 		runtime.WithStreaming(config.StreamingURL),
 		runtime.WithNetwork(config.CNIBinDir, config.CNIConfDir),
 		runtime.WithBaseRunDir(config.BaseRunDir),
 		runtime.WithTrashDir(config.TrashDir),
+		runtime.WithLiveRestore(config.LiveRestore),
+		runtime.WithGCInterval(config.GCInterval),
 	)
 	if err != nil {
 		return fmt.Errorf("could not create Singularity runtime service: %v", err)
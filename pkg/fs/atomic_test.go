@@ -0,0 +1,64 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "info.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("old"), 0600))
+
+	t.Run("failed write", func(t *testing.T) {
+		err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+			fmt.Fprint(w, "partial")
+			return fmt.Errorf("could not encode")
+		})
+		require.EqualError(t, err, "could not encode")
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "old", string(content), "file should be left intact")
+	})
+
+	t.Run("all ok", func(t *testing.T) {
+		err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+			_, err := fmt.Fprint(w, "new")
+			return err
+		})
+		require.NoError(t, err)
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "new", string(content))
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	})
+
+	fii, err := ioutil.ReadDir(dir)
+	require.NoError(t, err, "could not read temp directory")
+	require.Len(t, fii, 1, "temporary files are left")
+}
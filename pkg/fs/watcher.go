@@ -17,8 +17,13 @@ package fs
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -26,14 +31,40 @@ const (
 	OpUnsupported = Op(iota)
 	// OpRemove is used when watched file was removed.
 	OpRemove
-	// OpCreate is used when watched file was created.
+	// OpCreate is used when watched file was created. Created file
+	// may still be written to, see OpCloseWrite.
 	OpCreate
+	// OpWrite is used when watched file was written to.
+	OpWrite
+	// OpRename is used when watched file was renamed or moved away. New
+	// name, if it is watched as well, is reported with OpMoveIn.
+	OpRename
+	// OpCloseWrite is used when watched file opened for writing was closed,
+	// so those who need complete files should wait for it rather than OpWrite.
+	OpCloseWrite
+	// OpMoveIn is used when watched file was renamed or moved in. Unlike created
+	// files, moved in ones are usually complete, since they are written elsewhere.
+	OpMoveIn
 )
 
-// Watcher is a filesystem watcher that can be used
-// to watch filesystem changes.
+// watchMask is a set of inotify events Watcher subscribes to.
+const watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_DELETE |
+	unix.IN_DELETE_SELF | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_MOVE_SELF
+
+// Watcher is a filesystem watcher that can be used to watch filesystem changes.
+// Watcher is built on top of inotify, so unlike portable watchers it is able to
+// report when file written to is closed.
 type Watcher struct {
-	*fsnotify.Watcher
+	fd     int    // inotify instance
+	wakeup [2]int // pipe that interrupts reading events on Close
+
+	mu      sync.Mutex
+	watches map[int32]string // watched paths by watch descriptors
+
+	events    chan WatchEvent
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // Op is a separate type for watch file events.
@@ -46,23 +77,57 @@ type WatchEvent struct {
 }
 
 // NewWatcher creates new Watcher that will be watching passed files or directories
-// that already exist. Currently only create and remove operations are supported.
+// that already exist. Currently create, write, close-write, remove, rename and move in
+// operations are supported. Watcher should be closed with Close once not needed.
 // NOTE: when watching a single file no new event will be triggered after it's removal.
 func NewWatcher(files ...string) (*Watcher, error) {
-	watcher, err := fsnotify.NewWatcher()
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
 	if err != nil {
 		return nil, fmt.Errorf("could not create file watcher: %v", err)
 	}
+	w := &Watcher{
+		fd:      fd,
+		watches: make(map[int32]string),
+		events:  make(chan WatchEvent),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := unix.Pipe2(w.wakeup[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("could not create file watcher: %v", err)
+	}
+	go w.read()
 
 	for _, f := range files {
-		err = watcher.Add(f)
+		wd, err := unix.InotifyAddWatch(fd, f, watchMask)
 		if err != nil {
-			watcher.Close()
+			w.Close()
 			return nil, fmt.Errorf("could not add %s to file watcher: %v", f, err)
 		}
+		w.mu.Lock()
+		w.watches[int32(wd)] = filepath.Clean(f)
+		w.mu.Unlock()
 	}
+	return w, nil
+}
 
-	return &Watcher{Watcher: watcher}, nil
+// Close stops watching and releases all resources held by watcher.
+// Channel returned by Watch is closed as well, if it is not yet.
+func (w *Watcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		if _, werr := unix.Write(w.wakeup[1], []byte{0}); werr != nil {
+			err = fmt.Errorf("could not stop file watcher: %v", werr)
+		}
+		<-w.done
+		for _, fd := range []int{w.fd, w.wakeup[0], w.wakeup[1]} {
+			if cerr := unix.Close(fd); cerr != nil && err == nil {
+				err = fmt.Errorf("could not close file watcher: %v", cerr)
+			}
+		}
+	})
+	return err
 }
 
 // Watch starts filesystem watching, all occurred events will be sent
@@ -74,24 +139,15 @@ func (w *Watcher) Watch(ctx context.Context) <-chan WatchEvent {
 		defer close(events)
 		for {
 			select {
-			case event := <-w.Events:
-				var op Op
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					op = OpCreate
+			case event, ok := <-w.events:
+				if !ok {
+					return
 				}
-				if event.Op&fsnotify.Remove == fsnotify.Remove {
-					op = OpRemove
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
 				}
-				if op == OpUnsupported {
-					continue
-				}
-				events <- WatchEvent{
-					Path: event.Name,
-					Op:   op,
-				}
-			case err := <-w.Errors:
-				// we skip errors for now
-				_ = err
 			case <-ctx.Done():
 				return
 			}
@@ -99,3 +155,89 @@ func (w *Watcher) Watch(ctx context.Context) <-chan WatchEvent {
 	}()
 	return events
 }
+
+// read reads inotify events until watcher is closed.
+func (w *Watcher) read() {
+	defer close(w.done)
+	defer close(w.events)
+
+	var buf [unix.SizeofInotifyEvent * 4096]byte
+	fds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wakeup[0]), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Could not poll file watcher: %v", err)
+			return
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		n, err := unix.Read(w.fd, buf[:])
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Could not read file watcher events: %v", err)
+			return
+		}
+		if !w.send(buf[:n]) {
+			return
+		}
+	}
+}
+
+// send decodes inotify events in buf and sends them to watcher events channel.
+// It returns false if watcher is closed before all events are sent.
+func (w *Watcher) send(buf []byte) bool {
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		name := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+		offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+		w.mu.Lock()
+		path, ok := w.watches[raw.Wd]
+		if raw.Mask&unix.IN_IGNORED != 0 {
+			delete(w.watches, raw.Wd)
+		}
+		w.mu.Unlock()
+
+		op := eventOp(raw.Mask)
+		if !ok || op == OpUnsupported {
+			continue
+		}
+		if len(name) > 0 {
+			path = filepath.Join(path, strings.TrimRight(string(name), "\x00"))
+		}
+		select {
+		case w.events <- WatchEvent{Path: path, Op: op}:
+		case <-w.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// eventOp converts inotify event mask into file operation.
+func eventOp(mask uint32) Op {
+	switch {
+	case mask&unix.IN_CREATE != 0:
+		return OpCreate
+	case mask&unix.IN_MODIFY != 0:
+		return OpWrite
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		return OpCloseWrite
+	case mask&(unix.IN_DELETE|unix.IN_DELETE_SELF) != 0:
+		return OpRemove
+	case mask&(unix.IN_MOVED_FROM|unix.IN_MOVE_SELF) != 0:
+		return OpRename
+	case mask&unix.IN_MOVED_TO != 0:
+		return OpMoveIn
+	}
+	return OpUnsupported
+}
@@ -16,6 +16,7 @@ package fs
 
 import (
 	"context"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -71,6 +72,10 @@ func TestWatcher(t *testing.T) {
 		Path: file2,
 		Op:   OpCreate,
 	}, <-upd, "unexpected update")
+	require.Equal(t, WatchEvent{
+		Path: file2,
+		Op:   OpCloseWrite,
+	}, <-upd, "unexpected update")
 
 	f3, err := os.Create(file3)
 	require.NoError(t, err, "could not create test file")
@@ -79,11 +84,53 @@ func TestWatcher(t *testing.T) {
 		Path: file3,
 		Op:   OpCreate,
 	}, <-upd, "unexpected update")
+	require.Equal(t, WatchEvent{
+		Path: file3,
+		Op:   OpCloseWrite,
+	}, <-upd, "unexpected update")
+
+	f3, err = os.OpenFile(file3, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err, "could not open test file")
+	_, err = f3.Write([]byte("test"))
+	require.NoError(t, err, "could not write test file")
+	require.NoError(t, f3.Close())
+	require.Equal(t, WatchEvent{
+		Path: file3,
+		Op:   OpWrite,
+	}, <-upd, "unexpected update")
+	require.Equal(t, WatchEvent{
+		Path: file3,
+		Op:   OpCloseWrite,
+	}, <-upd, "unexpected update")
 
 	file2New := file2 + "_new"
 	require.NoError(t, os.Rename(file2, file2New), "could not rename test file")
+	require.Equal(t, WatchEvent{
+		Path: file2,
+		Op:   OpRename,
+	}, <-upd, "unexpected update")
 	require.Equal(t, WatchEvent{
 		Path: file2New,
-		Op:   OpCreate,
+		Op:   OpMoveIn,
 	}, <-upd, "unexpected update")
 }
+
+func TestWatcher_Close(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "fs-test-")
+	require.NoError(t, err, "could not create test directory")
+	defer os.RemoveAll(testDir)
+
+	watcher, err := NewWatcher(testDir)
+	require.NoError(t, err, "could not create watcher")
+	upd := watcher.Watch(context.Background())
+
+	// pending event must not prevent watcher from closing
+	require.NoError(t, ioutil.WriteFile(filepath.Join(testDir, "test"), nil, 0644))
+	require.NoError(t, watcher.Close(), "could not close watcher")
+	for range upd {
+	}
+	require.NoError(t, watcher.Close(), "second close should be no-op")
+
+	_, err = NewWatcher(filepath.Join(testDir, "missing"))
+	require.Error(t, err, "missing file should not be watched")
+}
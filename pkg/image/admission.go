@@ -0,0 +1,162 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/slice"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// AdmissionAction defines whether image matching admission rule may be pulled.
+type AdmissionAction string
+
+const (
+	// AdmissionAllow admits image for pulling.
+	AdmissionAllow AdmissionAction = "allow"
+	// AdmissionDeny rejects image before any network access.
+	AdmissionDeny AdmissionAction = "deny"
+)
+
+// AdmissionPolicy decides which images may be pulled. Rules are evaluated
+// in order and the first matching one wins; Default is applied when no
+// rule matches.
+type AdmissionPolicy struct {
+	// Default defaults to AdmissionAllow.
+	Default AdmissionAction
+	Rules   []AdmissionRule
+}
+
+// AdmissionRule matches images by their reference and namespace of
+// the pod they are pulled for. Empty fields match anything.
+type AdmissionRule struct {
+	// URI is matched against Reference.URI, e.g. docker.io or cloud.sylabs.io.
+	URI string
+	// Repository is a glob matched against full image name with tag or
+	// digest stripped, e.g. docker.io/library/*, quay.io/myorg/* or
+	// cloud.sylabs.io/sylabs/*/*. Domain is always present and docker
+	// official images have library namespace, * does not match slashes.
+	Repository string
+	// Namespaces are kubernetes namespaces rule applies to.
+	Namespaces []string
+	// Action defaults to AdmissionAllow.
+	Action AdmissionAction
+	// RequireDigest makes allowed images be rejected
+	// unless they are referenced by digest.
+	RequireDigest bool
+}
+
+// AdmissionError is returned when image is rejected by admission policy.
+type AdmissionError struct {
+	Ref    string
+	Reason string
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("image %s is rejected by admission policy: %s", e.Ref, e.Reason)
+}
+
+// NewAdmissionPolicy validates p and returns policy with defaults applied.
+func NewAdmissionPolicy(p AdmissionPolicy) (*AdmissionPolicy, error) {
+	if p.Default == "" {
+		p.Default = AdmissionAllow
+	}
+	if !validAction(p.Default) {
+		return nil, fmt.Errorf("unknown admission action %q", p.Default)
+	}
+	rules := make([]AdmissionRule, len(p.Rules))
+	for i, rule := range p.Rules {
+		if rule.Action == "" {
+			rule.Action = AdmissionAllow
+		}
+		if !validAction(rule.Action) {
+			return nil, fmt.Errorf("unknown admission action %q in rule %d", rule.Action, i)
+		}
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", rule.Repository, err)
+		}
+		rules[i] = rule
+	}
+	p.Rules = rules
+	return &p, nil
+}
+
+// Admit checks whether image referenced by ref may be pulled with auth for a pod
+// in namespace according to the policy p, nil policy admits any image. Rules are
+// matched against the full name of the image source before rewrite rules are applied,
+// so ctx should hold libraries images are pulled with. Every decision is logged
+// for audit. If image is rejected *AdmissionError is returned.
+func (p *AdmissionPolicy) Admit(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, namespace string) error {
+	if p == nil {
+		p = &AdmissionPolicy{Default: AdmissionAllow}
+	}
+
+	imgRef := sourceName(ctx, ref, auth)
+	rule, i := p.match(ref, imgRef, namespace)
+	action := p.Default
+	matched := "default policy"
+	if rule != nil {
+		action = rule.Action
+		matched = fmt.Sprintf("rule %d", i)
+	}
+
+	var reason string
+	switch {
+	case action == AdmissionDeny:
+		reason = "denied by " + matched
+	case rule != nil && rule.RequireDigest && len(ref.Digests()) == 0:
+		reason = "digest is required by " + matched
+	}
+	if reason != "" {
+		glog.Warningf("Admission: denied image %s for namespace %q: %s", imgRef, namespace, reason)
+		return &AdmissionError{Ref: imgRef, Reason: reason}
+	}
+	glog.Infof("Admission: allowed image %s for namespace %q by %s", imgRef, namespace, matched)
+	return nil
+}
+
+// match returns the first rule matching ref known by full name and
+// namespace along with its index, or nil if no rule matches.
+func (p *AdmissionPolicy) match(ref *Reference, name, namespace string) (*AdmissionRule, int) {
+	repo := repository(name)
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.URI != "" && rule.URI != ref.URI() {
+			continue
+		}
+		if rule.Repository != "" {
+			if ok, _ := path.Match(rule.Repository, repo); !ok {
+				continue
+			}
+		}
+		if len(rule.Namespaces) != 0 && !slice.ContainsString(rule.Namespaces, namespace) {
+			continue
+		}
+		return rule, i
+	}
+	return nil, -1
+}
+
+func validAction(action AdmissionAction) bool {
+	switch action {
+	case AdmissionAllow, AdmissionDeny:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestAdmit(t *testing.T) {
+	policy := AdmissionPolicy{
+		Default: AdmissionDeny,
+		Rules: []AdmissionRule{
+			{
+				Repository: "docker.io/evil/*",
+				Action:     AdmissionDeny,
+			},
+			{
+				Repository: "quay.io/evil/*",
+				Action:     AdmissionDeny,
+			},
+			{
+				Repository: "registry.local:5000/blocked/*",
+				Action:     AdmissionDeny,
+			},
+			{
+				Namespaces:    []string{"production"},
+				RequireDigest: true,
+			},
+			{
+				Repository: "docker.io/library/*",
+			},
+			{
+				Repository: "gcr.io/*/*",
+			},
+			{
+				URI: "oras",
+			},
+			{
+				Repository: "cloud.sylabs.io/sylabs/*/*",
+			},
+		},
+	}
+
+	tt := []struct {
+		name        string
+		policy      AdmissionPolicy
+		ref         string
+		auth        *k8s.AuthConfig
+		namespace   string
+		expectError string
+	}{
+		{
+			name:      "default allow",
+			policy:    AdmissionPolicy{},
+			ref:       "gcr.io/cri-tools/test-image-latest",
+			namespace: "default",
+		},
+		{
+			name:        "default deny",
+			policy:      policy,
+			ref:         "https://example.com/images/app.sif",
+			namespace:   "default",
+			expectError: "image https://example.com/images/app.sif is rejected by admission policy: denied by default policy",
+		},
+		{
+			name:      "official image",
+			policy:    policy,
+			ref:       "busybox:1.31",
+			namespace: "default",
+		},
+		{
+			name:      "official image with domain",
+			policy:    policy,
+			ref:       "docker.io/library/busybox:1.31",
+			namespace: "default",
+		},
+		{
+			name:        "docker hub image",
+			policy:      policy,
+			ref:         "someone/app:1.0",
+			namespace:   "default",
+			expectError: "image docker.io/someone/app:1.0 is rejected by admission policy: denied by default policy",
+		},
+		{
+			name:        "denied repository",
+			policy:      policy,
+			ref:         "evil/miner",
+			namespace:   "default",
+			expectError: "image docker.io/evil/miner:latest is rejected by admission policy: denied by rule 0",
+		},
+		{
+			name:        "denied repository in production",
+			policy:      policy,
+			ref:         "evil/miner@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			namespace:   "production",
+			expectError: "denied by rule 0",
+		},
+		{
+			name:        "denied quay repository",
+			policy:      policy,
+			ref:         "quay.io/evil/miner:1",
+			namespace:   "default",
+			expectError: "image quay.io/evil/miner:1 is rejected by admission policy: denied by rule 1",
+		},
+		{
+			name:        "denied registry with port",
+			policy:      policy,
+			ref:         "registry.local:5000/blocked/app:1.0",
+			namespace:   "default",
+			expectError: "denied by rule 2",
+		},
+		{
+			name:        "registry with port",
+			policy:      policy,
+			ref:         "registry.local:5000/team/app:1.0",
+			namespace:   "default",
+			expectError: "denied by default policy",
+		},
+		{
+			name:      "allowed gcr repository",
+			policy:    policy,
+			ref:       "gcr.io/foo/bar:1.0",
+			namespace: "default",
+		},
+		{
+			name:        "server address",
+			policy:      policy,
+			ref:         "busybox:1.31",
+			auth:        &k8s.AuthConfig{ServerAddress: "https://registry.local:5000"},
+			namespace:   "default",
+			expectError: "image registry.local:5000/busybox:1.31 is rejected by admission policy: denied by default policy",
+		},
+		{
+			name:      "allowed uri",
+			policy:    policy,
+			ref:       "oras://ghcr.io/myorg/app:1.0",
+			namespace: "default",
+		},
+		{
+			name:        "production tag",
+			policy:      policy,
+			ref:         "busybox:1.31",
+			namespace:   "production",
+			expectError: "digest is required by rule 3",
+		},
+		{
+			name:      "production digest",
+			policy:    policy,
+			ref:       "busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			namespace: "production",
+		},
+		{
+			name:      "production library digest",
+			policy:    policy,
+			ref:       "cloud.sylabs.io/sylabs/tests/busybox:sha256.8b5478b0f2962eba3982be245986eb0ea54f5164d90a65c078af5b83147009ba",
+			namespace: "production",
+		},
+		{
+			name:      "allowed library repository",
+			policy:    policy,
+			ref:       "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			namespace: "default",
+		},
+		{
+			name:        "glob does not match slashes",
+			policy:      policy,
+			ref:         "cloud.sylabs.io/sylabs/tests/nested/busybox:1.0.0",
+			namespace:   "default",
+			expectError: "denied by default policy",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewAdmissionPolicy(tc.policy)
+			require.NoError(t, err)
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			err = p.Admit(context.Background(), ref, tc.auth, tc.namespace)
+			if tc.expectError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.IsType(t, &AdmissionError{}, err)
+			require.Contains(t, err.Error(), tc.expectError)
+		})
+	}
+
+	t.Run("no policy", func(t *testing.T) {
+		ref, err := ParseRef("docker.io/evil/image:1.0")
+		require.NoError(t, err)
+		var p *AdmissionPolicy
+		require.NoError(t, p.Admit(context.Background(), ref, nil, "default"))
+	})
+}
+
+func TestNewAdmissionPolicy(t *testing.T) {
+	tt := []struct {
+		name        string
+		policy      AdmissionPolicy
+		expectError string
+	}{
+		{
+			name:   "defaults",
+			policy: AdmissionPolicy{},
+		},
+		{
+			name:        "unknown default",
+			policy:      AdmissionPolicy{Default: "block"},
+			expectError: `unknown admission action "block"`,
+		},
+		{
+			name: "unknown rule action",
+			policy: AdmissionPolicy{
+				Rules: []AdmissionRule{{URI: "docker.io", Action: "block"}},
+			},
+			expectError: `unknown admission action "block" in rule 0`,
+		},
+		{
+			name: "invalid pattern",
+			policy: AdmissionPolicy{
+				Rules: []AdmissionRule{{Repository: "docker.io/[evil"}},
+			},
+			expectError: `invalid repository pattern "docker.io/[evil"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewAdmissionPolicy(tc.policy)
+			if tc.expectError == "" {
+				require.NoError(t, err)
+				require.Equal(t, AdmissionAllow, p.Default)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectError)
+		})
+	}
+}
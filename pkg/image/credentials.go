@@ -0,0 +1,268 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// credentialHelperPrefix is a prefix of docker credential helper binaries,
+// e.g. docker-credential-ecr-login for ecr-login helper.
+const credentialHelperPrefix = "docker-credential-"
+
+// dockerHubIndex is a server address docker login keeps Docker Hub credentials under.
+const dockerHubIndex = "https://index.docker.io/v1/"
+
+// CredentialConfig describes where credentials for pulls that come
+// without ones, e.g. of static pods, are looked up.
+type CredentialConfig struct {
+	// DockerConfig is a path to docker config.json. Both static credentials
+	// in auths and credential helpers in credHelpers and credsStore are used.
+	DockerConfig string
+	// Helpers maps registry domain, e.g. gcr.io or cloud.sylabs.io, to credential
+	// helper name, e.g. gcr. Helpers set here take precedence over DockerConfig.
+	Helpers map[string]string
+}
+
+// dockerConfig is a subset of docker config.json that holds credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+
+type dockerAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// helperCredentials is an output of credential helper get command.
+type helperCredentials struct {
+	Username string
+	Secret   string
+}
+
+// Credentials holds validated credential config. Credentials should be created
+// with NewCredentials and are applied to pulls with ctx returned by WithCredentials.
+type Credentials struct {
+	cfg CredentialConfig
+}
+
+// NewCredentials returns credentials looked up as described by cfg. Docker
+// config is read right away to report any error with it, but it is reread on
+// each lookup so that changes are picked up without restart.
+func NewCredentials(cfg CredentialConfig) (*Credentials, error) {
+	if cfg.DockerConfig != "" {
+		if _, err := readDockerConfig(cfg.DockerConfig); err != nil {
+			return nil, err
+		}
+	}
+	helpers := make(map[string]string, len(cfg.Helpers))
+	for domain, helper := range cfg.Helpers {
+		if helper == "" {
+			return nil, fmt.Errorf("empty credential helper for %s", domain)
+		}
+		helpers[credentialKey(domain)] = helper
+	}
+	cfg.Helpers = helpers
+	return &Credentials{cfg: cfg}, nil
+}
+
+type credentialsKey struct{}
+
+// WithCredentials returns a copy of ctx that makes images pulled with
+// it fall back to credentials c when pull comes without ones.
+func WithCredentials(ctx context.Context, c *Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, c)
+}
+
+// credentialsFrom returns credential config set in ctx with WithCredentials.
+func credentialsFrom(ctx context.Context) CredentialConfig {
+	if c, ok := ctx.Value(credentialsKey{}).(*Credentials); ok && c != nil {
+		return c.cfg
+	}
+	return CredentialConfig{}
+}
+
+// hasCredentials returns true if auth holds anything to authenticate with.
+// Server address alone is not a credential.
+func hasCredentials(auth *k8s.AuthConfig) bool {
+	return auth.GetUsername() != "" || auth.GetPassword() != "" || auth.GetAuth() != "" ||
+		auth.GetIdentityToken() != "" || auth.GetRegistryToken() != ""
+}
+
+// resolveAuth returns auth to pull from registry known as domain with. Auth passed
+// with pull request is returned as is if it holds any credentials, otherwise credential
+// helpers and docker config set in ctx are consulted in that order. Failure
+// to get credentials is logged and anonymous pull is attempted.
+func resolveAuth(ctx context.Context, domain string, auth *k8s.AuthConfig) *k8s.AuthConfig {
+	if hasCredentials(auth) {
+		return auth
+	}
+
+	found, err := lookupCredentials(ctx, domain)
+	if err != nil {
+		glog.Warningf("Could not get credentials for %s, pulling anonymously: %v", domain, err)
+		return auth
+	}
+	if found == nil {
+		return auth
+	}
+	glog.V(4).Infof("Using configured credentials for %s", domain)
+	found.ServerAddress = auth.GetServerAddress()
+	return found
+}
+
+// lookupCredentials returns credentials set in ctx for domain, if any.
+func lookupCredentials(ctx context.Context, domain string) (*k8s.AuthConfig, error) {
+	cfg := credentialsFrom(ctx)
+	key := credentialKey(domain)
+	if helper, ok := cfg.Helpers[key]; ok {
+		return runCredentialHelper(ctx, helper, helperServer(key))
+	}
+	if cfg.DockerConfig == "" {
+		return nil, nil
+	}
+
+	config, err := readDockerConfig(cfg.DockerConfig)
+	if err != nil {
+		return nil, err
+	}
+	for host, helper := range config.CredHelpers {
+		if credentialKey(host) == key {
+			return runCredentialHelper(ctx, helper, host)
+		}
+	}
+	for host, auth := range config.Auths {
+		if credentialKey(host) == key {
+			return auth.decode()
+		}
+	}
+	if config.CredsStore != "" {
+		return runCredentialHelper(ctx, config.CredsStore, helperServer(key))
+	}
+	return nil, nil
+}
+
+func readDockerConfig(path string) (*dockerConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read docker config: %v", err)
+	}
+	var config dockerConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("could not decode docker config %s: %v", path, err)
+	}
+	return &config, nil
+}
+
+// decode returns k8s auth config holding credentials from docker config.
+// Base64 encoded auth field takes precedence over username and password.
+func (a dockerAuth) decode() (*k8s.AuthConfig, error) {
+	auth := &k8s.AuthConfig{
+		Username:      a.Username,
+		Password:      a.Password,
+		IdentityToken: a.IdentityToken,
+		RegistryToken: a.RegistryToken,
+	}
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode auth: %v", err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("auth should be in username:password form")
+		}
+		auth.Username, auth.Password = parts[0], parts[1]
+	}
+	if !hasCredentials(auth) {
+		return nil, nil
+	}
+	return auth, nil
+}
+
+// runCredentialHelper runs get command of docker credential helper, see
+// https://github.com/docker/docker-credential-helpers. Helper that has
+// no credentials for host is not considered an error.
+func runCredentialHelper(ctx context.Context, helper, host string) (*k8s.AuthConfig, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(host)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not run credential helper %s: %v: %s", helper, err, out)
+	}
+
+	var creds helperCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("could not decode credential helper %s output: %v", helper, err)
+	}
+	if creds.Secret == "" {
+		return nil, nil
+	}
+	// helpers report identity tokens with <token> username
+	if creds.Username == "<token>" {
+		return &k8s.AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return &k8s.AuthConfig{
+		Username: creds.Username,
+		Password: creds.Secret,
+	}, nil
+}
+
+// helperServer returns server URL credential helpers know registry domain
+// by. Docker Hub credentials are stored by docker login under its index URL.
+func helperServer(domain string) string {
+	if domain == singularity.DockerDomain {
+		return dockerHubIndex
+	}
+	return domain
+}
+
+// credentialKey returns registry domain credentials for host are kept under,
+// e.g. docker.io for https://index.docker.io/v1/ used by docker login.
+func credentialKey(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	if i := strings.IndexByte(host, '/'); i != -1 {
+		host = host[:i]
+	}
+	switch host {
+	case legacyDockerDomain, registry.DockerHubHost:
+		return singularity.DockerDomain
+	}
+	return host
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// fakeHelper is a credential helper that knows credentials of
+// registry.local and identity token of tokens.local.
+const fakeHelper = `#!/bin/sh
+[ "$1" = get ] || exit 1
+read server
+case "$server" in
+registry.local) echo '{"ServerURL":"registry.local","Username":"helper","Secret":"helper-secret"}' ;;
+tokens.local) echo '{"ServerURL":"tokens.local","Username":"<token>","Secret":"identity"}' ;;
+https://index.docker.io/v1/) echo '{"ServerURL":"docker.io","Username":"hub","Secret":"hub-secret"}' ;;
+*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+
+func TestWithCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, credentialHelperPrefix+"fake"), []byte(fakeHelper), 0755)
+	require.NoError(t, err, "could not write credential helper")
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	dockerConfig := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(dockerConfig, []byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("user:pass:word"))+`"},
+			"gcr.io": {"username": "_json_key", "password": "key"},
+			"cloud.sylabs.io": {"registrytoken": "library-token"},
+			"broken.local": {"auth": "not base64"}
+		},
+		"credHelpers": {
+			"registry.local": "fake",
+			"tokens.local": "fake",
+			"missing.local": "fake"
+		}
+	}`), 0644)
+	require.NoError(t, err, "could not write docker config")
+
+	creds, err := NewCredentials(CredentialConfig{
+		DockerConfig: dockerConfig,
+	})
+	require.NoError(t, err)
+	ctx := WithCredentials(context.Background(), creds)
+
+	tt := []struct {
+		name   string
+		domain string
+		auth   *k8s.AuthConfig
+		expect *k8s.AuthConfig
+	}{
+		{
+			name:   "request credentials",
+			domain: "gcr.io",
+			auth:   &k8s.AuthConfig{Username: "kubelet", Password: "secret"},
+			expect: &k8s.AuthConfig{Username: "kubelet", Password: "secret"},
+		},
+		{
+			name:   "docker hub auth",
+			domain: "docker.io",
+			expect: &k8s.AuthConfig{Username: "user", Password: "pass:word"},
+		},
+		{
+			name:   "username and password",
+			domain: "gcr.io",
+			auth:   &k8s.AuthConfig{ServerAddress: "gcr.io"},
+			expect: &k8s.AuthConfig{Username: "_json_key", Password: "key", ServerAddress: "gcr.io"},
+		},
+		{
+			name:   "library token",
+			domain: "cloud.sylabs.io",
+			expect: &k8s.AuthConfig{RegistryToken: "library-token"},
+		},
+		{
+			name:   "credential helper",
+			domain: "registry.local",
+			expect: &k8s.AuthConfig{Username: "helper", Password: "helper-secret"},
+		},
+		{
+			name:   "identity token",
+			domain: "tokens.local",
+			expect: &k8s.AuthConfig{IdentityToken: "identity"},
+		},
+		{
+			name:   "helper without credentials",
+			domain: "missing.local",
+		},
+		{
+			name:   "broken auth",
+			domain: "broken.local",
+		},
+		{
+			name:   "unknown registry",
+			domain: "quay.io",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := resolveAuth(ctx, tc.domain, tc.auth)
+			require.Equal(t, tc.expect, auth)
+		})
+	}
+
+	t.Run("configured helper", func(t *testing.T) {
+		creds, err := NewCredentials(CredentialConfig{
+			DockerConfig: dockerConfig,
+			Helpers: map[string]string{
+				"index.docker.io": "fake",
+			},
+		})
+		require.NoError(t, err)
+		auth := resolveAuth(WithCredentials(context.Background(), creds), "docker.io", nil)
+		require.Equal(t, &k8s.AuthConfig{Username: "hub", Password: "hub-secret"}, auth)
+	})
+}
+
+func TestNewCredentials(t *testing.T) {
+	_, err := NewCredentials(CredentialConfig{DockerConfig: "/no/such/config.json"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not read docker config")
+
+	_, err = NewCredentials(CredentialConfig{Helpers: map[string]string{"gcr.io": ""}})
+	require.EqualError(t, err, "empty credential helper for gcr.io")
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity-cri/pkg/slice"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// layoutDirPrefix is a prefix of temporary OCI layout
+	// directories created in image storage during docker pulls.
+	layoutDirPrefix = ".oci-"
+
+	layoutTag = "image"
+)
+
+// LayerCacheDir returns path to the directory where layers
+// of docker images pulled into location are cached.
+func LayerCacheDir(location string) string {
+	return filepath.Join(location, "blobs", "sha256")
+}
+
+// RemoveLayers removes passed layers from the cache of images pulled into
+// location. It is up to caller to make sure layers are no longer needed.
+func RemoveLayers(location string, layers []string) {
+	for _, layer := range layers {
+		path := filepath.Join(LayerCacheDir(location), strings.TrimPrefix(layer, "sha256:"))
+		glog.V(4).Infof("Removing cached layer %s", layer)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove cached layer %s: %v", layer, err)
+		}
+	}
+}
+
+// IsLayoutDir returns true if name looks like a temporary
+// OCI layout directory created during docker image pull.
+func IsLayoutDir(name string) bool {
+	return strings.HasPrefix(name, layoutDirPrefix)
+}
+
+// dockerSource serves images stored in docker registries, e.g. gcr.io/foo/bar:1.0.
+type dockerSource struct{}
+
+// Info is not supported since SIF is built locally and its checksum
+// is unknown until image is pulled.
+func (dockerSource) Info(context.Context, *Reference, *k8s.AuthConfig) (*Info, error) {
+	return nil, ErrNotSupported
+}
+
+func (dockerSource) Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return pullDocker(ctx, pullSource(ctx, ref, auth), auth, pullPath)
+}
+
+func (dockerSource) Digests(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) ([]string, error) {
+	dgst, err := manifestDigest(ctx, pullSource(ctx, ref, auth), auth)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(ref.String(), singularity.DockerDomain+"/")
+	return []string{repository(name) + "@" + dgst.String()}, nil
+}
+
+// pullDocker pulls docker image referenced by name, e.g. gcr.io/foo/bar:1.0, and
+// saves it as SIF at pullPath. Image is downloaded with native registry client into
+// a temporary OCI layout next to pullPath. Mirrors configured for the registry are
+// tried first, falling back to the registry itself. Only the download is native:
+// SIF requires squashfs root file system which cannot be assembled in process,
+// so layout is converted into SIF by singularity build, see buildSIF.
+// Layers are shared with other images through cache next to pullPath and
+// their digests are returned, even if pull fails.
+func pullDocker(ctx context.Context, name string, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	named, err := registryRef(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, reference := named.path, named.reference()
+
+	location := filepath.Dir(pullPath)
+	layoutDir, err := ioutil.TempDir(location, layoutDirPrefix)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("could not create OCI layout directory: %v", err))
+	}
+	defer func() {
+		if err := os.RemoveAll(layoutDir); err != nil {
+			glog.Errorf("Could not remove %s: %v", layoutDir, err)
+		}
+	}()
+
+	progress := func(p registry.Progress) {
+		if p.Downloaded == p.Total {
+			glog.V(4).Infof("Downloaded blob %s (%d bytes)", p.Digest, p.Total)
+		}
+	}
+	// layers of every manifest pulled, even partially, may be cached and
+	// are returned on error too, so that caller is able to clean them up
+	var layers []string
+	pull := func(client *registry.Client, host string) error {
+		glog.V(4).Infof("Pulling %s/%s:%s into %s", host, repo, reference, layoutDir)
+		manifest, _, err := client.PullLayout(ctx, repo, reference, layoutDir, layoutTag, PlatformFrom(ctx).spec(), progress)
+		if manifest != nil {
+			for _, layer := range manifest.Layers {
+				if !slice.ContainsString(layers, layer.Digest.String()) {
+					layers = append(layers, layer.Digest.String())
+				}
+			}
+		}
+		return err
+	}
+	endpoints := registryEndpoints(ctx, named.domain, named.registryHost(), auth)
+	err = pullFromRegistry(ctx, name, endpoints, pull, registry.WithBlobCache(location))
+	if err != nil {
+		return layers, registryError(err)
+	}
+
+	src := fmt.Sprintf("%s:%s:%s", singularity.OCILayoutProtocol, layoutDir, layoutTag)
+	if err := buildSIF(ctx, src, pullPath); err != nil {
+		return layers, err
+	}
+	return layers, nil
+}
+
+// registryError converts error returned by registry client into the one
+// suitable to be returned from pull backend.
+func registryError(err error) error {
+	if _, ok := err.(*permanentError); ok {
+		return err
+	}
+	if registry.IsNotFound(err) {
+		return ErrNotFound
+	}
+	if registry.IsPermanent(err) {
+		return permanent(fmt.Errorf("could not pull image from registry: %v", err))
+	}
+	return fmt.Errorf("could not pull image from registry: %v", err)
+}
+
+// buildSIF converts OCI image referenced by src, e.g. oci:/path/to/layout:tag,
+// into SIF at pullPath with singularity build. Image config is embedded into
+// SIF so that it is available later without original OCI image. Since src is
+// local, build never accesses network, but its failures are reported with
+// singularity stderr only and build progress is not observable.
+func buildSIF(ctx context.Context, src, pullPath string) error {
+	var errMsg bytes.Buffer
+	buildCmd := exec.CommandContext(ctx, singularity.RuntimeName, "build", "-F", pullPath, src)
+	buildCmd.Env = []string{
+		fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
+	}
+	buildCmd.Stderr = &errMsg
+	buildCmd.Stdout = ioutil.Discard
+	if err := buildCmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("could not build image: %v", ctx.Err())
+		}
+		return permanent(fmt.Errorf("could not build image: %s", &errMsg))
+	}
+	return nil
+}
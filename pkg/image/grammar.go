@@ -0,0 +1,194 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	_ "crypto/sha256" // register sha256 for digest package
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// Docker reference grammar, see
+// https://github.com/docker/distribution/blob/master/reference/reference.go.
+//
+//	reference       := name [ ":" tag ] [ "@" digest ]
+//	name            := [domain '/'] path-component ['/' path-component]*
+//	domain          := domain-component ['.' domain-component]* [':' port-number]
+//	domain-component := /([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])/
+//	port-number     := /[0-9]+/
+//	path-component  := alpha-numeric [separator alpha-numeric]*
+//	alpha-numeric   := /[a-z0-9]+/
+//	separator       := /[_.]|__|[-]*/
+//	tag             := /[\w][\w.-]{0,127}/
+//	digest          := algorithm ":" encoded
+var (
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])` +
+		`(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+const (
+	// maxNameLength limits length of repository name including domain.
+	maxNameLength = 255
+
+	legacyDockerDomain = "index.docker.io"
+	officialNamespace  = "library/"
+)
+
+// dockerRef holds parsed docker image reference.
+type dockerRef struct {
+	// domain is a registry host with optional port,
+	// always set, e.g. docker.io or localhost:5000
+	domain string
+	// path is a repository path within registry, official docker
+	// images are always in library namespace, e.g. library/busybox
+	path   string
+	tag    string
+	digest string
+}
+
+// parseDockerRef parses docker image reference, e.g. busybox, localhost:5000/foo/bar:1.0
+// or gcr.io/foo/bar:1.0@sha256:..., according to docker reference grammar. References
+// without registry host are resolved to docker.io and official images to library
+// namespace. Both tag and digest may be set, missing tag is not defaulted.
+func parseDockerRef(imgRef string) (*dockerRef, error) {
+	if imgRef == "" {
+		return nil, fmt.Errorf("reference is empty")
+	}
+
+	var ref dockerRef
+	name := imgRef
+	if i := strings.IndexByte(name, '@'); i != -1 {
+		dgst, err := digest.Parse(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest %q: %v", name[i+1:], err)
+		}
+		ref.digest = dgst.String()
+		name = name[:i]
+	}
+	if i := strings.LastIndexByte(name, ':'); i > strings.LastIndexByte(name, '/') {
+		ref.tag = name[i+1:]
+		name = name[:i]
+		if !tagRegexp.MatchString(ref.tag) {
+			return nil, fmt.Errorf("invalid tag %q", ref.tag)
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("repository name is empty")
+	}
+	if len(name) > maxNameLength {
+		return nil, fmt.Errorf("repository name must not be longer than %d characters", maxNameLength)
+	}
+
+	components := strings.Split(name, "/")
+	if len(components) > 1 && isDomain(components[0]) {
+		ref.domain = components[0]
+		components = components[1:]
+		if !domainRegexp.MatchString(ref.domain) {
+			return nil, fmt.Errorf("invalid registry host %q", ref.domain)
+		}
+	}
+	for _, c := range components {
+		if pathComponentRegexp.MatchString(c) {
+			continue
+		}
+		if c != strings.ToLower(c) {
+			return nil, fmt.Errorf("repository name must be lowercase")
+		}
+		return nil, fmt.Errorf("invalid repository name component %q", c)
+	}
+	ref.path = strings.Join(components, "/")
+
+	if ref.domain == "" || ref.domain == legacyDockerDomain {
+		ref.domain = singularity.DockerDomain
+	}
+	if ref.domain == singularity.DockerDomain && len(components) == 1 {
+		ref.path = officialNamespace + ref.path
+	}
+	return &ref, nil
+}
+
+// Name returns full repository name, e.g. docker.io/library/busybox.
+func (r *dockerRef) Name() string {
+	return r.domain + "/" + r.path
+}
+
+// FamiliarName returns repository name the way it is shown by docker, i.e.
+// without docker.io domain and library namespace, e.g. busybox or gcr.io/foo/bar.
+func (r *dockerRef) FamiliarName() string {
+	if r.domain != singularity.DockerDomain {
+		return r.Name()
+	}
+	path := r.path
+	if strings.HasPrefix(path, officialNamespace) && strings.Count(path, "/") == 1 {
+		path = strings.TrimPrefix(path, officialNamespace)
+	}
+	return path
+}
+
+// normalized appends tag and digest, if any, to name. Tag is kept along with
+// digest, e.g. busybox:1.31@sha256:..., so that image is both tagged and pinned
+// to content. Missing tag defaults to latest unless digest is set.
+func (r *dockerRef) normalized(name string) string {
+	tag := r.tag
+	if tag == "" && r.digest == "" {
+		tag = "latest"
+	}
+	if tag != "" {
+		name += ":" + tag
+	}
+	if r.digest != "" {
+		name += "@" + r.digest
+	}
+	return name
+}
+
+// registryHost returns host registry API is served on, which
+// differs from domain for Docker Hub only, e.g. registry-1.docker.io.
+func (r *dockerRef) registryHost() string {
+	if r.domain == singularity.DockerDomain {
+		return registry.DockerHubHost
+	}
+	return r.domain
+}
+
+// reference returns reference manifest should be requested with from
+// registry API. Digest, if set, takes precedence over tag, missing
+// tag defaults to latest.
+func (r *dockerRef) reference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	if r.tag == "" {
+		return "latest"
+	}
+	return r.tag
+}
+
+// registryRef parses name of the image stored in registry, e.g. gcr.io/foo/bar:1.0,
+// to be requested from registry API. Parse errors are permanent.
+func registryRef(name string) (*dockerRef, error) {
+	ref, err := parseDockerRef(name)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("could not parse image reference %s: %v", name, err))
+	}
+	return ref, nil
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+)
+
+func TestParseDockerRef(t *testing.T) {
+	const (
+		dgst      = "sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"
+		sha512Dgt = "sha512:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" +
+			"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	)
+
+	tt := []struct {
+		name           string
+		ref            string
+		expect         *dockerRef
+		expectFamiliar string
+		expectError    string
+	}{
+		{
+			name:           "official image",
+			ref:            "busybox",
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox"},
+			expectFamiliar: "busybox:latest",
+		},
+		{
+			name:           "official image with tag",
+			ref:            "busybox:1.31",
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox", tag: "1.31"},
+			expectFamiliar: "busybox:1.31",
+		},
+		{
+			name:           "official image with library namespace",
+			ref:            "library/busybox:1.31",
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox", tag: "1.31"},
+			expectFamiliar: "busybox:1.31",
+		},
+		{
+			name:           "official image with domain",
+			ref:            "docker.io/library/busybox",
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox"},
+			expectFamiliar: "busybox:latest",
+		},
+		{
+			name:           "official image with legacy domain",
+			ref:            "index.docker.io/busybox",
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox"},
+			expectFamiliar: "busybox:latest",
+		},
+		{
+			name:           "user image",
+			ref:            "sylabsio/lolcow",
+			expect:         &dockerRef{domain: "docker.io", path: "sylabsio/lolcow"},
+			expectFamiliar: "sylabsio/lolcow:latest",
+		},
+		{
+			name:           "nested library namespace",
+			ref:            "docker.io/library/foo/bar",
+			expect:         &dockerRef{domain: "docker.io", path: "library/foo/bar"},
+			expectFamiliar: "library/foo/bar:latest",
+		},
+		{
+			name:           "registry",
+			ref:            "gcr.io/google-containers/pause:3.1",
+			expect:         &dockerRef{domain: "gcr.io", path: "google-containers/pause", tag: "3.1"},
+			expectFamiliar: "gcr.io/google-containers/pause:3.1",
+		},
+		{
+			name:           "registry with port",
+			ref:            "myregistry:5000/team/app",
+			expect:         &dockerRef{domain: "myregistry:5000", path: "team/app"},
+			expectFamiliar: "myregistry:5000/team/app:latest",
+		},
+		{
+			name:           "registry with port and tag",
+			ref:            "myregistry:5000/team/app:1.0",
+			expect:         &dockerRef{domain: "myregistry:5000", path: "team/app", tag: "1.0"},
+			expectFamiliar: "myregistry:5000/team/app:1.0",
+		},
+		{
+			name:           "localhost",
+			ref:            "localhost/app",
+			expect:         &dockerRef{domain: "localhost", path: "app"},
+			expectFamiliar: "localhost/app:latest",
+		},
+		{
+			name:           "registry without namespace",
+			ref:            "quay.io/app",
+			expect:         &dockerRef{domain: "quay.io", path: "app"},
+			expectFamiliar: "quay.io/app:latest",
+		},
+		{
+			name:           "uppercase registry",
+			ref:            "Registry/app",
+			expect:         &dockerRef{domain: "Registry", path: "app"},
+			expectFamiliar: "Registry/app:latest",
+		},
+		{
+			name:           "digest",
+			ref:            "busybox@" + dgst,
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox", digest: dgst},
+			expectFamiliar: "busybox@" + dgst,
+		},
+		{
+			name:           "sha512 digest",
+			ref:            "busybox@" + sha512Dgt,
+			expect:         &dockerRef{domain: "docker.io", path: "library/busybox", digest: sha512Dgt},
+			expectFamiliar: "busybox@" + sha512Dgt,
+		},
+		{
+			name:           "tag and digest",
+			ref:            "myregistry:5000/team/app:1.0@" + dgst,
+			expect:         &dockerRef{domain: "myregistry:5000", path: "team/app", tag: "1.0", digest: dgst},
+			expectFamiliar: "myregistry:5000/team/app:1.0@" + dgst,
+		},
+		{
+			name:           "separators",
+			ref:            "gcr.io/my-org/my__app.v2_x---y:v1.0-rc_1",
+			expect:         &dockerRef{domain: "gcr.io", path: "my-org/my__app.v2_x---y", tag: "v1.0-rc_1"},
+			expectFamiliar: "gcr.io/my-org/my__app.v2_x---y:v1.0-rc_1",
+		},
+		{
+			name:        "empty",
+			ref:         "",
+			expectError: "reference is empty",
+		},
+		{
+			name:        "only tag",
+			ref:         ":1.0",
+			expectError: "repository name is empty",
+		},
+		{
+			name:        "uppercase repository",
+			ref:         "sylabsio/LolCow",
+			expectError: "repository name must be lowercase",
+		},
+		{
+			name:        "invalid separator",
+			ref:         "foo/_bar",
+			expectError: `invalid repository name component "_bar"`,
+		},
+		{
+			name:        "empty component",
+			ref:         "gcr.io/foo//bar",
+			expectError: `invalid repository name component ""`,
+		},
+		{
+			name:        "invalid registry host",
+			ref:         "my_registry.io/app",
+			expectError: `invalid registry host "my_registry.io"`,
+		},
+		{
+			name:        "invalid port",
+			ref:         "myregistry:port/app",
+			expectError: `invalid registry host "myregistry:port"`,
+		},
+		{
+			name:        "invalid tag",
+			ref:         "busybox:.1",
+			expectError: `invalid tag ".1"`,
+		},
+		{
+			name:        "too long tag",
+			ref:         "busybox:" + strings.Repeat("a", 129),
+			expectError: "invalid tag",
+		},
+		{
+			name:        "invalid digest",
+			ref:         "busybox@sha256:abc",
+			expectError: `invalid digest "sha256:abc"`,
+		},
+		{
+			name:        "unknown digest algorithm",
+			ref:         "busybox@md5:d41d8cd98f00b204e9800998ecf8427e",
+			expectError: `invalid digest "md5:d41d8cd98f00b204e9800998ecf8427e"`,
+		},
+		{
+			name:        "too long name",
+			ref:         "gcr.io/" + strings.Repeat("a", 250),
+			expectError: "repository name must not be longer than 255 characters",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := parseDockerRef(tc.ref)
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, ref)
+			require.Equal(t, tc.expectFamiliar, ref.normalized(ref.FamiliarName()))
+		})
+	}
+}
+
+func TestRegistryRef(t *testing.T) {
+	const dgst = "sha256:31b8e90a349d1fce7621f5a5a08e4fc519b634f7d3feb09d53fac9b12aa4d991"
+
+	tt := []struct {
+		ref             string
+		expectHost      string
+		expectRepo      string
+		expectReference string
+		expectError     string
+	}{
+		{
+			ref:             "busybox",
+			expectHost:      registry.DockerHubHost,
+			expectRepo:      "library/busybox",
+			expectReference: "latest",
+		},
+		{
+			ref:             "docker.io/library/busybox:1.31",
+			expectHost:      registry.DockerHubHost,
+			expectRepo:      "library/busybox",
+			expectReference: "1.31",
+		},
+		{
+			ref:             "index.docker.io/sylabsio/lolcow:latest",
+			expectHost:      registry.DockerHubHost,
+			expectRepo:      "sylabsio/lolcow",
+			expectReference: "latest",
+		},
+		{
+			ref:             "gcr.io/google-containers/pause:3.1",
+			expectHost:      "gcr.io",
+			expectRepo:      "google-containers/pause",
+			expectReference: "3.1",
+		},
+		{
+			ref:             "localhost:5000/foo/bar",
+			expectHost:      "localhost:5000",
+			expectRepo:      "foo/bar",
+			expectReference: "latest",
+		},
+		{
+			ref:             "docker.io/library/nginx@" + dgst,
+			expectHost:      registry.DockerHubHost,
+			expectRepo:      "library/nginx",
+			expectReference: dgst,
+		},
+		{
+			ref:             "localhost:5000/nginx:1.17@" + dgst,
+			expectHost:      "localhost:5000",
+			expectRepo:      "nginx",
+			expectReference: dgst,
+		},
+		{
+			ref:         "gcr.io/Foo/bar",
+			expectError: "could not parse image reference gcr.io/Foo/bar: repository name must be lowercase",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			ref, err := registryRef(tc.ref)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectHost, ref.registryHost())
+			require.Equal(t, tc.expectRepo, ref.path)
+			require.Equal(t, tc.expectReference, ref.reference())
+		})
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+const (
+	// partialPrefix is a prefix of partially downloaded files kept in
+	// image storage so that interrupted downloads can be resumed.
+	partialPrefix = ".partial-"
+	// validatorSuffix is a suffix of files that hold ETag or Last-Modified
+	// of the partially downloaded content to resume download safely.
+	validatorSuffix = ".validator"
+
+	digestFragment = "#sha256="
+
+	// lockRetryInterval is how often locked partial download is checked
+	// while another pull of the same image holds the lock.
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// httpSource serves SIF images downloaded directly from web servers.
+type httpSource struct{}
+
+func (httpSource) Info(context.Context, *Reference, *k8s.AuthConfig) (*Info, error) {
+	return nil, ErrNotSupported
+}
+
+func (httpSource) Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return nil, pullHTTP(ctx, ref, auth, pullPath)
+}
+
+func (httpSource) Digests(context.Context, *Reference, *k8s.AuthConfig) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// pullHTTP downloads SIF image referenced by ref, e.g. https://example.com/app.sif,
+// into pullPath. Interrupted downloads are kept in storage next to pullPath and
+// are resumed with range requests by the next attempt. Partial download is locked
+// so that concurrent pulls of ref, e.g. with different credentials, take turns.
+// Sha256 digest fragment ref may end with, e.g. app.sif#sha256=<hex>, is not
+// checked here, since Pull verifies pulled image against it anyway.
+func pullHTTP(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
+	url := pullSource(ctx, ref, auth)
+
+	partial := partialPath(filepath.Dir(pullPath), ref.String(), "")
+	lock, err := lockPartial(ctx, partial)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	client, _ := registriesFrom(ctx).hostTransport(urlHost(url))
+	if err := download(ctx, client, url, auth, partial); err != nil {
+		// keep partial download only when it may be resumed by the next attempt
+		if _, ok := err.(*permanentError); ok || err == ErrNotFound {
+			removePartial(partial)
+		}
+		return err
+	}
+
+	return commitPartial(partial, "", pullPath)
+}
+
+// commitPartial moves completed download from partial to path. If expected
+// hex encoded sha256 digest is not empty, download is verified against it
+// first and is quarantined on mismatch with *DigestMismatchError returned.
+func commitPartial(partial, expected, path string) error {
+	if expected != "" {
+		checksum, err := Checksum(partial)
+		if err != nil {
+			return err
+		}
+		if checksum != expected {
+			err := &DigestMismatchError{
+				Expected: expected,
+				Actual:   checksum,
+				Path:     quarantine(partial, checksum),
+			}
+			removePartial(partial)
+			return permanent(err)
+		}
+	}
+
+	if err := os.Rename(partial, path); err != nil {
+		return fmt.Errorf("could not move downloaded image: %v", err)
+	}
+	removePartial(partial)
+	return nil
+}
+
+// download fetches content at url into path. If path already holds a part
+// of the content download is resumed from where it was interrupted.
+func download(ctx context.Context, client *http.Client, url string, auth *k8s.AuthConfig, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return permanent(fmt.Errorf("could not open file to download image: %v", err))
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("could not seek to the end of partial download: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return permanent(fmt.Errorf("could not create request: %v", err))
+	}
+	req = req.WithContext(ctx)
+	setAuth(req, auth)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if validator := readValidator(path); validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	glog.V(4).Infof("Downloading %s from byte %d", url, offset)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not download image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if err != nil || start != offset {
+			removePartial(path)
+			return fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+		glog.V(2).Infof("Resuming download of %s from byte %d", url, offset)
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			glog.V(2).Infof("Server doesn't support resume or content of %s changed, downloading from scratch", url)
+		}
+		if err := f.Truncate(0); err != nil {
+			return fmt.Errorf("could not truncate partial download: %v", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("could not seek to the start of partial download: %v", err)
+		}
+		writeValidator(path, resp.Header)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// partial download is complete if its size matches the size reported
+		// by server, otherwise content has changed and we should start over
+		var size int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size)
+		if err == nil && size == offset {
+			return nil
+		}
+		removePartial(path)
+		return fmt.Errorf("could not resume download: %s", resp.Status)
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("could not download image: %s", resp.Status)
+	default:
+		return permanent(fmt.Errorf("could not download image: %s", resp.Status))
+	}
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("could not download image: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close downloaded image: %v", err)
+	}
+	return nil
+}
+
+// setAuth sets authorization header according to auth. Tokens are sent
+// as bearer ones, username and password are used for basic auth.
+func setAuth(req *http.Request, auth *k8s.AuthConfig) {
+	switch {
+	case auth.GetRegistryToken() != "":
+		req.Header.Set("Authorization", "Bearer "+auth.GetRegistryToken())
+	case auth.GetIdentityToken() != "":
+		req.Header.Set("Authorization", "Bearer "+auth.GetIdentityToken())
+	case auth.GetUsername() != "" || auth.GetPassword() != "":
+		req.SetBasicAuth(auth.GetUsername(), auth.GetPassword())
+	}
+}
+
+// splitDigestFragment splits ref into URL and expected hex encoded sha256 digest.
+func splitDigestFragment(ref string) (string, string) {
+	i := strings.LastIndex(ref, digestFragment)
+	if i == -1 {
+		return ref, ""
+	}
+	return ref[:i], strings.ToLower(ref[i+len(digestFragment):])
+}
+
+// partialPath returns path to partially downloaded content of ref in location.
+// Non empty version, e.g. expected hash, distinguishes downloads of the same ref
+// made at different times, e.g. when ref is a tag that was moved.
+func partialPath(location, ref, version string) string {
+	name := fmt.Sprintf("%s%x", partialPrefix, sha256.Sum256([]byte(ref)))
+	if version != "" {
+		name += fmt.Sprintf("-%x", sha256.Sum256([]byte(version)))
+	}
+	return filepath.Join(location, name)
+}
+
+// lockPartial opens partial download at path, creating it if needed, and locks it
+// exclusively waiting for concurrent pulls that hold the lock. Lock is released
+// when returned file is closed. Since previous lock holder may commit or remove
+// partial download, locked file is reopened unless it is still found at path.
+func lockPartial(ctx context.Context, path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, permanent(fmt.Errorf("could not open partial download: %v", err))
+		}
+		if err := flock(ctx, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not stat partial download: %v", err)
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+// flock places exclusive lock on f polling until it is acquired or ctx is done.
+func flock(ctx context.Context, f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return fmt.Errorf("could not lock partial download: %v", err)
+		}
+		glog.V(5).Infof("Partial download %s is locked, waiting", f.Name())
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("could not lock partial download: %v", ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// removeStalePartials removes partial downloads of ref in location
+// other than the one at keep, e.g. left before ref was moved.
+func removeStalePartials(location, ref, keep string) {
+	pattern := partialPath(location, ref, "") + "*"
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		glog.Errorf("Could not find partial downloads of %s: %v", ref, err)
+		return
+	}
+	for _, path := range matches {
+		partial, ok := PartialFile(filepath.Base(path))
+		if !ok || partial == filepath.Base(keep) {
+			continue
+		}
+		glog.V(2).Infof("Removing stale partial download %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove %s: %v", path, err)
+		}
+	}
+}
+
+// PartialFile returns true if name looks like a partially downloaded image
+// kept to resume its download or like a validator of one. Returned is the
+// name of the partially downloaded image file name belongs to.
+func PartialFile(name string) (string, bool) {
+	if !strings.HasPrefix(name, partialPrefix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, validatorSuffix), true
+}
+
+func readValidator(path string) string {
+	validator, err := ioutil.ReadFile(path + validatorSuffix)
+	if err != nil {
+		return ""
+	}
+	return string(validator)
+}
+
+// writeValidator saves strong ETag or Last-Modified of the content being
+// downloaded to path, so that download can be resumed with If-Range.
+func writeValidator(path string, header http.Header) {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		os.Remove(path + validatorSuffix)
+		return
+	}
+	if err := ioutil.WriteFile(path+validatorSuffix, []byte(validator), 0644); err != nil {
+		glog.Errorf("Could not save download validator: %v", err)
+	}
+}
+
+func removePartial(path string) {
+	for _, p := range []string{path, path + validatorSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove %s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPullHTTP(t *testing.T) {
+	sif := bytes.Repeat([]byte("pretend this is a SIF file\n"), 100)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(sif))
+	modTime := time.Now().Add(-time.Hour)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/basic/"):
+			if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case strings.HasPrefix(r.URL.Path, "/bearer/"):
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		if !strings.HasSuffix(r.URL.Path, "/app.sif") {
+			http.NotFound(w, r)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "app.sif", modTime, bytes.NewReader(sif))
+	}))
+	defer server.Close()
+
+	storage, err := ioutil.TempDir("", "http-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	tt := []struct {
+		name        string
+		ref         string
+		auth        *k8s.AuthConfig
+		partial     []byte
+		validator   string
+		expectRange string
+		expectError string
+	}{
+		{
+			name: "no digest",
+			ref:  server.URL + "/images/app.sif",
+		},
+		{
+			name: "digest",
+			ref:  server.URL + "/images/app.sif#sha256=" + checksum,
+		},
+		{
+			name:        "digest mismatch",
+			ref:         server.URL + "/images/app.sif#sha256=" + strings.Repeat("0", 64),
+			expectError: "digest mismatch",
+		},
+		{
+			name: "basic auth",
+			ref:  server.URL + "/basic/app.sif",
+			auth: &k8s.AuthConfig{
+				Username: "user",
+				Password: "password",
+			},
+		},
+		{
+			name: "bearer auth",
+			ref:  server.URL + "/bearer/app.sif",
+			auth: &k8s.AuthConfig{
+				RegistryToken: "token",
+			},
+		},
+		{
+			name:        "unauthorized",
+			ref:         server.URL + "/basic/app.sif",
+			expectError: "401 Unauthorized",
+		},
+		{
+			name:        "not found",
+			ref:         server.URL + "/images/missing.sif",
+			expectError: ErrNotFound.Error(),
+		},
+		{
+			name:        "resume",
+			ref:         server.URL + "/images/app.sif#sha256=" + checksum,
+			partial:     sif[:1000],
+			validator:   `"v1"`,
+			expectRange: "bytes=1000-",
+		},
+		{
+			name:        "resume changed content",
+			ref:         server.URL + "/images/app.sif",
+			partial:     []byte("old content"),
+			validator:   `"v0"`,
+			expectRange: "bytes=11-",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges = nil
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			require.Equal(t, singularity.HTTPDomain, ref.URI())
+
+			partial := partialPath(storage, ref.String(), "")
+			if tc.partial != nil {
+				require.NoError(t, ioutil.WriteFile(partial, tc.partial, 0644))
+				require.NoError(t, ioutil.WriteFile(partial+validatorSuffix, []byte(tc.validator), 0644))
+			}
+
+			info, _, err := Pull(context.Background(), nil, storage, ref, tc.auth, "")
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, checksum, info.ID)
+				require.Equal(t, []string{tc.ref}, info.Ref.Tags())
+				content, err := ioutil.ReadFile(info.Path)
+				require.NoError(t, err)
+				require.Equal(t, sif, content)
+			}
+			if tc.expectRange != "" {
+				require.Equal(t, []string{tc.expectRange}, ranges)
+			}
+			_, err = os.Stat(partial)
+			require.True(t, os.IsNotExist(err), "partial download is left")
+		})
+	}
+
+	files, err := filepath.Glob(filepath.Join(storage, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, files, "temporary files are left in storage")
+}
+
+func TestLockPartial(t *testing.T) {
+	storage, err := ioutil.TempDir("", "http-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	path := partialPath(storage, "https://example.com/app.sif", "")
+	first, err := lockPartial(context.Background(), path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*lockRetryInterval)
+	defer cancel()
+	_, err = lockPartial(ctx, path)
+	require.EqualError(t, err, "could not lock partial download: context deadline exceeded")
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	locked := make(chan result)
+	go func() {
+		f, err := lockPartial(context.Background(), path)
+		locked <- result{f, err}
+	}()
+
+	// download is committed by the first pull while the second one waits
+	committed := filepath.Join(storage, "committed")
+	require.NoError(t, os.Rename(path, committed))
+	require.NoError(t, first.Close())
+
+	second := <-locked
+	require.NoError(t, second.err)
+	defer second.f.Close()
+	lockedInfo, err := second.f.Stat()
+	require.NoError(t, err)
+	pathInfo, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(pathInfo, lockedInfo), "new partial download is not locked")
+	committedInfo, err := os.Stat(committed)
+	require.NoError(t, err)
+	require.False(t, os.SameFile(committedInfo, lockedInfo), "committed download is locked")
+}
+
+func TestSplitDigestFragment(t *testing.T) {
+	url, digest := splitDigestFragment("https://example.com/app.sif#sha256=ABCDEF")
+	require.Equal(t, "https://example.com/app.sif", url)
+	require.Equal(t, "abcdef", digest)
+
+	url, digest = splitDigestFragment("https://example.com/app.sif")
+	require.Equal(t, "https://example.com/app.sif", url)
+	require.Equal(t, "", digest)
+}
@@ -21,22 +21,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/golang/glog"
 	specs "github.com/opencontainers/image-spec/specs-go/v1"
-	library "github.com/sylabs/scs-library-client/client"
+	"github.com/sylabs/sif/pkg/sif"
 	"github.com/sylabs/singularity-cri/pkg/rand"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
 	"github.com/sylabs/singularity-cri/pkg/slice"
 	"github.com/sylabs/singularity/pkg/image"
-	"github.com/sylabs/singularity/pkg/signing"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 )
 
@@ -63,6 +59,11 @@ type Info struct {
 	Path      string             `json:"path"`
 	Ref       *Reference         `json:"ref"`
 	OciConfig *specs.ImageConfig `json:"ociConfig,omitempty"`
+	// Layers are digests of cached docker layers image was built from.
+	Layers []string `json:"layers,omitempty"`
+	// Platform is os/arch[/variant] image was selected for, it is
+	// empty for images that are pulled regardless of platform.
+	Platform string `json:"platform,omitempty"`
 
 	mu     sync.RWMutex
 	usedBy []string
@@ -99,14 +100,29 @@ func (i *Info) UsedBy() []string {
 }
 
 // Pull pulls image referenced by ref and saves it to the passed location.
-func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+// Pull is subject to the passed policy, nil policy means the image is pulled
+// once with no limits. Registries and credentials set in ctx with WithRegistries
+// and WithCredentials are used to reach the image source. If expected hex
+// encoded sha256 digest is not empty, pulled image is verified against it.
+// On mismatch *DigestMismatchError is returned and pulled file is moved to
+// QuarantineDir(location) for inspection. Expected digest is known from
+// ResolveInfo for library images, i.e. image hash, and for ORAS images, i.e.
+// SIF layer digest. If expected digest is empty, sha256 digest fragment of
+// HTTP ref is expected. Docker and local OCI images are built into SIF locally,
+// so their checksum is not known in advance and nothing is expected for them.
+// Local images are used in place, so expected digest is not checked for them.
+// Returned are also digests of cached docker layers fetched by all pull attempts,
+// even if pull fails, so that caller is able to remove the ones nothing relies on.
+// On success they are the same as layers of the returned image.
+func Pull(ctx context.Context, policy *PullPolicy, location string, ref *Reference,
+	auth *k8s.AuthConfig, expected string) (*Info, []string, error) {
 	if ref.URI() == singularity.LocalFileDomain {
-		info, err := sifInfo(strings.TrimPrefix(ref.tags[0], singularity.LocalFileDomain))
-		if err != nil {
-			return nil, fmt.Errorf("could not fetch local SIF info: %v", err)
-		}
-		info.Ref = ref
-		return info, nil
+		info, err := ResolveInfo(ctx, ref, auth)
+		return info, nil, err
+	}
+	expected = strings.ToLower(expected)
+	if expected == "" && ref.URI() == singularity.HTTPDomain {
+		_, expected = splitDigestFragment(ref.String())
 	}
 
 	pullPath := filepath.Join(location, "."+rand.GenerateID(64))
@@ -117,15 +133,57 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 		}
 	}
 
-	err := pullImage(ctx, ref, auth, pullPath)
+	p := PullPolicy{Retry: RetryPolicy{Attempts: 1}}
+	if policy != nil {
+		p = *policy
+	}
+	release, err := acquireSlot(ctx, ref, p.slots)
 	if err != nil {
-		cleanup()
-		return nil, fmt.Errorf("could not pull image: %v", err)
+		return nil, nil, fmt.Errorf("could not start pull: %v", err)
+	}
+	defer release()
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var layers []string
+	err = retry(ctx, p.Retry, ref, func(ctx context.Context) error {
+		fetched, err := pullImage(ctx, ref, auth, pullPath)
+		for _, layer := range fetched {
+			if !slice.ContainsString(layers, layer) {
+				layers = append(layers, layer)
+			}
+		}
+		if err != nil {
+			cleanup()
+		}
+		return err
+	})
+	if err == ErrNotFound {
+		return nil, layers, err
+	}
+	if derr, ok := err.(*DigestMismatchError); ok {
+		derr.Ref = ref.String()
+		return nil, layers, derr
+	}
+	if err != nil {
+		return nil, layers, fmt.Errorf("could not pull image: %v", err)
 	}
 	info, err := sifInfo(pullPath)
 	if err != nil {
 		cleanup()
-		return nil, fmt.Errorf("could not fetch SIF info: %v", err)
+		return nil, layers, fmt.Errorf("could not fetch SIF info: %v", err)
+	}
+	if expected != "" && info.Sha256 != expected {
+		return nil, layers, &DigestMismatchError{
+			Ref:      ref.String(),
+			Expected: expected,
+			Actual:   info.Sha256,
+			Path:     quarantine(pullPath, info.Sha256),
+		}
 	}
 
 	path := filepath.Join(location, info.Sha256)
@@ -133,11 +191,57 @@ func Pull(ctx context.Context, location string, ref *Reference, auth *k8s.AuthCo
 	err = os.Rename(pullPath, path)
 	if err != nil {
 		cleanup()
-		return nil, fmt.Errorf("could not save pulled image: %v", err)
+		return nil, layers, fmt.Errorf("could not save pulled image: %v", err)
 	}
 
 	info.Path = path
+	info.Layers = layers
 	info.Ref = ref
+	if selectsPlatform(ref.URI()) {
+		info.Platform = PlatformFrom(ctx).String()
+	}
+	return info, layers, nil
+}
+
+// Load returns info of the image that was previously pulled to path. Since
+// original reference of the image is unknown, returned image has no tags
+// or digests and can be referenced only by its ID.
+func Load(path string) (*Info, error) {
+	info, err := sifInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch SIF info: %v", err)
+	}
+	info.Ref = &Reference{}
+	return info, nil
+}
+
+// Import returns info of SIF image at path that is used in place the same
+// way local.file images are, i.e. it is never copied into storage and never
+// removed. Image is referenced both by path with local.file prefix and by
+// passed tags, e.g. app:v3, that are normalized the way docker ones are.
+// File without SIF header is rejected, e.g. when it is still being copied.
+func Import(path string, tags ...string) (*Info, error) {
+	// tags never have domain, so no library config is needed
+	var l *Libraries
+	refTags := []string{singularity.LocalFileDomain + path}
+	for _, tag := range tags {
+		norm, err := l.normalizeRef(tag)
+		if err != nil {
+			return nil, err
+		}
+		refTags = append(refTags, norm)
+	}
+	if err := checkSIFHeader(path); err != nil {
+		return nil, err
+	}
+	info, err := sifInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch SIF info: %v", err)
+	}
+	info.Ref = &Reference{
+		uri:  singularity.LocalFileDomain,
+		tags: refTags,
+	}
 	return info, nil
 }
 
@@ -148,33 +252,7 @@ func LibraryInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*In
 	if ref.URI() != singularity.LibraryDomain {
 		return nil, ErrNotLibrary
 	}
-
-	pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
-	config := &library.Config{
-		BaseURL:   auth.GetServerAddress(),
-		AuthToken: auth.GetPassword(),
-	}
-	client, err := library.NewClient(config)
-	if err != nil {
-		return nil, fmt.Errorf("could not create library client: %v", err)
-	}
-	img, err := client.GetImage(ctx, runtime.GOARCH, pullURL)
-	if err == library.ErrNotFound {
-		return nil, ErrNotFound
-	}
-	if err != nil {
-		return nil, fmt.Errorf("could not get library image info: %v", err)
-	}
-
-	// library API uses sha256 hash func and returns image hash in form sha256.<hash>
-	// we need to trim it before it can be used
-	id := strings.TrimPrefix(img.Hash, "sha256.")
-	return &Info{
-		ID:     id,
-		Sha256: id,
-		Size:   uint64(img.Size),
-		Ref:    ref,
-	}, nil
+	return ResolveInfo(ctx, ref, auth)
 }
 
 // Remove removes image from the host filesystem. It makes sure
@@ -199,23 +277,6 @@ func (i *Info) Remove() error {
 	return nil
 }
 
-// Verify verifies image signatures.
-func (i *Info) Verify() error {
-	if i.Ref.URI() == singularity.DockerDomain {
-		return nil
-	}
-
-	_, _, err := signing.Verify(i.Path, singularity.KeysServer, 0, false, "", false, true)
-	noSignatures := err != nil && strings.Contains(err.Error(), "no signatures found")
-	if noSignatures {
-		glog.V(2).Infof("Image %s is not signed", i.Ref)
-	}
-	if err != nil && !noSignatures {
-		return fmt.Errorf("SIF verification failed: %v", err)
-	}
-	return nil
-}
-
 // Matches tests image against passed filter and returns true if it matches.
 func (i *Info) Matches(filter *k8s.ImageFilter) bool {
 	if filter == nil || filter.Image == nil {
@@ -238,76 +299,62 @@ func (i *Info) Matches(filter *k8s.ImageFilter) bool {
 	return false
 }
 
-func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
-	pullURL := strings.TrimPrefix(ref.String(), ref.URI()+"/")
-	switch ref.URI() {
-	case singularity.LibraryDomain:
-		config := &library.Config{
-			BaseURL:   auth.GetServerAddress(),
-			AuthToken: auth.GetPassword(),
-		}
-		client, err := library.NewClient(config)
-		if err != nil {
-			return fmt.Errorf("could not create library client: %v", err)
-		}
-		w, err := os.Create(pullPath)
-		if err != nil {
-			return fmt.Errorf("could not create file to pull image: %v", err)
-		}
-		parts := strings.Split(pullURL, ":")
-		// don't check index out of range since we add :latest by default when parsing ref
-		err = client.DownloadImage(ctx, w, runtime.GOARCH, parts[0], parts[1], nil)
-		_ = w.Close()
-		if err != nil {
-			return fmt.Errorf("could not pull library image: %v", err)
-		}
-	case singularity.DockerDomain:
-		var errMsg bytes.Buffer
-		if auth.GetServerAddress() != "" {
-			pullURL = fmt.Sprintf("%s/%s", auth.GetServerAddress(), pullURL)
-		}
-		remote := fmt.Sprintf("%s://%s", singularity.DockerProtocol, pullURL)
-		buildCmd := exec.CommandContext(ctx, singularity.RuntimeName, "build", "-F", pullPath, remote)
-		buildCmd.Env = []string{
-			fmt.Sprintf("PATH=%s", os.Getenv("PATH")),
-			// assume auth.Auth is not needed b/c k8s decodes it into username and password,
-			// see https://github.com/kubernetes/kubernetes/blob/master/pkg/credentialprovider/config.go#L284
-			fmt.Sprintf("%s=%s", singularity.EnvDockerUsername, auth.GetUsername()),
-			fmt.Sprintf("%s=%s", singularity.EnvDockerPassword, auth.GetPassword()),
-		}
-		buildCmd.Stderr = &errMsg
-		buildCmd.Stdout = ioutil.Discard
-		err := buildCmd.Run()
-		if err != nil {
-			return fmt.Errorf("could not build image: %s", &errMsg)
-		}
-	default:
-		return fmt.Errorf("unknown image registry: %s", ref.URI())
+// pullImage pulls image referenced by ref into pullPath with the source registered
+// for its URI. Configured rewrite rules and mirrors are applied, while ref itself is
+// left intact except for digests sources may add to it. For images built from docker
+// layers returned are digests of the cached layers image relies on.
+func pullImage(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	src, ok := lookupSource(ref.URI())
+	if !ok {
+		return nil, permanent(fmt.Errorf("unknown image registry: %s", ref.URI()))
 	}
-	return nil
+	return src.Pull(ctx, ref, auth, pullPath)
 }
 
-func sifInfo(sifPath string) (*Info, error) {
-	sif, err := os.Open(sifPath)
+// Checksum returns hex encoded SHA-256 checksum of the image file
+// located at path. Checksum of pulled image is also its ID.
+func Checksum(path string) (string, error) {
+	sif, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not open sif image: %v", err)
+		return "", fmt.Errorf("could not open sif image: %v", err)
 	}
+	defer sif.Close()
 
-	fi, err := sif.Stat()
+	h := sha256.New()
+	_, err = io.Copy(h, sif)
 	if err != nil {
-		return nil, fmt.Errorf("could not fetch file info: %v", err)
+		return "", fmt.Errorf("could not get sif image digest: %v", err)
 	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-	h := sha256.New()
-	_, err = io.Copy(h, sif)
+// checkSIFHeader returns error if file at path doesn't start with SIF magic.
+func checkSIFHeader(path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not get sif image digest: %v", err)
+		return fmt.Errorf("could not open image: %v", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, sif.HdrLaunchLen+sif.HdrMagicLen)
+	if _, err := io.ReadFull(f, header); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("could not read image header: %v", err)
+	}
+	if !bytes.HasPrefix(header[sif.HdrLaunchLen:], []byte(sif.HdrMagic)) {
+		return fmt.Errorf("%s is not a SIF image", path)
+	}
+	return nil
+}
+
+func sifInfo(sifPath string) (*Info, error) {
+	fi, err := os.Stat(sifPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch file info: %v", err)
 	}
-	checksum := fmt.Sprintf("%x", h.Sum(nil))
 
-	err = sif.Close()
+	checksum, err := Checksum(sifPath)
 	if err != nil {
-		return nil, fmt.Errorf("could not close pulled image: %v", err)
+		return nil, err
 	}
 
 	ociConfig, err := fetchOCIConfig(sifPath)
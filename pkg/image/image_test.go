@@ -185,7 +185,7 @@ func TestPullImage(t *testing.T) {
 				t.Skip()
 			}
 
-			image, err := Pull(context.Background(), os.TempDir(), tc.ref, tc.auth)
+			image, _, err := Pull(context.Background(), nil, os.TempDir(), tc.ref, tc.auth, "")
 			if tc.expectError == "" {
 				require.NoError(t, err, "unexpected error")
 			} else {
@@ -343,14 +343,14 @@ func TestInfo_Verify(t *testing.T) {
 			var err error
 			img := tc.image
 			if img == nil {
-				img, err = Pull(context.Background(), os.TempDir(), tc.imgRef, nil)
+				img, _, err = Pull(context.Background(), nil, os.TempDir(), tc.imgRef, nil, "")
 				require.NoError(t, err, "could not pull SIF")
 				defer func() {
 					require.NoError(t, img.Remove(), "could not remove SIF")
 				}()
 			}
 
-			err = img.Verify()
+			err = img.Verify(context.Background(), nil, nil)
 			if tc.expectError == "" {
 				require.NoError(t, err, "unexpected error")
 			} else {
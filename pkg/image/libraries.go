@@ -0,0 +1,148 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+// LibraryConfig describes Singularity libraries images are pulled from.
+type LibraryConfig struct {
+	// URL is a base URL of library API images referenced with library
+	// domain or library:// scheme are pulled from, e.g. on-prem
+	// https://library.example.com. Empty URL means Sylabs Cloud.
+	URL string
+	// TokenFile is a path to a file holding token to authenticate in the
+	// default library with when pull request comes without credentials.
+	TokenFile string
+	// Domains maps additional library domains to base URLs of their APIs.
+	// References with these domains, e.g. library.example.com/team/app:1.0,
+	// are parsed as library ones. Empty URL means https://<domain>.
+	Domains map[string]string
+}
+
+// Libraries holds validated library config. Libraries should be created with
+// NewLibraries. Library domains change how references are parsed, so references
+// should be parsed with Libraries.ParseRef, and Libraries are applied to pulls
+// with ctx returned by WithLibraries. Nil Libraries stand for Sylabs Cloud only.
+type Libraries struct {
+	cfg LibraryConfig
+}
+
+// NewLibraries returns libraries described by cfg. Token file is read right
+// away to report any error with it, but it is reread on each pull so that
+// token may be rotated without restart.
+func NewLibraries(cfg LibraryConfig) (*Libraries, error) {
+	if cfg.URL != "" {
+		if err := validLibraryURL(cfg.URL); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TokenFile != "" {
+		if _, err := readLibraryToken(cfg.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+	domains := make(map[string]string, len(cfg.Domains))
+	for domain, baseURL := range cfg.Domains {
+		if domain == "" || strings.ContainsAny(domain, "/@") || domain == singularity.DockerDomain {
+			return nil, fmt.Errorf("invalid library domain %q", domain)
+		}
+		if baseURL != "" {
+			if err := validLibraryURL(baseURL); err != nil {
+				return nil, err
+			}
+		}
+		domains[domain] = baseURL
+	}
+	cfg.Domains = domains
+	return &Libraries{cfg: cfg}, nil
+}
+
+type librariesKey struct{}
+
+// WithLibraries returns a copy of ctx that makes library
+// images pulled with it be pulled from libraries l.
+func WithLibraries(ctx context.Context, l *Libraries) context.Context {
+	return context.WithValue(ctx, librariesKey{}, l)
+}
+
+// librariesFrom returns libraries set in ctx with WithLibraries, if any.
+func librariesFrom(ctx context.Context) *Libraries {
+	l, _ := ctx.Value(librariesKey{}).(*Libraries)
+	return l
+}
+
+func validLibraryURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid library URL %q: %v", rawURL, err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid library URL %q: should be http(s)://host[:port][/path]", rawURL)
+	}
+	return nil
+}
+
+// isLibraryDomain returns true if images with domain are stored in library,
+// i.e. domain is either Sylabs Cloud one or is configured as a library one.
+func (l *Libraries) isLibraryDomain(domain string) bool {
+	if domain == singularity.LibraryDomain {
+		return true
+	}
+	if l == nil {
+		return false
+	}
+	_, ok := l.cfg.Domains[domain]
+	return ok
+}
+
+// libraryURL returns base URL of API of the library known as domain.
+// Empty URL stands for the library client default, i.e. Sylabs Cloud.
+func (l *Libraries) libraryURL(domain string) string {
+	var cfg LibraryConfig
+	if l != nil {
+		cfg = l.cfg
+	}
+	if domain == singularity.LibraryDomain {
+		return cfg.URL
+	}
+	if baseURL := cfg.Domains[domain]; baseURL != "" {
+		return baseURL
+	}
+	return "https://" + domain
+}
+
+// defaultLibraryToken returns token configured for the default library, if any.
+func (l *Libraries) defaultLibraryToken() (string, error) {
+	if l == nil || l.cfg.TokenFile == "" {
+		return "", nil
+	}
+	return readLibraryToken(l.cfg.TokenFile)
+}
+
+func readLibraryToken(path string) (string, error) {
+	token, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read library token: %v", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestNewLibraries(t *testing.T) {
+	tt := []struct {
+		name        string
+		cfg         LibraryConfig
+		expectError string
+	}{
+		{
+			name: "all ok",
+			cfg: LibraryConfig{
+				URL: "https://library.example.com",
+				Domains: map[string]string{
+					"library.lab.local": "http://library.lab.local:8080/api",
+					"library.local":     "",
+				},
+			},
+		},
+		{
+			name:        "URL without scheme",
+			cfg:         LibraryConfig{URL: "library.example.com"},
+			expectError: `invalid library URL "library.example.com"`,
+		},
+		{
+			name: "invalid domain URL",
+			cfg: LibraryConfig{
+				Domains: map[string]string{"library.local": "ftp://library.local"},
+			},
+			expectError: `invalid library URL "ftp://library.local"`,
+		},
+		{
+			name: "domain with path",
+			cfg: LibraryConfig{
+				Domains: map[string]string{"library.local/v1": ""},
+			},
+			expectError: `invalid library domain "library.local/v1"`,
+		},
+		{
+			name: "docker domain",
+			cfg: LibraryConfig{
+				Domains: map[string]string{"docker.io": ""},
+			},
+			expectError: `invalid library domain "docker.io"`,
+		},
+		{
+			name:        "missing token file",
+			cfg:         LibraryConfig{TokenFile: "/no/such/token"},
+			expectError: "could not read library token",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewLibraries(tc.cfg)
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDefaultLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "library-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600))
+
+	libraries, err := NewLibraries(LibraryConfig{
+		URL:       "https://library.example.com",
+		TokenFile: tokenFile,
+		Domains: map[string]string{
+			"library.lab.local": "",
+		},
+	})
+	require.NoError(t, err)
+	ctx := WithLibraries(context.Background(), libraries)
+
+	tt := []struct {
+		name           string
+		ref            string
+		auth           *k8s.AuthConfig
+		expectEndpoint libraryEndpoint
+	}{
+		{
+			name:           "token file",
+			ref:            "library://sylabs/tests/busybox:1.0.0",
+			expectEndpoint: libraryEndpoint{baseURL: "https://library.example.com", token: "file-token"},
+		},
+		{
+			name:           "request token",
+			ref:            "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			auth:           &k8s.AuthConfig{Password: "request-token"},
+			expectEndpoint: libraryEndpoint{baseURL: "https://library.example.com", token: "request-token"},
+		},
+		{
+			name:           "server address",
+			ref:            "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			auth:           &k8s.AuthConfig{ServerAddress: "https://library.other.com"},
+			expectEndpoint: libraryEndpoint{baseURL: "https://library.other.com"},
+		},
+		{
+			name:           "another library",
+			ref:            "library.lab.local/team/app:1.0",
+			expectEndpoint: libraryEndpoint{baseURL: "https://library.lab.local"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := libraries.ParseRef(tc.ref)
+			require.NoError(t, err)
+			require.Equal(t, singularity.LibraryDomain, ref.URI())
+			_, endpoints := libraryEndpoints(ctx, ref, tc.auth)
+			require.Equal(t, []libraryEndpoint{tc.expectEndpoint}, endpoints)
+		})
+	}
+
+	t.Run("reference", func(t *testing.T) {
+		ref, err := libraries.ParseRef("library.lab.local/team/app")
+		require.NoError(t, err)
+		require.Equal(t, singularity.LibraryDomain, ref.URI())
+		require.Equal(t, []string{"library.lab.local/team/app:latest"}, ref.Tags())
+
+		ref, err = libraries.ParseRef("library.unknown.local/team/app")
+		require.NoError(t, err)
+		require.Equal(t, singularity.DockerDomain, ref.URI(), "unknown domain should be a docker one")
+
+		ref, err = ParseRef("library.lab.local/team/app")
+		require.NoError(t, err)
+		require.Equal(t, singularity.DockerDomain, ref.URI(), "library domain should not be known without config")
+	})
+}
+
+func TestPullLibrary(t *testing.T) {
+	sif := bytes.Repeat([]byte("pretend this is a SIF file\n"), 100)
+	checksum := fmt.Sprintf("%x", sha256.Sum256(sif))
+	modTime := time.Now().Add(-time.Hour)
+
+	var (
+		ranges    []string
+		interrupt bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/images/team/app:"):
+			hash := checksum
+			if strings.HasSuffix(r.URL.Path, ":changed") {
+				hash = strings.Repeat("0", 64)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"data":{"hash":"sha256.%s","size":%d}}`, hash, len(sif))
+		case strings.HasPrefix(r.URL.Path, "/v1/imagefile/team/app:"):
+			ranges = append(ranges, r.Header.Get("Range"))
+			if interrupt {
+				// pretend connection drops in the middle of the download
+				w.Header().Set("Content-Length", strconv.Itoa(len(sif)))
+				w.Header().Set("ETag", `"v1"`)
+				w.Write(sif[:1000])
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "app.sif", modTime, bytes.NewReader(sif))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	libraries, err := NewLibraries(LibraryConfig{
+		Domains: map[string]string{"library.local": server.URL},
+	})
+	require.NoError(t, err)
+	ctx := WithLibraries(context.Background(), libraries)
+
+	storage, err := ioutil.TempDir("", "library-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	pull := func(t *testing.T, rawRef string) (*Info, string, error) {
+		ref, err := libraries.ParseRef(rawRef)
+		require.NoError(t, err)
+		require.Equal(t, singularity.LibraryDomain, ref.URI())
+		path, endpoints := libraryEndpoints(ctx, ref, nil)
+		img, err := libraryImage(ctx, path, endpoints)
+		require.NoError(t, err)
+		partial := partialPath(storage, ref.String(), img.Hash)
+		info, _, err := Pull(ctx, nil, storage, ref, nil, "")
+		return info, partial, err
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		ranges, interrupt = nil, true
+		_, partial, err := pull(t, "library.local/team/app:1.0")
+		require.Error(t, err)
+		content, err := ioutil.ReadFile(partial)
+		require.NoError(t, err, "partial download should be kept")
+		require.Equal(t, sif[:1000], content)
+
+		ranges, interrupt = nil, false
+		info, _, err := pull(t, "library.local/team/app:1.0")
+		require.NoError(t, err)
+		require.Equal(t, []string{"bytes=1000-"}, ranges)
+		require.Equal(t, checksum, info.ID)
+		content, err = ioutil.ReadFile(info.Path)
+		require.NoError(t, err)
+		require.Equal(t, sif, content)
+		_, err = os.Stat(partial)
+		require.True(t, os.IsNotExist(err), "partial download is left")
+	})
+
+	t.Run("moved tag", func(t *testing.T) {
+		ref, err := libraries.ParseRef("library.local/team/app:1.0")
+		require.NoError(t, err)
+		stale := partialPath(storage, ref.String(), "sha256."+strings.Repeat("1", 64))
+		require.NoError(t, ioutil.WriteFile(stale, sif[:1000], 0644))
+		require.NoError(t, ioutil.WriteFile(stale+validatorSuffix, []byte(`"v0"`), 0644))
+		other := partialPath(storage, "library.local/team/other:1.0", "sha256."+strings.Repeat("1", 64))
+		require.NoError(t, ioutil.WriteFile(other, sif[:1000], 0644))
+		defer os.Remove(other)
+
+		ranges, interrupt = nil, false
+		_, _, err = pull(t, "library.local/team/app:1.0")
+		require.NoError(t, err)
+		require.Equal(t, []string{""}, ranges, "stale partial download should not be resumed")
+		for _, path := range []string{stale, stale + validatorSuffix} {
+			_, err = os.Stat(path)
+			require.True(t, os.IsNotExist(err), "stale %s is left", path)
+		}
+		require.FileExists(t, other, "partial download of another image is removed")
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		ranges, interrupt = nil, false
+		_, partial, err := pull(t, "library.local/team/app:changed")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "digest mismatch")
+		require.IsType(t, &DigestMismatchError{}, err)
+		_, err = os.Stat(filepath.Join(QuarantineDir(storage), checksum))
+		require.NoError(t, err, "mismatched download should be quarantined")
+		_, err = os.Stat(partial)
+		require.True(t, os.IsNotExist(err), "partial download is left")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ref, err := libraries.ParseRef("library.local/team/missing:1.0")
+		require.NoError(t, err)
+		_, _, err = Pull(ctx, nil, storage, ref, nil, "")
+		require.Equal(t, ErrNotFound, err)
+	})
+
+	files, err := filepath.Glob(filepath.Join(storage, ".*"))
+	require.NoError(t, err)
+	require.Empty(t, files, "temporary files are left in storage")
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	library "github.com/sylabs/scs-library-client/client"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// libraryEndpoint is a library API base URL along with a token to authenticate with.
+// Empty base URL stands for the default library. Nil HTTP client means library client
+// defaults are used.
+type libraryEndpoint struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+func (e libraryEndpoint) String() string {
+	if e.baseURL == "" {
+		return singularity.LibraryDomain
+	}
+	return e.baseURL
+}
+
+func (e libraryEndpoint) client() (*library.Client, error) {
+	config := &library.Config{
+		BaseURL:    e.baseURL,
+		AuthToken:  e.token,
+		HTTPClient: e.httpClient,
+	}
+	client, err := library.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create library client: %v", err)
+	}
+	return client, nil
+}
+
+// libraryEndpoints returns path of the image referenced by ref in library, e.g.
+// sylabs/tests/busybox:1.0.0, along with library endpoints image should be looked
+// up at. Mirrors go first, the origin library is always the last one. TLS settings
+// are looked up by endpoint host, default library settings are under its domain.
+// If auth holds no token, one configured for the library is used.
+func libraryEndpoints(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (string, []libraryEndpoint) {
+	domain, path := splitDomain(pullSource(ctx, ref, auth))
+	registries := registriesFrom(ctx)
+	libraries := librariesFrom(ctx)
+
+	var endpoints []libraryEndpoint
+	for _, mirror := range registries.mirrors(domain) {
+		endpoints = append(endpoints, newLibraryEndpoint(registries, mirror, ""))
+	}
+	baseURL := auth.GetServerAddress()
+	if baseURL == "" {
+		baseURL = libraries.libraryURL(domain)
+		if domain == singularity.LibraryDomain && !hasCredentials(auth) {
+			auth = libraries.withLibraryToken(auth)
+		}
+	}
+	if baseURL != "" {
+		domain = credentialKey(baseURL)
+	}
+	auth = resolveAuth(ctx, domain, auth)
+	return path, append(endpoints, newLibraryEndpoint(registries, baseURL, libraryToken(auth)))
+}
+
+// withLibraryToken returns auth holding token configured for the default
+// library, if any. Failure to read token is logged and auth is returned as is.
+func (l *Libraries) withLibraryToken(auth *k8s.AuthConfig) *k8s.AuthConfig {
+	token, err := l.defaultLibraryToken()
+	if err != nil {
+		glog.Warningf("Could not get default library token: %v", err)
+		return auth
+	}
+	if token == "" {
+		return auth
+	}
+	return &k8s.AuthConfig{
+		ServerAddress: auth.GetServerAddress(),
+		RegistryToken: token,
+	}
+}
+
+// libraryToken returns token to authenticate in library with. Library tokens
+// may be passed either as password or as any kind of token.
+func libraryToken(auth *k8s.AuthConfig) string {
+	switch {
+	case auth.GetRegistryToken() != "":
+		return auth.GetRegistryToken()
+	case auth.GetIdentityToken() != "":
+		return auth.GetIdentityToken()
+	}
+	return auth.GetPassword()
+}
+
+func newLibraryEndpoint(registries *Registries, baseURL, token string) libraryEndpoint {
+	host := singularity.LibraryDomain
+	if baseURL != "" {
+		host = urlHost(baseURL)
+	}
+	client, plain := registries.hostTransport(host)
+	if plain && baseURL != "" {
+		baseURL = "http://" + strings.TrimPrefix(baseURL, "https://")
+	}
+	if client == http.DefaultClient {
+		client = nil
+	}
+	return libraryEndpoint{
+		baseURL:    baseURL,
+		token:      token,
+		httpClient: client,
+	}
+}
+
+// libraryImage queries library endpoints in order and
+// returns metadata of the image found at path.
+func libraryImage(ctx context.Context, path string, endpoints []libraryEndpoint) (*library.Image, error) {
+	var err error
+	for i, endpoint := range endpoints {
+		var img *library.Image
+		img, err = getLibraryImage(ctx, endpoint, path)
+		if err == nil {
+			return img, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(endpoints)-1 {
+			glog.Warningf("Could not get image %s info from mirror %s, trying next one: %v", path, endpoint, err)
+		}
+	}
+	if err == library.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return nil, fmt.Errorf("could not get library image info: %v", err)
+}
+
+// librarySource serves images stored in Sylabs Cloud library or compatible
+// ones, e.g. cloud.sylabs.io/sylabs/tests/busybox:1.0.0 or images with
+// configured library domains, e.g. library.example.com/team/app:1.0.
+type librarySource struct{}
+
+func (librarySource) Info(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+	path, endpoints := libraryEndpoints(ctx, ref, auth)
+	img, err := libraryImage(ctx, path, endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// library API uses sha256 hash func and returns image hash in form sha256.<hash>
+	// we need to trim it before it can be used
+	id := strings.TrimPrefix(img.Hash, "sha256.")
+	return &Info{
+		ID:     id,
+		Sha256: id,
+		Size:   uint64(img.Size),
+		Ref:    ref,
+	}, nil
+}
+
+func (librarySource) Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return nil, pullLibrary(ctx, ref, auth, pullPath)
+}
+
+// Digests returns library reference with image hash in place
+// of the tag, e.g. cloud.sylabs.io/sylabs/tests/busybox:sha256.<hex>.
+func (librarySource) Digests(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) ([]string, error) {
+	path, endpoints := libraryEndpoints(ctx, ref, auth)
+	img, err := libraryImage(ctx, path, endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return []string{repository(ref.String()) + ":" + img.Hash}, nil
+}
+
+// pullLibrary downloads library image referenced by ref into pullPath
+// trying configured mirrors first and falling back to the origin library.
+// Image is downloaded into a partial file keyed by ref and image hash, so
+// interrupted download is resumed by the next attempt unless image behind
+// ref changes. Partial download is locked so that concurrent pulls of ref, e.g.
+// with different credentials, take turns. Downloaded image is verified against
+// hash reported by library.
+func pullLibrary(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
+	path, endpoints := libraryEndpoints(ctx, ref, auth)
+	img, err := libraryImage(ctx, path, endpoints)
+	if err != nil {
+		return err
+	}
+	name, tag := path, "latest"
+	if i := strings.LastIndexByte(path, ':'); i != -1 {
+		name, tag = path[:i], path[i+1:]
+	}
+
+	// tag may be moved since the last attempt, so its previous partial download
+	// can never be resumed and is removed before the new one is started
+	partial := partialPath(filepath.Dir(pullPath), ref.String(), img.Hash)
+	removeStalePartials(filepath.Dir(pullPath), ref.String(), partial)
+	lock, err := lockPartial(ctx, partial)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	for i, endpoint := range endpoints {
+		err = downloadLibrary(ctx, endpoint, name, tag, partial)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(*permanentError); ok || ctx.Err() != nil {
+			break
+		}
+		if i < len(endpoints)-1 {
+			glog.Warningf("Could not pull %s from mirror %s, trying next one: %v", path, endpoint, err)
+		}
+	}
+	if err != nil {
+		// keep partial download only when it may be resumed by the next attempt
+		if _, ok := err.(*permanentError); ok || err == ErrNotFound {
+			removePartial(partial)
+		}
+		return err
+	}
+
+	var expected string
+	if strings.HasPrefix(img.Hash, "sha256.") {
+		expected = strings.TrimPrefix(img.Hash, "sha256.")
+	}
+	return commitPartial(partial, expected, pullPath)
+}
+
+func getLibraryImage(ctx context.Context, endpoint libraryEndpoint, path string) (*library.Image, error) {
+	client, err := endpoint.client()
+	if err != nil {
+		return nil, err
+	}
+	return client.GetImage(ctx, PlatformFrom(ctx).Architecture, path)
+}
+
+// downloadLibrary downloads image file from library endpoint into partial
+// resuming previously interrupted download, if any. Library client doesn't
+// support range requests, so image file is fetched directly from library API.
+func downloadLibrary(ctx context.Context, endpoint libraryEndpoint, name, tag, partial string) error {
+	client, err := endpoint.client()
+	if err != nil {
+		return err
+	}
+	imageURL := client.BaseURL.ResolveReference(&url.URL{
+		Path:     fmt.Sprintf("/v1/imagefile/%s:%s", name, tag),
+		RawQuery: url.Values{"arch": {PlatformFrom(ctx).Architecture}}.Encode(),
+	})
+	var auth *k8s.AuthConfig
+	if endpoint.token != "" {
+		auth = &k8s.AuthConfig{RegistryToken: endpoint.token}
+	}
+	return download(ctx, client.HTTPClient, imageURL.String(), auth, partial)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// ociSource serves images imported from local OCI layouts,
+// OCI archives and docker archives.
+type ociSource struct{}
+
+func (ociSource) Info(context.Context, *Reference, *k8s.AuthConfig) (*Info, error) {
+	return nil, ErrNotSupported
+}
+
+func (ociSource) Pull(ctx context.Context, ref *Reference, _ *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return nil, importOCI(ctx, ref, pullPath)
+}
+
+func (ociSource) Digests(context.Context, *Reference, *k8s.AuthConfig) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// importOCI converts local OCI layout, OCI archive or docker archive referenced
+// by ref, e.g. oci-archive:/path/to/image.tar, into SIF at pullPath. This allows
+// images to be loaded on hosts with no access to registries.
+func importOCI(ctx context.Context, ref *Reference, pullPath string) error {
+	src := ref.String()
+	path := localOCIPath(src)
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return permanent(fmt.Errorf("could not access %s: %v", path, err))
+	}
+
+	glog.V(4).Infof("Importing %s", src)
+	return buildSIF(ctx, src, pullPath)
+}
+
+// localOCIPath returns path to OCI layout or archive referenced by imgRef,
+// e.g. /path/to/layout for oci:/path/to/layout:tag.
+func localOCIPath(imgRef string) string {
+	proto := localOCIProtocol(imgRef)
+	path := strings.TrimPrefix(imgRef, proto+":")
+	if proto == singularity.OCILayoutProtocol {
+		if i := strings.LastIndexByte(path, ':'); i > strings.LastIndexByte(path, '/') {
+			path = path[:i]
+		}
+	}
+	return path
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalOCIPath(t *testing.T) {
+	tt := []struct {
+		ref    string
+		expect string
+	}{
+		{
+			ref:    "oci:/var/images/layout",
+			expect: "/var/images/layout",
+		},
+		{
+			ref:    "oci:/var/images/layout:1.0",
+			expect: "/var/images/layout",
+		},
+		{
+			ref:    "oci-archive:/var/images/busybox.tar",
+			expect: "/var/images/busybox.tar",
+		},
+		{
+			ref:    "docker-archive:/var/images/busybox.tar",
+			expect: "/var/images/busybox.tar",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			require.Equal(t, tc.expect, localOCIPath(tc.ref))
+		})
+	}
+}
+
+func TestImportOCI_NotFound(t *testing.T) {
+	storage, err := ioutil.TempDir("", "oci-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	for _, imgRef := range []string{
+		"oci:/not/exist/layout:1.0",
+		"oci-archive:/not/exist/busybox.tar",
+		"docker-archive:/not/exist/busybox.tar",
+	} {
+		t.Run(imgRef, func(t *testing.T) {
+			ref, err := ParseRef(imgRef)
+			require.NoError(t, err)
+			require.True(t, ref.IsOCI())
+
+			_, _, err = Pull(context.Background(), nil, storage, ref, nil, "")
+			require.Equal(t, ErrNotFound, err)
+		})
+	}
+
+	files, err := ioutil.ReadDir(storage)
+	require.NoError(t, err)
+	require.Empty(t, files, "temporary files are left in storage")
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// SIFLayerMediaType is a media type of SIF file pushed to OCI registry with ORAS.
+const SIFLayerMediaType = "application/vnd.sylabs.sif.layer.v1.sif"
+
+// orasSource serves SIF images stored in OCI registries as ORAS artifacts.
+type orasSource struct{}
+
+// Info resolves image metadata from SIF layer descriptor, which
+// digest is the checksum of SIF file and thus image ID.
+func (orasSource) Info(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+	name := pullSource(ctx, ref, auth)
+	named, err := registryRef(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, reference := named.path, named.reference()
+
+	var layer specs.Descriptor
+	resolve := func(client *registry.Client, host string) error {
+		manifest, _, err := client.Manifest(ctx, repo, reference, registry.DefaultPlatform())
+		if err != nil {
+			return err
+		}
+		layer, err = sifLayer(manifest, repo)
+		return err
+	}
+	endpoints := registryEndpoints(ctx, named.domain, named.registryHost(), auth)
+	if err := pullFromRegistry(ctx, name, endpoints, resolve); err != nil {
+		return nil, registryError(err)
+	}
+	if layer.Digest.Algorithm() != digest.SHA256 {
+		return nil, ErrNotSupported
+	}
+	return &Info{
+		ID:     layer.Digest.Hex(),
+		Sha256: layer.Digest.Hex(),
+		Size:   uint64(layer.Size),
+		Ref:    ref,
+	}, nil
+}
+
+func (orasSource) Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return nil, pullOras(ctx, ref, auth, pullPath)
+}
+
+func (orasSource) Digests(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) ([]string, error) {
+	dgst, err := manifestDigest(ctx, pullSource(ctx, ref, auth), auth)
+	if err != nil {
+		return nil, err
+	}
+	return []string{repository(ref.String()) + "@" + dgst.String()}, nil
+}
+
+// pullOras pulls SIF image stored as ORAS artifact in OCI registry and saves
+// it at pullPath. Digest of the pulled manifest is added to ref.
+func pullOras(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) error {
+	name := pullSource(ctx, ref, auth)
+	named, err := registryRef(name)
+	if err != nil {
+		return err
+	}
+	repo, reference := named.path, named.reference()
+
+	var dgst digest.Digest
+	pull := func(client *registry.Client, host string) error {
+		glog.V(4).Infof("Pulling SIF %s/%s:%s", host, repo, reference)
+		var err error
+		dgst, err = pullSIFLayer(ctx, client, repo, reference, pullPath)
+		return err
+	}
+	endpoints := registryEndpoints(ctx, named.domain, named.registryHost(), auth)
+	if err := pullFromRegistry(ctx, name, endpoints, pull); err != nil {
+		return registryError(err)
+	}
+
+	ref.AddDigests([]string{repository(ref.String()) + "@" + dgst.String()})
+	return nil
+}
+
+// pullSIFLayer fetches manifest referenced by reference in repo and downloads
+// SIF layer it points to. Returned is the digest of the manifest.
+func pullSIFLayer(ctx context.Context, client *registry.Client, repo, reference, pullPath string) (digest.Digest, error) {
+	manifest, dgst, err := client.Manifest(ctx, repo, reference, registry.DefaultPlatform())
+	if err != nil {
+		return "", err
+	}
+
+	layer, err := sifLayer(manifest, repo)
+	if err != nil {
+		return "", err
+	}
+
+	w, err := os.Create(pullPath)
+	if err != nil {
+		return "", permanent(fmt.Errorf("could not create file to pull image: %v", err))
+	}
+	err = client.Blob(ctx, repo, layer, w, nil)
+	if cerr := w.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("could not close image file: %v", cerr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// sifLayer returns descriptor of SIF layer in manifest pulled from repo.
+func sifLayer(manifest *specs.Manifest, repo string) (specs.Descriptor, error) {
+	for _, desc := range manifest.Layers {
+		if desc.MediaType == SIFLayerMediaType {
+			return desc, nil
+		}
+	}
+	return specs.Descriptor{}, permanent(fmt.Errorf("no layer of type %s found in %s", SIFLayerMediaType, repo))
+}
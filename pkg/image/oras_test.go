@@ -0,0 +1,183 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPullOras(t *testing.T) {
+	sif := []byte("pretend this is a SIF file")
+	sifDigest := digest.FromBytes(sif)
+	config := []byte("{}")
+
+	manifest, err := json.Marshal(specs.Manifest{
+		Versioned: imgspecs.Versioned{SchemaVersion: 2},
+		Config: specs.Descriptor{
+			MediaType: "application/vnd.sylabs.sif.config.v1+json",
+			Digest:    digest.FromBytes(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []specs.Descriptor{
+			{
+				MediaType: SIFLayerMediaType,
+				Digest:    sifDigest,
+				Size:      int64(len(sif)),
+				Annotations: map[string]string{
+					specs.AnnotationTitle: "image.sif",
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	manifestDigest := digest.FromBytes(manifest)
+	badDigest := digest.FromString("bad")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/sylabs/busybox/manifests/1.0", "/v2/sylabs/busybox/manifests/" + manifestDigest.String():
+			w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+			w.Write(manifest)
+		case "/v2/sylabs/corrupted/manifests/1.0":
+			corrupted := strings.Replace(string(manifest), sifDigest.String(), badDigest.String(), 1)
+			w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+			w.Write([]byte(corrupted))
+		case "/v2/sylabs/busybox/blobs/" + sifDigest.String(), "/v2/sylabs/corrupted/blobs/" + badDigest.String():
+			w.Write(sif)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	registries, err := NewRegistries(RegistryConfig{
+		Hosts: map[string]HostConfig{
+			host: {PlainHTTP: true},
+		},
+	})
+	require.NoError(t, err)
+	ctx := WithRegistries(context.Background(), registries)
+
+	storage, err := ioutil.TempDir("", "oras-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	auth := &k8s.AuthConfig{
+		Username: "user",
+		Password: "password",
+	}
+	tt := []struct {
+		name          string
+		ref           string
+		auth          *k8s.AuthConfig
+		expectDigests []string
+		expectError   string
+	}{
+		{
+			name: "by tag",
+			ref:  fmt.Sprintf("oras://%s/sylabs/busybox:1.0", host),
+			auth: auth,
+			expectDigests: []string{
+				fmt.Sprintf("oras://%s/sylabs/busybox@%s", host, manifestDigest),
+			},
+		},
+		{
+			name: "by digest",
+			ref:  fmt.Sprintf("oras://%s/sylabs/busybox@%s", host, manifestDigest),
+			auth: auth,
+			expectDigests: []string{
+				fmt.Sprintf("oras://%s/sylabs/busybox@%s", host, manifestDigest),
+			},
+		},
+		{
+			name:        "not found",
+			ref:         fmt.Sprintf("oras://%s/sylabs/missing:1.0", host),
+			auth:        auth,
+			expectError: ErrNotFound.Error(),
+		},
+		{
+			name:        "no credentials",
+			ref:         fmt.Sprintf("oras://%s/sylabs/busybox:1.0", host),
+			expectError: "unauthorized",
+		},
+		{
+			name:        "digest mismatch",
+			ref:         fmt.Sprintf("oras://%s/sylabs/corrupted:1.0", host),
+			auth:        auth,
+			expectError: "digest mismatch",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			require.Equal(t, singularity.OrasDomain, ref.URI())
+
+			info, _, err := Pull(ctx, nil, storage, ref, tc.auth, "")
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, sifDigest.Hex(), info.ID)
+			require.Equal(t, filepath.Join(storage, sifDigest.Hex()), info.Path)
+			require.ElementsMatch(t, tc.expectDigests, info.Ref.Digests())
+
+			content, err := ioutil.ReadFile(info.Path)
+			require.NoError(t, err)
+			require.Equal(t, sif, content)
+		})
+	}
+
+	ref, err := ParseRef(fmt.Sprintf("oras://%s/sylabs/busybox:1.0", host))
+	require.NoError(t, err)
+	info, err := ResolveInfo(ctx, ref, auth)
+	require.NoError(t, err)
+	require.Equal(t, sifDigest.Hex(), info.ID)
+	require.Equal(t, uint64(len(sif)), info.Size)
+	digests, err := ResolveDigests(ctx, ref, auth)
+	require.NoError(t, err)
+	require.Equal(t, []string{fmt.Sprintf("oras://%s/sylabs/busybox@%s", host, manifestDigest)}, digests)
+
+	files, err := ioutil.ReadDir(storage)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "temporary files are left in storage")
+}
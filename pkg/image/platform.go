@@ -0,0 +1,115 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity-cri/pkg/slice"
+)
+
+// Platform describes operating system and CPU architecture images
+// are pulled for. It is used to select image from docker manifest
+// lists and architecture of library images.
+type Platform struct {
+	OS           string
+	Architecture string
+	// Variant is a CPU variant, e.g. v8 for arm64. Library
+	// images have no variants, so it is ignored for them.
+	Variant string
+}
+
+// knownOS lists operating systems recognized by ParsePlatform.
+var knownOS = []string{"linux", "windows", "darwin", "freebsd"}
+
+// ParsePlatform parses platform in os/arch[/variant] or arch[/variant]
+// form, e.g. linux/arm64/v8, arm64/v8 or amd64. Omitted operating
+// system defaults to the one sycri is running on.
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	p := Platform{
+		OS: registry.DefaultPlatform().OS,
+	}
+	for _, os := range knownOS {
+		if parts[0] == os {
+			p.OS = os
+			parts = parts[1:]
+			break
+		}
+	}
+	if len(parts) == 0 || len(parts) > 2 || slice.ContainsString(parts, "") {
+		return Platform{}, fmt.Errorf("invalid platform %q, should be os/arch[/variant]", s)
+	}
+	p.Architecture = parts[0]
+	if len(parts) == 2 {
+		p.Variant = parts[1]
+	}
+	return p, nil
+}
+
+// String returns platform in os/arch[/variant] form.
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+func (p Platform) spec() specs.Platform {
+	return specs.Platform{
+		OS:           p.OS,
+		Architecture: p.Architecture,
+		Variant:      p.Variant,
+	}
+}
+
+// DefaultPlatform returns platform sycri is running on. Images are
+// pulled for it unless other platform is set with WithPlatform.
+func DefaultPlatform() Platform {
+	return Platform{
+		OS:           registry.DefaultPlatform().OS,
+		Architecture: registry.DefaultPlatform().Architecture,
+	}
+}
+
+type platformKey struct{}
+
+// WithPlatform returns a copy of ctx that makes images
+// pulled with it be selected for platform p.
+func WithPlatform(ctx context.Context, p Platform) context.Context {
+	return context.WithValue(ctx, platformKey{}, p)
+}
+
+// PlatformFrom returns platform set in ctx with WithPlatform
+// falling back to the default one.
+func PlatformFrom(ctx context.Context) Platform {
+	if p, ok := ctx.Value(platformKey{}).(Platform); ok {
+		return p
+	}
+	return DefaultPlatform()
+}
+
+// selectsPlatform returns true if images pulled from uri are
+// selected according to platform, while others, e.g. SIF files,
+// are pulled as is.
+func selectsPlatform(uri string) bool {
+	return uri == singularity.DockerDomain || uri == singularity.LibraryDomain
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tt := []struct {
+		name        string
+		platform    string
+		expect      Platform
+		expectError string
+	}{
+		{
+			name:     "architecture",
+			platform: "amd64",
+			expect:   Platform{OS: runtime.GOOS, Architecture: "amd64"},
+		},
+		{
+			name:     "architecture and variant",
+			platform: "arm64/v8",
+			expect:   Platform{OS: runtime.GOOS, Architecture: "arm64", Variant: "v8"},
+		},
+		{
+			name:     "os and architecture",
+			platform: "linux/ppc64le",
+			expect:   Platform{OS: "linux", Architecture: "ppc64le"},
+		},
+		{
+			name:     "full platform",
+			platform: "linux/amd64/v3",
+			expect:   Platform{OS: "linux", Architecture: "amd64", Variant: "v3"},
+		},
+		{
+			name:        "empty",
+			platform:    "",
+			expectError: `invalid platform ""`,
+		},
+		{
+			name:        "only os",
+			platform:    "linux",
+			expectError: `invalid platform "linux"`,
+		},
+		{
+			name:        "empty variant",
+			platform:    "linux/arm64/",
+			expectError: `invalid platform "linux/arm64/"`,
+		},
+		{
+			name:        "too many components",
+			platform:    "linux/arm/v7/extra",
+			expectError: `invalid platform "linux/arm/v7/extra"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParsePlatform(tc.platform)
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, p)
+
+			parsed, err := ParsePlatform(p.String())
+			require.NoError(t, err)
+			require.Equal(t, p, parsed, "platform should survive round trip")
+		})
+	}
+}
+
+func TestPlatformFrom(t *testing.T) {
+	host := Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	require.Equal(t, host, DefaultPlatform())
+	require.Equal(t, host, PlatformFrom(context.Background()))
+
+	arm := Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	require.Equal(t, arm, PlatformFrom(WithPlatform(context.Background(), arm)))
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultPullAttempts is the default number of attempts to pull an image.
+	DefaultPullAttempts = 3
+	// DefaultInitialBackoff is the default delay before the first retry.
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff is the default upper bound of delay between retries.
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// PullPolicy controls concurrency, timeouts and retries of image pulls.
+// It is applied to all images pulled with Pull it is passed to regardless
+// of their origin. Policy should be created with NewPullPolicy, otherwise
+// parallel pulls are not limited.
+type PullPolicy struct {
+	// MaxParallel is the maximum number of images pulled at the same time.
+	// Pulls over the limit are queued. Zero means no limit.
+	MaxParallel int
+	// Timeout bounds a single pull including all its retries, but not the
+	// time spent in queue. Zero means no timeout.
+	Timeout time.Duration
+	// Retry controls how failed pulls are retried.
+	Retry RetryPolicy
+
+	// slots limits number of parallel pulls, nil means no limit
+	slots chan struct{}
+}
+
+// RetryPolicy describes exponential backoff between attempts.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts including the first
+	// one. If Attempts is 0 DefaultPullAttempts is used. Set Attempts
+	// to 1 to disable retries.
+	Attempts int
+	// InitialBackoff is a delay before the first retry, doubled
+	// after each attempt. If 0 DefaultInitialBackoff is used.
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper bound of delay between attempts.
+	// If 0 DefaultMaxBackoff is used.
+	MaxBackoff time.Duration
+}
+
+// NewPullPolicy returns policy p with defaults applied. Parallel
+// pulls are limited among all pulls the returned policy is passed to.
+func NewPullPolicy(p PullPolicy) *PullPolicy {
+	if p.Retry.Attempts <= 0 {
+		p.Retry.Attempts = DefaultPullAttempts
+	}
+	if p.Retry.InitialBackoff <= 0 {
+		p.Retry.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.Retry.MaxBackoff <= 0 {
+		p.Retry.MaxBackoff = DefaultMaxBackoff
+	}
+	p.slots = nil
+	if p.MaxParallel > 0 {
+		p.slots = make(chan struct{}, p.MaxParallel)
+	}
+	return &p
+}
+
+// acquireSlot blocks until pull of ref may start in accordance with
+// limit of parallel pulls. Returned function frees acquired slot.
+func acquireSlot(ctx context.Context, ref *Reference, slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	glog.V(2).Infof("Too many parallel pulls, %s is queued", ref)
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+		glog.Infof("Pull of %s waited in queue for %v", ref, time.Since(start))
+		return release, nil
+	case <-ctx.Done():
+		glog.Infof("Pull of %s gave up after %v in queue: %v", ref, time.Since(start), ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// retry calls pull until it succeeds, fails with a permanent error or number
+// of attempts allowed by p is exhausted. The last error is returned.
+func retry(ctx context.Context, p RetryPolicy, ref *Reference, pull func(context.Context) error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := pull(ctx)
+		if err == nil {
+			return nil
+		}
+		if perr, ok := err.(*permanentError); ok {
+			return perr.err
+		}
+		if err == ErrNotFound || ctx.Err() != nil || attempt >= p.Attempts {
+			return err
+		}
+
+		glog.Warningf("Attempt %d to pull %s failed, retrying in %v: %v", attempt, ref, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// permanentError is returned by pull backends when retrying
+// the pull is pointless, e.g. due to misconfiguration.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
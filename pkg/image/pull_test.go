@@ -0,0 +1,148 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+func TestRetry(t *testing.T) {
+	ref := &Reference{
+		uri:  singularity.DockerDomain,
+		tags: []string{"busybox:1.31"},
+	}
+	policy := RetryPolicy{
+		Attempts:       3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+	errTemporary := fmt.Errorf("connection reset by peer")
+	errPermanent := fmt.Errorf("unauthorized: authentication required")
+
+	tt := []struct {
+		name         string
+		errs         []error
+		expectCalls  int
+		expectError  error
+		cancelBefore bool
+	}{
+		{
+			name:        "first attempt succeeds",
+			errs:        []error{nil},
+			expectCalls: 1,
+		},
+		{
+			name:        "temporary error",
+			errs:        []error{errTemporary, errTemporary, nil},
+			expectCalls: 3,
+		},
+		{
+			name:        "attempts exhausted",
+			errs:        []error{errTemporary, errTemporary, errTemporary, nil},
+			expectCalls: 3,
+			expectError: errTemporary,
+		},
+		{
+			name:        "permanent error",
+			errs:        []error{errTemporary, permanent(errPermanent), nil},
+			expectCalls: 2,
+			expectError: errPermanent,
+		},
+		{
+			name:        "not found",
+			errs:        []error{ErrNotFound, nil},
+			expectCalls: 1,
+			expectError: ErrNotFound,
+		},
+		{
+			name:         "cancelled",
+			errs:         []error{errTemporary, nil},
+			expectCalls:  1,
+			expectError:  errTemporary,
+			cancelBefore: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancelBefore {
+				cancel()
+			}
+
+			var calls int
+			err := retry(ctx, policy, ref, func(context.Context) error {
+				err := tc.errs[calls]
+				calls++
+				return err
+			})
+			require.Equal(t, tc.expectError, err)
+			require.Equal(t, tc.expectCalls, calls)
+		})
+	}
+}
+
+func TestAcquireSlot(t *testing.T) {
+	ref := &Reference{
+		uri:  singularity.DockerDomain,
+		tags: []string{"busybox:1.31"},
+	}
+
+	release, err := acquireSlot(context.Background(), ref, nil)
+	require.NoError(t, err, "unlimited pulls must not block")
+	release()
+
+	slots := make(chan struct{}, 1)
+	release, err = acquireSlot(context.Background(), ref, slots)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = acquireSlot(ctx, ref, slots)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := acquireSlot(context.Background(), ref, slots)
+		require.NoError(t, err)
+		release()
+		close(acquired)
+	}()
+	release()
+	<-acquired
+	require.Len(t, slots, 0)
+}
+
+func TestNewPullPolicy(t *testing.T) {
+	p := NewPullPolicy(PullPolicy{})
+	require.Equal(t, DefaultPullAttempts, p.Retry.Attempts)
+	require.Equal(t, DefaultInitialBackoff, p.Retry.InitialBackoff)
+	require.Equal(t, DefaultMaxBackoff, p.Retry.MaxBackoff)
+	require.Nil(t, p.slots)
+
+	p = NewPullPolicy(PullPolicy{
+		MaxParallel: 2,
+		Retry:       RetryPolicy{Attempts: 1},
+	})
+	require.Equal(t, 1, p.Retry.Attempts)
+	require.Equal(t, 2, cap(p.slots))
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DigestMismatchError is returned when pulled image doesn't match the
+// digest it was expected to have, e.g. due to corrupted or tampered download.
+type DigestMismatchError struct {
+	Ref string
+	// Expected and Actual are hex encoded sha256 digests.
+	Expected string
+	Actual   string
+	// Path is where the downloaded file is quarantined for inspection.
+	// Empty path means file could not be quarantined and was removed.
+	Path string
+}
+
+func (e *DigestMismatchError) Error() string {
+	msg := fmt.Sprintf("digest mismatch: expected sha256:%s, got sha256:%s", e.Expected, e.Actual)
+	if e.Ref != "" {
+		msg = fmt.Sprintf("image %s %s", e.Ref, msg)
+	}
+	if e.Path != "" {
+		msg += ", quarantined to " + e.Path
+	}
+	return msg
+}
+
+// QuarantineDir returns path to the directory where images pulled
+// into location are moved when they don't match the expected digest.
+func QuarantineDir(location string) string {
+	return filepath.Join(location, "quarantine")
+}
+
+// quarantine moves file at path to the quarantine directory of the location
+// path is in and returns its new path. Files are named after their checksum.
+// If file cannot be moved it is removed and empty path is returned. Modification
+// time of quarantined file is set to the current time, so that it tells how long
+// file is kept in quarantine rather than when it was downloaded.
+func quarantine(path, checksum string) string {
+	dir := QuarantineDir(filepath.Dir(path))
+	quarantinePath := filepath.Join(dir, checksum)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(path, quarantinePath)
+	}
+	if err == nil {
+		now := time.Now()
+		if err := os.Chtimes(quarantinePath, now, now); err != nil {
+			glog.Errorf("Could not set quarantine time of %s: %v", quarantinePath, err)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Could not quarantine %s: %v", path, err)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Could not remove %s: %v", path, err)
+		}
+		return ""
+	}
+	glog.Warningf("Image with unexpected digest is quarantined to %s", quarantinePath)
+	return quarantinePath
+}
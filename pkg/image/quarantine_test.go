@@ -0,0 +1,48 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantine(t *testing.T) {
+	storage, err := ioutil.TempDir("", "quarantine-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	// partial download may be written long before it is quarantined
+	path := filepath.Join(storage, ".partial-app")
+	require.NoError(t, ioutil.WriteFile(path, []byte("tampered"), 0644))
+	written := time.Now().Add(-30 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(path, written, written))
+
+	checksum := strings.Repeat("a", 64)
+	quarantined := quarantine(path, checksum)
+	require.Equal(t, filepath.Join(QuarantineDir(storage), checksum), quarantined)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "quarantined file is left in place")
+
+	fi, err := os.Stat(quarantined)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), fi.ModTime(), time.Minute, "quarantine time is not recorded")
+}
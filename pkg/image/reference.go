@@ -16,6 +16,7 @@ package image
 
 import (
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync"
 
@@ -23,9 +24,17 @@ import (
 	"github.com/sylabs/singularity-cri/pkg/slice"
 )
 
+// libraryScheme is a scheme singularity uses for images in sylabs cloud
+// library, e.g. library://sylabs/tests/busybox:1.0.0. Such references are
+// indexed with library domain, e.g. cloud.sylabs.io/sylabs/tests/busybox:1.0.0.
+const libraryScheme = "library://"
+
 // Reference holds parsed content of image reference.
 type Reference struct {
 	uri string
+	// pinned is a docker or ORAS reference image was requested by if it has both
+	// tag and digest, e.g. busybox:1.31@sha256:..., so that it is pulled by digest
+	pinned string
 
 	mu      sync.Mutex
 	tags    []string
@@ -33,11 +42,14 @@ type Reference struct {
 }
 
 // String returns first tag or digest found with origin domain as a prefix.
+// Reference pinned to digest is returned with both tag and digest instead.
 func (r *Reference) String() string {
 	var ref string
-	if len(r.tags) > 0 {
+	if r.pinned != "" {
+		ref = r.pinned
+	} else if len(r.tags) > 0 {
 		ref = r.tags[0]
-	} else {
+	} else if len(r.digests) > 0 {
 		ref = r.digests[0]
 	}
 	if r.uri == singularity.DockerDomain {
@@ -71,23 +83,79 @@ func (r *Reference) UnmarshalJSON(data []byte) error {
 	r.uri = jsonRef.URI
 	r.tags = jsonRef.Tags
 	r.digests = jsonRef.Digests
+	if r.uri == singularity.DockerDomain || r.uri == singularity.OrasDomain {
+		// references stored by older versions may be in a different
+		// form, e.g. library/busybox:latest, so normalize them
+		r.tags = normalizeRefs(r.tags)
+		r.digests = normalizeRefs(r.digests)
+	}
 	return err
 }
 
-// ParseRef constructs image reference based on imgRef.
+// normalizeRefs normalizes refs removing duplicates, but keeping
+// their order. Refs that cannot be normalized are kept intact.
+func normalizeRefs(refs []string) []string {
+	if refs == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		ref = NormalizedImageRef(ref)
+		if !slice.ContainsString(normalized, ref) {
+			normalized = append(normalized, ref)
+		}
+	}
+	return normalized
+}
+
+// ParseRef constructs image reference based on imgRef. Docker and ORAS
+// references are validated against docker reference grammar. Only Sylabs
+// Cloud domain is recognized as a library one, references with configured
+// library domains should be parsed with Libraries.ParseRef.
 func ParseRef(imgRef string) (*Reference, error) {
-	imgRef = NormalizedImageRef(imgRef)
+	var l *Libraries
+	return l.ParseRef(imgRef)
+}
+
+// ParseRef constructs image reference based on imgRef
+// recognizing domains of libraries l as library ones.
+func (l *Libraries) ParseRef(imgRef string) (*Reference, error) {
+	imgRef, err := l.normalizeRef(imgRef)
+	if err != nil {
+		return nil, err
+	}
 	if strings.HasPrefix(imgRef, singularity.LocalFileDomain) {
 		return &Reference{
 			uri:  singularity.LocalFileDomain,
 			tags: []string{imgRef},
 		}, nil
 	}
+	if isHTTPRef(imgRef) {
+		return &Reference{
+			uri:  singularity.HTTPDomain,
+			tags: []string{imgRef},
+		}, nil
+	}
+	if proto := localOCIProtocol(imgRef); proto != "" {
+		return &Reference{
+			uri:  proto,
+			tags: []string{imgRef},
+		}, nil
+	}
+	if scheme := customScheme(imgRef); scheme != "" {
+		return &Reference{
+			uri:  scheme,
+			tags: []string{imgRef},
+		}, nil
+	}
 
 	uri := singularity.DockerDomain
-	if strings.HasPrefix(imgRef, singularity.LibraryDomain) {
+	if l.isLibraryRef(imgRef) {
 		uri = singularity.LibraryDomain
 	}
+	if strings.HasPrefix(imgRef, singularity.OrasDomain+"://") {
+		uri = singularity.OrasDomain
+	}
 
 	ref := Reference{
 		uri: uri,
@@ -100,9 +168,14 @@ func ParseRef(imgRef string) (*Reference, error) {
 		} else {
 			ref.tags = []string{imgRef}
 		}
-	case singularity.DockerDomain:
+	case singularity.DockerDomain, singularity.OrasDomain:
 		if strings.IndexByte(imgRef, '@') != -1 {
-			ref.digests = []string{imgRef}
+			tag, digest := splitPinned(imgRef)
+			if tag != "" {
+				ref.tags = []string{tag}
+				ref.pinned = imgRef
+			}
+			ref.digests = []string{digest}
 		} else {
 			ref.tags = []string{imgRef}
 		}
@@ -119,6 +192,19 @@ func (r *Reference) URI() string {
 	return r.uri
 }
 
+// IsOCI returns true if image referenced by r was built from OCI image, i.e.
+// pulled from docker registry or imported from local OCI layout or archive.
+func (r *Reference) IsOCI() bool {
+	switch r.URI() {
+	case singularity.DockerDomain,
+		singularity.OCILayoutProtocol,
+		singularity.OCIArchiveProtocol,
+		singularity.DockerArchiveProtocol:
+		return true
+	}
+	return false
+}
+
 // Digests returns all digests referencing the image.
 func (r *Reference) Digests() []string {
 	digestsCopy := make([]string, len(r.digests))
@@ -161,21 +247,128 @@ func (r *Reference) RemoveTag(tag string) {
 	r.tags = slice.RemoveFromString(r.tags, tag)
 }
 
-// NormalizedImageRef appends tag 'latest' if the passed ref
-// does not have any tag or digest already. It also trims
-// default docker domain prefix if present.
+// NormalizedImageRef returns imgRef in the form images are indexed with. Docker
+// references are converted into familiar form, i.e. default docker.io domain and
+// library namespace are trimmed, and tag 'latest' is appended if the passed ref
+// does not have any tag or digest already. References with both tag and digest
+// are reduced to digest. Invalid references are returned intact. Only Sylabs Cloud
+// domain is recognized as a library one, see Libraries.NormalizedImageRef.
 func NormalizedImageRef(imgRef string) string {
-	imgRef = strings.TrimPrefix(imgRef, singularity.DockerDomain+"/")
-	i := strings.LastIndexByte(imgRef, ':')
-	if strings.HasPrefix(imgRef, singularity.LocalFileDomain) {
-		if i == -1 {
-			return imgRef
+	var l *Libraries
+	return l.NormalizedImageRef(imgRef)
+}
+
+// NormalizedImageRef returns imgRef in the form images are indexed with
+// recognizing domains of libraries l as library ones.
+func (l *Libraries) NormalizedImageRef(imgRef string) string {
+	ref, err := l.ParseRef(imgRef)
+	if err != nil {
+		return imgRef
+	}
+	if len(ref.tags) == 0 || ref.pinned != "" {
+		return ref.digests[0]
+	}
+	return ref.tags[0]
+}
+
+// normalizeRef normalizes imgRef for ParseRef returning an error
+// if docker or ORAS reference does not conform to the grammar.
+// Local OCI layouts are left intact since tag is optional for them.
+func (l *Libraries) normalizeRef(imgRef string) (string, error) {
+	switch {
+	case localOCIProtocol(imgRef) == singularity.OCILayoutProtocol:
+		return imgRef, nil
+	case strings.HasPrefix(imgRef, singularity.LocalFileDomain), isHTTPRef(imgRef),
+		localOCIProtocol(imgRef) != "", customScheme(imgRef) != "":
+		i := strings.LastIndexByte(imgRef, ':')
+		// colon may separate scheme, port or digest algorithm rather than a tag
+		if i < strings.LastIndexByte(imgRef, '/') ||
+			strings.LastIndexByte(imgRef, '@') > strings.LastIndexByte(imgRef, '/') {
+			return imgRef, nil
 		}
 		// kubernetes will add :latest tag, so we need to trim it for the file
-		return imgRef[:i]
+		return imgRef[:i], nil
+	case strings.HasPrefix(imgRef, libraryScheme):
+		return l.normalizeRef(singularity.LibraryDomain + "/" + strings.TrimPrefix(imgRef, libraryScheme))
+	case l.isLibraryRef(imgRef):
+		if strings.LastIndexByte(imgRef, ':') < strings.LastIndexByte(imgRef, '/') {
+			return imgRef + ":latest", nil
+		}
+		return imgRef, nil
+	case strings.HasPrefix(imgRef, singularity.OrasDomain+"://"):
+		ref, err := parseDockerRef(strings.TrimPrefix(imgRef, singularity.OrasDomain+"://"))
+		if err != nil {
+			return "", fmt.Errorf("invalid reference %q: %v", imgRef, err)
+		}
+		return singularity.OrasDomain + "://" + ref.normalized(ref.Name()), nil
+	default:
+		ref, err := parseDockerRef(imgRef)
+		if err != nil {
+			return "", fmt.Errorf("invalid reference %q: %v", imgRef, err)
+		}
+		return ref.normalized(ref.FamiliarName()), nil
+	}
+}
+
+// splitPinned splits normalized docker or ORAS reference with digest, e.g.
+// busybox:1.31@sha256:..., into tag and digest references, e.g. busybox:1.31
+// and busybox@sha256:.... Returned tag is empty if imgRef has no tag.
+func splitPinned(imgRef string) (string, string) {
+	i := strings.LastIndexByte(imgRef, '@')
+	name := imgRef[:i]
+	j := strings.LastIndexByte(name, ':')
+	// colon may separate scheme or port rather than a tag
+	if j <= strings.LastIndexByte(name, '/') {
+		return "", imgRef
+	}
+	return name, name[:j] + imgRef[i:]
+}
+
+// isLibraryRef returns true if imgRef references image in sylabs cloud
+// library or in one of the libraries l.
+func (l *Libraries) isLibraryRef(imgRef string) bool {
+	domain, _ := splitDomain(imgRef)
+	return domain != "" && l.isLibraryDomain(domain)
+}
+
+// isHTTPRef returns true if imgRef is URL of SIF file on a web server.
+func isHTTPRef(imgRef string) bool {
+	return strings.HasPrefix(imgRef, "https://") || strings.HasPrefix(imgRef, "http://")
+}
+
+// localOCIProtocol returns protocol of imgRef if it references local OCI layout,
+// OCI archive or docker archive, e.g. oci:/path/to/layout:tag, or empty string
+// otherwise. Only absolute paths are recognized so that docker images
+// like oci:latest are not mistaken for local ones.
+func localOCIProtocol(imgRef string) string {
+	protocols := []string{
+		singularity.OCILayoutProtocol,
+		singularity.OCIArchiveProtocol,
+		singularity.DockerArchiveProtocol,
+	}
+	for _, proto := range protocols {
+		if strings.HasPrefix(imgRef, proto+":/") {
+			return proto
+		}
 	}
-	if i == -1 {
-		return imgRef + ":latest"
+	return ""
+}
+
+// customScheme returns scheme of imgRef, e.g. s3 for s3://bucket/images/app.sif,
+// if source for it was registered with Register, or empty string otherwise.
+func customScheme(imgRef string) string {
+	i := strings.Index(imgRef, "://")
+	if i <= 0 {
+		return ""
+	}
+	scheme := imgRef[:i]
+	switch scheme {
+	case singularity.OrasDomain, singularity.HTTPDomain:
+		// built-in sources with their own reference format
+		return ""
+	}
+	if _, ok := lookupSource(scheme); !ok {
+		return ""
 	}
-	return imgRef
+	return scheme
 }
@@ -15,6 +15,8 @@
 package image
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -88,6 +90,69 @@ func TestParseImageRef(t *testing.T) {
 			},
 			expectError: nil,
 		},
+		{
+			name: "oras without tag",
+			ref:  "oras://harbor.local:5000/sylabs/busybox",
+			expect: &Reference{
+				uri:  singularity.OrasDomain,
+				tags: []string{"oras://harbor.local:5000/sylabs/busybox:latest"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "oras with digest",
+			ref:  "oras://harbor.local/sylabs/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: &Reference{
+				uri:     singularity.OrasDomain,
+				digests: []string{"oras://harbor.local/sylabs/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "https SIF with digest",
+			ref:  "https://example.com/images/app.sif#sha256=9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: &Reference{
+				uri:  singularity.HTTPDomain,
+				tags: []string{"https://example.com/images/app.sif#sha256=9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "OCI layout",
+			ref:  "oci:/var/images/layout:1.0",
+			expect: &Reference{
+				uri:  singularity.OCILayoutProtocol,
+				tags: []string{"oci:/var/images/layout:1.0"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "OCI archive",
+			ref:  "oci-archive:/var/images/busybox.tar",
+			expect: &Reference{
+				uri:  singularity.OCIArchiveProtocol,
+				tags: []string{"oci-archive:/var/images/busybox.tar"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "docker archive",
+			ref:  "docker-archive:/var/images/busybox.tar:latest",
+			expect: &Reference{
+				uri:  singularity.DockerArchiveProtocol,
+				tags: []string{"docker-archive:/var/images/busybox.tar"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "docker image named oci",
+			ref:  "oci:1.0",
+			expect: &Reference{
+				uri:  singularity.DockerDomain,
+				tags: []string{"oci:1.0"},
+			},
+			expectError: nil,
+		},
 		{
 			name: "local SIF",
 			ref:  "local.file/home/sasha/my.sif",
@@ -97,6 +162,58 @@ func TestParseImageRef(t *testing.T) {
 			},
 			expectError: nil,
 		},
+		{
+			name: "library scheme with digest",
+			ref:  "library://sylabs/tests/busybox:sha256.8b5478b0f2962eba3982be245986eb0ea54f5164d90a65c078af5b83147009ba",
+			expect: &Reference{
+				uri:     singularity.LibraryDomain,
+				digests: []string{"cloud.sylabs.io/sylabs/tests/busybox:sha256.8b5478b0f2962eba3982be245986eb0ea54f5164d90a65c078af5b83147009ba"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "docker official image",
+			ref:  "docker.io/library/busybox",
+			expect: &Reference{
+				uri:  singularity.DockerDomain,
+				tags: []string{"busybox:latest"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "docker with tag and digest",
+			ref:  "myregistry:5000/team/app:1.0@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: &Reference{
+				uri:     singularity.DockerDomain,
+				pinned:  "myregistry:5000/team/app:1.0@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+				tags:    []string{"myregistry:5000/team/app:1.0"},
+				digests: []string{"myregistry:5000/team/app@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+			expectError: nil,
+		},
+		{
+			name: "oras with tag and digest",
+			ref:  "oras://harbor.local/sylabs/busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: &Reference{
+				uri:     singularity.OrasDomain,
+				pinned:  "oras://harbor.local/sylabs/busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+				tags:    []string{"oras://harbor.local/sylabs/busybox:1.31"},
+				digests: []string{"oras://harbor.local/sylabs/busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+			expectError: nil,
+		},
+		{
+			name:        "invalid docker",
+			ref:         "gcr.io/cri-tools/Test-Image",
+			expect:      nil,
+			expectError: fmt.Errorf(`invalid reference "gcr.io/cri-tools/Test-Image": repository name must be lowercase`),
+		},
+		{
+			name:        "invalid oras",
+			ref:         "oras://harbor.local/sylabs/busybox@sha256:123",
+			expect:      nil,
+			expectError: fmt.Errorf(`invalid reference "oras://harbor.local/sylabs/busybox@sha256:123": invalid digest "sha256:123": invalid checksum digest length`),
+		},
 	}
 
 	for _, tc := range tt {
@@ -149,6 +266,41 @@ func TestNormalizedImageRef(t *testing.T) {
 			ref:    "cloud.sylabs.io/sashayakovtseva/test/image-server:sha256.9327532a05078d7efd5a0ef9ace1ee5cd278653d8df53590e2fb7a4a34cb0bb8",
 			expect: "cloud.sylabs.io/sashayakovtseva/test/image-server:sha256.9327532a05078d7efd5a0ef9ace1ee5cd278653d8df53590e2fb7a4a34cb0bb8",
 		},
+		{
+			name:   "docker image with registry port",
+			ref:    "localhost:5000/cri-tools/test-image-tags",
+			expect: "localhost:5000/cri-tools/test-image-tags:latest",
+		},
+		{
+			name:   "oras image without tag",
+			ref:    "oras://harbor.local/sylabs/busybox",
+			expect: "oras://harbor.local/sylabs/busybox:latest",
+		},
+		{
+			name:   "https SIF without tag",
+			ref:    "https://example.com/images/app.sif",
+			expect: "https://example.com/images/app.sif",
+		},
+		{
+			name:   "https SIF with tag",
+			ref:    "https://example.com:8443/images/app.sif:latest",
+			expect: "https://example.com:8443/images/app.sif",
+		},
+		{
+			name:   "OCI layout without tag",
+			ref:    "oci:/var/images/layout",
+			expect: "oci:/var/images/layout",
+		},
+		{
+			name:   "OCI layout with tag",
+			ref:    "oci:/var/images/layout:1.0",
+			expect: "oci:/var/images/layout:1.0",
+		},
+		{
+			name:   "OCI archive with tag",
+			ref:    "oci-archive:/var/images/busybox.tar:latest",
+			expect: "oci-archive:/var/images/busybox.tar",
+		},
 		{
 			name:   "local SIF without tag",
 			ref:    "local.file/home/sasha/my.sif",
@@ -159,6 +311,41 @@ func TestNormalizedImageRef(t *testing.T) {
 			ref:    "local.file/home/sasha/my.sif:latest",
 			expect: "local.file/home/sasha/my.sif",
 		},
+		{
+			name:   "docker official image",
+			ref:    "busybox",
+			expect: "busybox:latest",
+		},
+		{
+			name:   "docker official image with namespace",
+			ref:    "docker.io/library/busybox:1.31",
+			expect: "busybox:1.31",
+		},
+		{
+			name:   "docker image with registry port and namespace",
+			ref:    "myregistry:5000/team/app",
+			expect: "myregistry:5000/team/app:latest",
+		},
+		{
+			name:   "docker image with tag and digest",
+			ref:    "busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: "busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+		},
+		{
+			name:   "library scheme",
+			ref:    "library://sylabs/tests/busybox",
+			expect: "cloud.sylabs.io/sylabs/tests/busybox:latest",
+		},
+		{
+			name:   "invalid docker image",
+			ref:    "Busybox",
+			expect: "Busybox",
+		},
+		{
+			name:   "image ID",
+			ref:    "0123456789abcdef",
+			expect: "0123456789abcdef:latest",
+		},
 	}
 
 	for _, tc := range tt {
@@ -231,3 +418,54 @@ func TestReferenceTags(t *testing.T) {
 	}, ref.Tags())
 
 }
+
+func TestReference_UnmarshalJSON(t *testing.T) {
+	tt := []struct {
+		name   string
+		json   string
+		expect *Reference
+	}{
+		{
+			name: "docker",
+			json: `{"uri":"docker.io","tags":["busybox:1.31","gcr.io/foo/bar:1.0"],"digests":null}`,
+			expect: &Reference{
+				uri:  singularity.DockerDomain,
+				tags: []string{"busybox:1.31", "gcr.io/foo/bar:1.0"},
+			},
+		},
+		{
+			name: "docker legacy namespace",
+			json: `{"uri":"docker.io","tags":["library/busybox:1.31","busybox:1.31","library/busybox:latest"],` +
+				`"digests":["library/busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"]}`,
+			expect: &Reference{
+				uri:     singularity.DockerDomain,
+				tags:    []string{"busybox:1.31", "busybox:latest"},
+				digests: []string{"busybox@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343"},
+			},
+		},
+		{
+			name: "library",
+			json: `{"uri":"cloud.sylabs.io","tags":["cloud.sylabs.io/sylabs/tests/busybox:1.0.0"],"digests":null}`,
+			expect: &Reference{
+				uri:  singularity.LibraryDomain,
+				tags: []string{"cloud.sylabs.io/sylabs/tests/busybox:1.0.0"},
+			},
+		},
+		{
+			name: "invalid kept intact",
+			json: `{"uri":"docker.io","tags":["Busybox:1.31"],"digests":null}`,
+			expect: &Reference{
+				uri:  singularity.DockerDomain,
+				tags: []string{"Busybox:1.31"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var ref Reference
+			require.NoError(t, json.Unmarshal([]byte(tc.json), &ref))
+			require.Equal(t, tc.expect, &ref)
+		})
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// RegistryConfig describes where images are pulled from.
+type RegistryConfig struct {
+	// Hosts holds per registry settings keyed by registry domain,
+	// e.g. docker.io, gcr.io or cloud.sylabs.io.
+	Hosts map[string]HostConfig
+	// Rewrites are applied to image references before pulling.
+	// The first rule with matching prefix wins.
+	Rewrites []RewriteRule
+}
+
+// HostConfig holds settings of a single registry. Mirrors are registries
+// on their own, so their TLS settings are looked up by mirror host.
+type HostConfig struct {
+	// Mirrors are endpoints that are tried in order before the registry
+	// itself. For docker registries endpoint is a host with optional port
+	// and scheme, e.g. http://mirror.local:5000; for library it is a
+	// library API base URL. Credentials passed with pull request are never
+	// sent to mirrors.
+	Mirrors []string
+	// CAFile is a path to PEM encoded CA bundle registry certificate
+	// is verified with in addition to the system CAs.
+	CAFile string
+	// CertFile and KeyFile are paths to PEM encoded client
+	// certificate and key to present to registry.
+	CertFile string
+	KeyFile  string
+	// Insecure disables verification of registry certificate.
+	Insecure bool
+	// PlainHTTP makes registry be accessed over plain HTTP.
+	PlainHTTP bool
+}
+
+// RewriteRule replaces reference prefix. Rules are matched against references
+// with domain always present, e.g. docker.io/library/busybox:1.31 or
+// cloud.sylabs.io/sylabs/tests/busybox:1.0.0.
+type RewriteRule struct {
+	Prefix      string
+	Replacement string
+}
+
+// Registries holds validated registry config along with HTTP clients
+// for registries with custom TLS settings. Registries should be created with
+// NewRegistries and are applied to pulls with ctx returned by WithRegistries.
+type Registries struct {
+	cfg     RegistryConfig
+	clients map[string]*http.Client
+}
+
+// NewRegistries returns registries described by cfg. CA bundles and client
+// certificates are loaded right away, so any error with them is reported here.
+func NewRegistries(cfg RegistryConfig) (*Registries, error) {
+	clients := make(map[string]*http.Client)
+	for domain, host := range cfg.Hosts {
+		client, err := newHTTPClient(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for %s: %v", domain, err)
+		}
+		if client != nil {
+			clients[domain] = client
+		}
+	}
+	return &Registries{
+		cfg:     cfg,
+		clients: clients,
+	}, nil
+}
+
+type registriesKey struct{}
+
+// WithRegistries returns a copy of ctx that makes images
+// pulled with it be pulled according to registries r.
+func WithRegistries(ctx context.Context, r *Registries) context.Context {
+	return context.WithValue(ctx, registriesKey{}, r)
+}
+
+// registriesFrom returns registries set in ctx with WithRegistries, if any.
+// Returned value may be nil, which means no registry settings are applied.
+func registriesFrom(ctx context.Context) *Registries {
+	r, _ := ctx.Value(registriesKey{}).(*Registries)
+	return r
+}
+
+// newHTTPClient returns HTTP client that talks to registry with TLS settings
+// from host. If no custom TLS settings are present nil is returned.
+func newHTTPClient(host HostConfig) (*http.Client, error) {
+	if host.CAFile == "" && host.CertFile == "" && host.KeyFile == "" && !host.Insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: host.Insecure,
+	}
+	if host.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			glog.Warningf("Could not load system CAs: %v", err)
+			pool = x509.NewCertPool()
+		}
+		bundle, err := ioutil.ReadFile(host.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", host.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if host.CertFile != "" || host.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(host.CertFile, host.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// hostTransport returns HTTP client to talk to registry at domain
+// and whether plain HTTP should be used for that.
+func (r *Registries) hostTransport(domain string) (*http.Client, bool) {
+	if r == nil {
+		return http.DefaultClient, false
+	}
+	client, ok := r.clients[domain]
+	if !ok {
+		client = http.DefaultClient
+	}
+	return client, r.cfg.Hosts[domain].PlainHTTP
+}
+
+// registryOptions returns docker registry client options
+// that apply TLS settings configured for domain.
+func (r *Registries) registryOptions(domain string) []registry.Option {
+	client, plain := r.hostTransport(domain)
+	return []registry.Option{
+		registry.WithHTTPClient(client),
+		registry.WithPlainHTTP(plain),
+	}
+}
+
+// registryEndpoint is a docker registry image can be pulled from.
+type registryEndpoint struct {
+	host   string
+	mirror bool
+	opts   []registry.Option
+}
+
+// registryEndpoints returns endpoints to pull image from registry served on host
+// and known as domain. Configured mirrors go first. Credentials from auth, or
+// configured ones if auth has none, are passed to the registry itself only.
+func registryEndpoints(ctx context.Context, domain, host string, auth *k8s.AuthConfig) []registryEndpoint {
+	registries := registriesFrom(ctx)
+	var endpoints []registryEndpoint
+	for _, mirror := range registries.mirrors(domain) {
+		mirrorHost, plain := splitEndpoint(mirror)
+		opts := registries.registryOptions(mirrorHost)
+		if plain {
+			opts = append(opts, registry.WithPlainHTTP(true))
+		}
+		endpoints = append(endpoints, registryEndpoint{
+			host:   mirrorHost,
+			mirror: true,
+			opts:   opts,
+		})
+	}
+
+	// assume auth.Auth is not needed b/c k8s decodes it into username and password,
+	// see https://github.com/kubernetes/kubernetes/blob/master/pkg/credentialprovider/config.go#L284
+	auth = resolveAuth(ctx, domain, auth)
+	opts := append(registries.registryOptions(domain),
+		registry.WithCredentials(auth.GetUsername(), auth.GetPassword()),
+		registry.WithIdentityToken(auth.GetIdentityToken()))
+	return append(endpoints, registryEndpoint{
+		host: host,
+		opts: opts,
+	})
+}
+
+// pullFromRegistry calls pull with client for each endpoint in order until pull
+// succeeds. Errors from mirrors are logged, the error from the registry itself
+// is returned as is. Extra options are applied to each client.
+func pullFromRegistry(ctx context.Context, name string, endpoints []registryEndpoint,
+	pull func(client *registry.Client, host string) error, extra ...registry.Option) error {
+	var err error
+	for _, endpoint := range endpoints {
+		opts := append(endpoint.opts[:len(endpoint.opts):len(endpoint.opts)], extra...)
+		err = pull(registry.NewClient(endpoint.host, opts...), endpoint.host)
+		if err == nil || ctx.Err() != nil || !endpoint.mirror {
+			return err
+		}
+		glog.Warningf("Could not pull %s from mirror %s, trying next one: %v", name, endpoint.host, err)
+	}
+	return err
+}
+
+// manifestDigest resolves digest of the manifest referenced by name, e.g.
+// gcr.io/foo/bar:1.0, trying configured mirrors first. Manifest itself
+// is not downloaded unless registry fails to report its digest.
+func manifestDigest(ctx context.Context, name string, auth *k8s.AuthConfig) (digest.Digest, error) {
+	named, err := registryRef(name)
+	if err != nil {
+		return "", err
+	}
+
+	var dgst digest.Digest
+	resolve := func(client *registry.Client, host string) error {
+		var err error
+		dgst, err = client.ManifestDigest(ctx, named.path, named.reference())
+		return err
+	}
+	endpoints := registryEndpoints(ctx, named.domain, named.registryHost(), auth)
+	if err := pullFromRegistry(ctx, name, endpoints, resolve); err != nil {
+		return "", registryError(err)
+	}
+	return dgst, nil
+}
+
+// urlHost returns host of rawURL, e.g. library.local:8080
+// for https://library.local:8080/v1.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// mirrors returns mirror endpoints configured for domain.
+func (r *Registries) mirrors(domain string) []string {
+	if r == nil {
+		return nil
+	}
+	return r.cfg.Hosts[domain].Mirrors
+}
+
+// rewrite applies the first matching rewrite rule to name.
+func (r *Registries) rewrite(name string) string {
+	if r == nil {
+		return name
+	}
+	for _, rule := range r.cfg.Rewrites {
+		if strings.HasPrefix(name, rule.Prefix) {
+			rewritten := rule.Replacement + strings.TrimPrefix(name, rule.Prefix)
+			glog.V(4).Infof("Rewriting %s to %s", name, rewritten)
+			return rewritten
+		}
+	}
+	return name
+}
+
+// pullSource returns name image referenced by ref should be pulled from,
+// i.e. its sourceName with rewrite rules set in ctx applied.
+func pullSource(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) string {
+	return registriesFrom(ctx).rewrite(sourceName(ctx, ref, auth))
+}
+
+// sourceName returns full name of the image referenced by ref with domain always
+// present. Docker images are referenced by full name, e.g. docker.io/library/busybox:1.31
+// or gcr.io/foo/bar:1.0, ORAS images without scheme and HTTP images without digest
+// fragment. Server address passed with auth, if any, takes precedence over the
+// domain in ref. Images of other origins are referenced by ref itself.
+func sourceName(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) string {
+	name := strings.TrimPrefix(ref.String(), ref.URI()+"/")
+	switch ref.URI() {
+	case singularity.DockerDomain:
+		if auth.GetServerAddress() != "" {
+			name = auth.GetServerAddress() + "/" + name
+		}
+		name = strings.TrimPrefix(name, "https://")
+		name = strings.TrimPrefix(name, "http://")
+		if named, err := parseDockerRef(name); err == nil {
+			name = named.normalized(named.Name())
+		} else if domain, _ := splitDomain(name); !isDomain(domain) {
+			name = singularity.DockerDomain + "/" + name
+		}
+	case singularity.LibraryDomain:
+		// name keeps its domain only if it is one of configured library domains,
+		// otherwise image is stored in the default library
+		if domain, _ := splitDomain(name); !librariesFrom(ctx).isLibraryDomain(domain) {
+			name = ref.URI() + "/" + name
+		}
+	case singularity.OrasDomain:
+		name = strings.TrimPrefix(ref.String(), singularity.OrasDomain+"://")
+	case singularity.HTTPDomain:
+		name, _ = splitDigestFragment(ref.String())
+	default:
+		name = ref.String()
+	}
+	return name
+}
+
+// splitDomain splits name into the leading domain and the rest.
+func splitDomain(name string) (string, string) {
+	i := strings.IndexByte(name, '/')
+	if i == -1 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+// isDomain returns true if the first component of docker reference
+// is a registry domain rather than a part of repository name. Since
+// repository names are lowercase, uppercase component is a domain.
+func isDomain(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost" || s != strings.ToLower(s)
+}
+
+// splitEndpoint splits docker mirror endpoint into
+// host and whether plain HTTP should be used.
+func splitEndpoint(endpoint string) (string, bool) {
+	if strings.HasPrefix(endpoint, "http://") {
+		return strings.TrimSuffix(strings.TrimPrefix(endpoint, "http://"), "/"), true
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(endpoint, "https://"), "/"), false
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/registry"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPullSource(t *testing.T) {
+	registries, err := NewRegistries(RegistryConfig{
+		Rewrites: []RewriteRule{
+			{
+				Prefix:      "docker.io/myorg/",
+				Replacement: "registry.local/hub/myorg/",
+			},
+			{
+				Prefix:      "docker.io/myorg/private",
+				Replacement: "never.matches/",
+			},
+			{
+				Prefix:      "cloud.sylabs.io/sylabs/",
+				Replacement: "library.local/sylabs/",
+			},
+		},
+	})
+	require.NoError(t, err)
+	ctx := WithRegistries(context.Background(), registries)
+
+	tt := []struct {
+		name       string
+		ref        string
+		auth       *k8s.AuthConfig
+		expectName string
+	}{
+		{
+			name:       "docker hub",
+			ref:        "busybox:1.31",
+			expectName: "docker.io/library/busybox:1.31",
+		},
+		{
+			name:       "docker hub with domain",
+			ref:        "docker.io/library/busybox:1.31",
+			expectName: "docker.io/library/busybox:1.31",
+		},
+		{
+			name:       "custom registry",
+			ref:        "gcr.io/google-samples/hello-app:1.0",
+			expectName: "gcr.io/google-samples/hello-app:1.0",
+		},
+		{
+			name:       "registry with port",
+			ref:        "localhost:5000/foo@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expectName: "localhost:5000/foo@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+		},
+		{
+			name:       "tag and digest",
+			ref:        "busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expectName: "docker.io/library/busybox:1.31@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+		},
+		{
+			name: "server address",
+			ref:  "foo/bar:1.0",
+			auth: &k8s.AuthConfig{
+				ServerAddress: "https://registry.example.com",
+			},
+			expectName: "registry.example.com/foo/bar:1.0",
+		},
+		{
+			name:       "rewritten docker image",
+			ref:        "myorg/private:2.0",
+			expectName: "registry.local/hub/myorg/private:2.0",
+		},
+		{
+			name:       "library image",
+			ref:        "cloud.sylabs.io/sashayakovtseva/test/image-server",
+			expectName: "cloud.sylabs.io/sashayakovtseva/test/image-server:latest",
+		},
+		{
+			name:       "rewritten library image",
+			ref:        "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			expectName: "library.local/sylabs/tests/busybox:1.0.0",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := ParseRef(tc.ref)
+			require.NoError(t, err)
+			original := ref.String()
+			require.Equal(t, tc.expectName, pullSource(ctx, ref, tc.auth))
+			require.Equal(t, original, ref.String(), "reference must not be changed")
+		})
+	}
+
+	t.Run("library tag without domain", func(t *testing.T) {
+		ref := &Reference{
+			uri:  singularity.LibraryDomain,
+			tags: []string{"sashayakovtseva/test/image-server:latest"},
+		}
+		require.Equal(t, "cloud.sylabs.io/sashayakovtseva/test/image-server:latest", pullSource(ctx, ref, nil))
+	})
+}
+
+func TestLibraryEndpoints(t *testing.T) {
+	registries, err := NewRegistries(RegistryConfig{
+		Hosts: map[string]HostConfig{
+			"cloud.sylabs.io": {
+				Mirrors: []string{"https://mirror1.local", "https://mirror2.local"},
+			},
+		},
+		Rewrites: []RewriteRule{
+			{
+				Prefix:      "cloud.sylabs.io/internal/",
+				Replacement: "library.local/",
+			},
+		},
+	})
+	require.NoError(t, err)
+	libraries, err := NewLibraries(LibraryConfig{
+		Domains: map[string]string{
+			"library.lab.local":   "https://library.lab.local:8443",
+			"library.example.com": "",
+		},
+	})
+	require.NoError(t, err)
+	ctx := WithLibraries(WithRegistries(context.Background(), registries), libraries)
+
+	tt := []struct {
+		name            string
+		ref             string
+		auth            *k8s.AuthConfig
+		expectPath      string
+		expectEndpoints []libraryEndpoint
+	}{
+		{
+			name:       "mirrors",
+			ref:        "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			auth:       &k8s.AuthConfig{Password: "token"},
+			expectPath: "sylabs/tests/busybox:1.0.0",
+			expectEndpoints: []libraryEndpoint{
+				{baseURL: "https://mirror1.local"},
+				{baseURL: "https://mirror2.local"},
+				{token: "token"},
+			},
+		},
+		{
+			name: "server address",
+			ref:  "cloud.sylabs.io/sylabs/tests/busybox:1.0.0",
+			auth: &k8s.AuthConfig{
+				ServerAddress: "https://library.example.com",
+				Password:      "token",
+			},
+			expectPath: "sylabs/tests/busybox:1.0.0",
+			expectEndpoints: []libraryEndpoint{
+				{baseURL: "https://mirror1.local"},
+				{baseURL: "https://mirror2.local"},
+				{baseURL: "https://library.example.com", token: "token"},
+			},
+		},
+		{
+			name:       "rewritten",
+			ref:        "cloud.sylabs.io/internal/tests/busybox:1.0.0",
+			expectPath: "tests/busybox:1.0.0",
+			expectEndpoints: []libraryEndpoint{
+				{baseURL: "https://library.local"},
+			},
+		},
+		{
+			name:       "library domain",
+			ref:        "library.lab.local/team/app:1.0",
+			expectPath: "team/app:1.0",
+			expectEndpoints: []libraryEndpoint{
+				{baseURL: "https://library.lab.local:8443"},
+			},
+		},
+		{
+			name:       "library domain without URL",
+			ref:        "library.example.com/team/app:1.0",
+			expectPath: "team/app:1.0",
+			expectEndpoints: []libraryEndpoint{
+				{baseURL: "https://library.example.com"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ref, err := libraries.ParseRef(tc.ref)
+			require.NoError(t, err)
+			path, endpoints := libraryEndpoints(ctx, ref, tc.auth)
+			require.Equal(t, tc.expectPath, path)
+			require.Equal(t, tc.expectEndpoints, endpoints)
+		})
+	}
+}
+
+func TestSplitEndpoint(t *testing.T) {
+	tt := []struct {
+		endpoint    string
+		expectHost  string
+		expectPlain bool
+	}{
+		{
+			endpoint:   "mirror.gcr.io",
+			expectHost: "mirror.gcr.io",
+		},
+		{
+			endpoint:   "https://mirror.local/",
+			expectHost: "mirror.local",
+		},
+		{
+			endpoint:    "http://mirror.local:5000",
+			expectHost:  "mirror.local:5000",
+			expectPlain: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.endpoint, func(t *testing.T) {
+			host, plain := splitEndpoint(tc.endpoint)
+			require.Equal(t, tc.expectHost, host)
+			require.Equal(t, tc.expectPlain, plain)
+		})
+	}
+}
+
+func TestRegistryTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-tls-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, clientCAs := writeClientCert(t, dir)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/test/image/manifests/latest":
+			w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+			w.Write([]byte(`{"schemaVersion":2,"layers":[]}`))
+		case strings.HasPrefix(r.URL.Path, "/v1/images/test/image"):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data":{"hash":"sha256.0123456789abcdef","size":42}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	tlsHost := strings.TrimPrefix(tlsServer.URL, "https://")
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	require.NoError(t, ioutil.WriteFile(caFile, caPEM, 0644))
+
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+	plainHost := strings.TrimPrefix(plainServer.URL, "http://")
+
+	tt := []struct {
+		name        string
+		host        string
+		config      HostConfig
+		expectError string
+	}{
+		{
+			name:        "unknown CA",
+			host:        tlsHost,
+			expectError: "certificate",
+		},
+		{
+			name: "no client certificate",
+			host: tlsHost,
+			config: HostConfig{
+				CAFile: caFile,
+			},
+			expectError: "certificate",
+		},
+		{
+			name: "custom CA",
+			host: tlsHost,
+			config: HostConfig{
+				CAFile:   caFile,
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			},
+		},
+		{
+			name: "insecure",
+			host: tlsHost,
+			config: HostConfig{
+				CertFile: certFile,
+				KeyFile:  keyFile,
+				Insecure: true,
+			},
+		},
+		{
+			name: "plain HTTP",
+			host: plainHost,
+			config: HostConfig{
+				PlainHTTP: true,
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			registries, err := NewRegistries(RegistryConfig{
+				Hosts: map[string]HostConfig{
+					tc.host: tc.config,
+				},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			ctx = WithRegistries(ctx, registries)
+
+			client := registry.NewClient(tc.host, registries.registryOptions(tc.host)...)
+			_, _, err = client.Manifest(ctx, "test/image", "latest", registry.DefaultPlatform())
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+			} else {
+				require.NoError(t, err, "could not fetch manifest from registry")
+			}
+
+			ref, err := ParseRef(singularity.LibraryDomain + "/test/image")
+			require.NoError(t, err)
+			info, err := LibraryInfo(ctx, ref, &k8s.AuthConfig{ServerAddress: "https://" + tc.host})
+			if tc.expectError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.expectError)
+			} else {
+				require.NoError(t, err, "could not fetch image info from library")
+				require.Equal(t, "0123456789abcdef", info.ID)
+			}
+		})
+	}
+
+	t.Run("missing CA bundle", func(t *testing.T) {
+		_, err := NewRegistries(RegistryConfig{
+			Hosts: map[string]HostConfig{
+				tlsHost: {CAFile: filepath.Join(dir, "missing.pem")},
+			},
+		})
+		require.Error(t, err)
+	})
+}
+
+// writeClientCert generates self-signed client certificate and writes it along with
+// its key into dir. Returned pool should be used by server to verify clients.
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "could not generate key")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sycri"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err, "could not create certificate")
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// ErrNotSupported is returned by sources that cannot perform requested
+// operation, e.g. resolve image metadata without pulling the image.
+var ErrNotSupported = fmt.Errorf("not supported by image source")
+
+// Source is a backend images are pulled from. Each source serves image
+// references with a particular URI and is registered with Register.
+type Source interface {
+	// Info resolves metadata of the image referenced by ref without pulling it.
+	// Returned info should have at least ID, Sha256 and Ref set. If metadata
+	// cannot be resolved in advance ErrNotSupported is returned.
+	Info(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*Info, error)
+	// Pull pulls image referenced by ref and saves it as SIF at pullPath. If image
+	// is not found ErrNotFound is returned. Errors that cannot be fixed by retrying
+	// should be returned as permanent. Source may add digests of the pulled content
+	// to ref. Returned are digests of cached layers image relies on, if any. When
+	// pull fails, layers that may have been cached are returned along with error.
+	Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error)
+	// Digests returns digest references pinning the content ref currently
+	// points to, e.g. gcr.io/foo/bar@sha256:<hex> for gcr.io/foo/bar:1.0.
+	// If source has no notion of digests ErrNotSupported is returned.
+	Digests(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) ([]string, error)
+}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]Source{
+		singularity.LibraryDomain:         librarySource{},
+		singularity.DockerDomain:          dockerSource{},
+		singularity.OrasDomain:            orasSource{},
+		singularity.HTTPDomain:            httpSource{},
+		singularity.LocalFileDomain:       localFileSource{},
+		singularity.OCILayoutProtocol:     ociSource{},
+		singularity.OCIArchiveProtocol:    ociSource{},
+		singularity.DockerArchiveProtocol: ociSource{},
+	}
+)
+
+// Register makes src serve image references with passed uri replacing
+// previously registered source, if any. Besides overriding built-in sources,
+// e.g. with a fake in tests, this allows new ones to be added: references
+// in form <uri>://<location>, e.g. s3://bucket/images/app.sif, are parsed as
+// ones served by the source registered for uri and are passed to it as is.
+func Register(uri string, src Source) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[uri] = src
+}
+
+func lookupSource(uri string) (Source, bool) {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	src, ok := sources[uri]
+	return src, ok
+}
+
+// ResolveInfo resolves metadata of the image referenced by ref with the source
+// registered for its URI without pulling the image. If image is not found returns
+// ErrNotFound. If source cannot resolve metadata in advance returns ErrNotSupported.
+func ResolveInfo(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) (*Info, error) {
+	src, ok := lookupSource(ref.URI())
+	if !ok {
+		return nil, fmt.Errorf("unknown image registry: %s", ref.URI())
+	}
+	return src.Info(ctx, ref, auth)
+}
+
+// ResolveDigests returns digest references pinning the content ref currently points
+// to with the source registered for its URI. If source has no notion of digests
+// returns ErrNotSupported.
+func ResolveDigests(ctx context.Context, ref *Reference, auth *k8s.AuthConfig) ([]string, error) {
+	src, ok := lookupSource(ref.URI())
+	if !ok {
+		return nil, fmt.Errorf("unknown image registry: %s", ref.URI())
+	}
+	return src.Digests(ctx, ref, auth)
+}
+
+// localFileSource serves SIF images already present on the host, e.g.
+// local.file/home/user/app.sif. Such images are used in place and never pulled.
+type localFileSource struct{}
+
+func (localFileSource) Info(_ context.Context, ref *Reference, _ *k8s.AuthConfig) (*Info, error) {
+	info, err := sifInfo(strings.TrimPrefix(ref.String(), singularity.LocalFileDomain))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch local SIF info: %v", err)
+	}
+	info.Ref = ref
+	return info, nil
+}
+
+func (localFileSource) Pull(context.Context, *Reference, *k8s.AuthConfig, string) ([]string, error) {
+	return nil, permanent(fmt.Errorf("local images are used in place and cannot be pulled"))
+}
+
+func (localFileSource) Digests(context.Context, *Reference, *k8s.AuthConfig) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// repository returns image reference without tag or digest,
+// e.g. gcr.io/foo/bar for gcr.io/foo/bar:1.0.
+func repository(ref string) string {
+	if i := strings.IndexByte(ref, '@'); i != -1 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndexByte(ref, ':'); i > strings.LastIndexByte(ref, '/') {
+		return ref[:i]
+	}
+	return ref
+}
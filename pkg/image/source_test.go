@@ -0,0 +1,263 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+type fakeSource struct {
+	objects map[string][]byte
+}
+
+func (s *fakeSource) Info(_ context.Context, ref *Reference, _ *k8s.AuthConfig) (*Info, error) {
+	content, ok := s.objects[ref.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+	return &Info{
+		ID:     checksum,
+		Sha256: checksum,
+		Size:   uint64(len(content)),
+		Ref:    ref,
+	}, nil
+}
+
+func (s *fakeSource) Pull(_ context.Context, ref *Reference, _ *k8s.AuthConfig, pullPath string) ([]string, error) {
+	content, ok := s.objects[ref.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return nil, ioutil.WriteFile(pullPath, content, 0644)
+}
+
+func (s *fakeSource) Digests(_ context.Context, ref *Reference, _ *k8s.AuthConfig) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+func TestRegister(t *testing.T) {
+	const imgRef = "fake://bucket/images/app.sif"
+	content := []byte("pretend this is a SIF file")
+	checksum := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	_, err := ParseRef(imgRef)
+	require.Error(t, err, "unregistered scheme should not be recognized")
+
+	Register("fake", &fakeSource{
+		objects: map[string][]byte{imgRef: content},
+	})
+	defer func() {
+		sourcesMu.Lock()
+		delete(sources, "fake")
+		sourcesMu.Unlock()
+	}()
+
+	storage, err := ioutil.TempDir("", "source-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	ref, err := ParseRef(imgRef + ":latest")
+	require.NoError(t, err)
+	require.Equal(t, "fake", ref.URI())
+	require.Equal(t, []string{imgRef}, ref.Tags())
+
+	info, err := ResolveInfo(context.Background(), ref, nil)
+	require.NoError(t, err)
+	require.Equal(t, checksum, info.ID)
+
+	_, err = ResolveDigests(context.Background(), ref, nil)
+	require.Equal(t, ErrNotSupported, err)
+
+	info, _, err = Pull(context.Background(), nil, storage, ref, nil, "")
+	require.NoError(t, err)
+	require.Equal(t, checksum, info.ID)
+	require.Equal(t, filepath.Join(storage, checksum), info.Path)
+	require.Equal(t, ref, info.Ref)
+
+	expected := strings.Repeat("0", 64)
+	_, _, err = Pull(context.Background(), nil, storage, ref, nil, expected)
+	require.Equal(t, &DigestMismatchError{
+		Ref:      imgRef,
+		Expected: expected,
+		Actual:   checksum,
+		Path:     filepath.Join(QuarantineDir(storage), checksum),
+	}, err)
+	quarantined, err := ioutil.ReadFile(filepath.Join(QuarantineDir(storage), checksum))
+	require.NoError(t, err, "mismatched image should be quarantined")
+	require.Equal(t, content, quarantined)
+
+	ref, err = ParseRef("fake://bucket/images/missing.sif")
+	require.NoError(t, err)
+	_, _, err = Pull(context.Background(), nil, storage, ref, nil, "")
+	require.Equal(t, ErrNotFound, err)
+}
+
+// layerSource pretends to cache passed layers on each pull attempt
+// and fails with errors in order until they are exhausted.
+type layerSource struct {
+	fakeSource
+	layers [][]string
+	errs   []error
+	calls  int
+}
+
+func (s *layerSource) Pull(ctx context.Context, ref *Reference, auth *k8s.AuthConfig, pullPath string) ([]string, error) {
+	layers := s.layers[s.calls]
+	if s.calls < len(s.errs) {
+		s.calls++
+		return layers, s.errs[s.calls-1]
+	}
+	s.calls++
+	_, err := s.fakeSource.Pull(ctx, ref, auth, pullPath)
+	return layers, err
+}
+
+func TestPull_Layers(t *testing.T) {
+	const imgRef = "fake-layers://bucket/images/app.sif"
+	content := []byte("pretend this is a SIF built from layers")
+	policy := NewPullPolicy(PullPolicy{
+		Retry: RetryPolicy{
+			Attempts:       2,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+	})
+
+	storage, err := ioutil.TempDir("", "source-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	tt := []struct {
+		name         string
+		layers       [][]string
+		errs         []error
+		expectLayers []string
+		expectError  string
+	}{
+		{
+			name:         "retried pull",
+			layers:       [][]string{{"sha256:aaa", "sha256:bbb"}, {"sha256:bbb", "sha256:ccc"}},
+			errs:         []error{fmt.Errorf("connection reset by peer")},
+			expectLayers: []string{"sha256:aaa", "sha256:bbb", "sha256:ccc"},
+		},
+		{
+			name:         "failed pull",
+			layers:       [][]string{{"sha256:aaa"}, {"sha256:aaa", "sha256:bbb"}},
+			errs:         []error{fmt.Errorf("connection reset by peer"), fmt.Errorf("build failed")},
+			expectLayers: []string{"sha256:aaa", "sha256:bbb"},
+			expectError:  "could not pull image: build failed",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			Register("fake-layers", &layerSource{
+				fakeSource: fakeSource{objects: map[string][]byte{imgRef: content}},
+				layers:     tc.layers,
+				errs:       tc.errs,
+			})
+			defer func() {
+				sourcesMu.Lock()
+				delete(sources, "fake-layers")
+				sourcesMu.Unlock()
+			}()
+
+			ref, err := ParseRef(imgRef)
+			require.NoError(t, err)
+			info, layers, err := Pull(context.Background(), policy, storage, ref, nil, "")
+			require.Equal(t, tc.expectLayers, layers)
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				require.Nil(t, info)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectLayers, info.Layers)
+		})
+	}
+}
+
+func TestResolveInfo_Unsupported(t *testing.T) {
+	for _, imgRef := range []string{
+		"gcr.io/cri-tools/test-image-latest",
+		"https://example.com/images/app.sif",
+		"oci-archive:/var/images/busybox.tar",
+	} {
+		t.Run(imgRef, func(t *testing.T) {
+			ref, err := ParseRef(imgRef)
+			require.NoError(t, err)
+			_, err = ResolveInfo(context.Background(), ref, nil)
+			require.Equal(t, ErrNotSupported, err)
+		})
+	}
+}
+
+func TestRepository(t *testing.T) {
+	tt := []struct {
+		ref    string
+		expect string
+	}{
+		{
+			ref:    "busybox:1.31",
+			expect: "busybox",
+		},
+		{
+			ref:    "localhost:5000/foo/bar",
+			expect: "localhost:5000/foo/bar",
+		},
+		{
+			ref:    "gcr.io/foo/bar@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: "gcr.io/foo/bar",
+		},
+		{
+			ref:    "gcr.io/foo/bar:1.0@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: "gcr.io/foo/bar",
+		},
+		{
+			ref:    "cloud.sylabs.io/sylabs/tests/busybox:sha256.8b5478b0f2962eba3982be245986eb0ea54f5164d90a65c078af5b83147009ba",
+			expect: "cloud.sylabs.io/sylabs/tests/busybox",
+		},
+		{
+			ref:    "oras://harbor.local/foo/bar:1.0",
+			expect: "oras://harbor.local/foo/bar",
+		},
+		{
+			ref:    "oras://harbor.local:5000/foo/bar",
+			expect: "oras://harbor.local:5000/foo/bar",
+		},
+		{
+			ref:    "oras://harbor.local/foo/bar@sha256:9179135b4b4cc5a8721e09379244807553c318d92fa3111a65133241551ca343",
+			expect: "oras://harbor.local/foo/bar",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.ref, func(t *testing.T) {
+			require.Equal(t, tc.expect, repository(tc.ref))
+		})
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity-cri/pkg/slice"
+	"github.com/sylabs/singularity/pkg/sypgp"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// VerifyMode defines what images are admitted by signature verification.
+type VerifyMode string
+
+const (
+	// VerifyDisabled turns signature verification off.
+	VerifyDisabled VerifyMode = "disabled"
+	// VerifyWarn admits unsigned images and images signed by untrusted
+	// or unknown keys logging a warning.
+	VerifyWarn VerifyMode = "warn"
+	// VerifyRequireSigned admits only images signed by a trusted key.
+	VerifyRequireSigned VerifyMode = "require-signed"
+)
+
+// VerifyPolicy controls how signatures of pulled images are verified. Regardless
+// of the mode images with signatures that do not match their content are rejected.
+type VerifyPolicy struct {
+	// Mode is applied to images no rule matches. Defaults to VerifyWarn.
+	Mode VerifyMode
+	// KeyServer is used to fetch keys that are not found in Keyring.
+	// Defaults to singularity.KeysServer.
+	KeyServer string
+	// Offline disables key server lookups, so only Keyring is used.
+	Offline bool
+	// Keyring is a path to a local public keyring, either binary
+	// or ASCII armored, signing keys are looked up in first.
+	Keyring string
+	// TrustedKeys are fingerprints of keys images should be signed with.
+	// When empty any key found in keyring or at key server is trusted.
+	TrustedKeys []string
+	// Rules override Mode and TrustedKeys for particular registries
+	// or namespaces. The first rule with matching prefix wins.
+	Rules []VerifyRule
+}
+
+// VerifyRule overrides verification policy for images which full name starts
+// with Prefix, e.g. docker.io/library/, gcr.io/ or cloud.sylabs.io/sylabs/.
+// Full name always has domain, e.g. docker.io/library/busybox:1.31.
+type VerifyRule struct {
+	Prefix string
+	// Mode defaults to the policy mode.
+	Mode VerifyMode
+	// TrustedKeys default to the policy trusted keys.
+	TrustedKeys []string
+}
+
+// VerificationError is returned when image is rejected by verification policy.
+type VerificationError struct {
+	Ref    string
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("image %s is rejected by verification policy: %s", e.Ref, e.Reason)
+}
+
+// NewVerifyPolicy validates p and returns policy with defaults applied.
+// Keyring, if any, is loaded to make sure it is valid, but is read again on
+// each verification, so that keys may be added without restart.
+func NewVerifyPolicy(p VerifyPolicy) (*VerifyPolicy, error) {
+	if p.Mode == "" {
+		p.Mode = VerifyWarn
+	}
+	if !validMode(p.Mode) {
+		return nil, fmt.Errorf("unknown verification mode %q", p.Mode)
+	}
+	if p.KeyServer == "" {
+		p.KeyServer = singularity.KeysServer
+	}
+	if p.Offline && p.Keyring == "" {
+		return nil, fmt.Errorf("keyring is required for offline verification")
+	}
+	if p.Keyring != "" {
+		if _, err := loadKeyring(p.Keyring); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if p.TrustedKeys, err = normalizeFingerprints(p.TrustedKeys); err != nil {
+		return nil, err
+	}
+	rules := make([]VerifyRule, len(p.Rules))
+	for i, rule := range p.Rules {
+		if rule.Mode == "" {
+			rule.Mode = p.Mode
+		}
+		if !validMode(rule.Mode) {
+			return nil, fmt.Errorf("unknown verification mode %q for %s", rule.Mode, rule.Prefix)
+		}
+		if rule.TrustedKeys, err = normalizeFingerprints(rule.TrustedKeys); err != nil {
+			return nil, err
+		}
+		if len(rule.TrustedKeys) == 0 {
+			rule.TrustedKeys = p.TrustedKeys
+		}
+		rules[i] = rule
+	}
+	p.Rules = rules
+	return &p, nil
+}
+
+// Verify verifies signatures of image pulled with auth according to the passed policy,
+// nil policy means VerifyWarn mode with the default key server. Rules are matched against
+// the full name of the image source before rewrite rules are applied, so ctx should hold
+// libraries image is pulled with. If image is rejected *VerificationError is returned.
+func (i *Info) Verify(ctx context.Context, policy *VerifyPolicy, auth *k8s.AuthConfig) error {
+	p := VerifyPolicy{
+		Mode:      VerifyWarn,
+		KeyServer: singularity.KeysServer,
+	}
+	if policy != nil {
+		p = *policy
+	}
+
+	ref := sourceName(ctx, i.Ref, auth)
+	mode, trusted := p.match(ref)
+	if mode == VerifyDisabled {
+		return nil
+	}
+
+	var keyring openpgp.EntityList
+	if p.Keyring != "" {
+		var err error
+		if keyring, err = loadKeyring(p.Keyring); err != nil {
+			return err
+		}
+	}
+	keyServer := p.KeyServer
+	if p.Offline {
+		keyServer = ""
+	}
+
+	signers, err := verifySignatures(i.Path, keyring, keyServer)
+	if err != nil {
+		if verr, ok := err.(*VerificationError); ok {
+			verr.Ref = ref
+		}
+		return err
+	}
+
+	reject := func(reason string) error {
+		if mode == VerifyRequireSigned {
+			return &VerificationError{Ref: ref, Reason: reason}
+		}
+		glog.Warningf("Image %s is admitted despite verification failure: %s", ref, reason)
+		return nil
+	}
+	if len(signers) == 0 {
+		return reject("image is not signed")
+	}
+	for _, signer := range signers {
+		if signer.known && (len(trusted) == 0 || slice.ContainsString(trusted, signer.fingerprint)) {
+			glog.V(2).Infof("Image %s is signed by %s (%s)", ref, signer.identity, signer.fingerprint)
+			return nil
+		}
+	}
+	return reject("image is not signed by a trusted key")
+}
+
+// match returns verification mode and trusted keys applied to image known by name.
+func (p VerifyPolicy) match(name string) (VerifyMode, []string) {
+	for _, rule := range p.Rules {
+		if strings.HasPrefix(name, rule.Prefix) {
+			return rule.Mode, rule.TrustedKeys
+		}
+	}
+	return p.Mode, p.TrustedKeys
+}
+
+// signer describes a valid signature found in SIF image.
+type signer struct {
+	fingerprint string
+	identity    string
+	// known is false when signing key was found neither
+	// in keyring nor at key server, so signature was not checked
+	known bool
+}
+
+// verifySignatures checks all signatures of SIF primary partition at path and
+// returns their signers. Signatures are checked with keys from keyring, falling back
+// to keyServer unless it is empty. Signatures that do not match image content result
+// in *VerificationError with no Ref set, since this is never acceptable.
+func verifySignatures(path string, keyring openpgp.EntityList, keyServer string) ([]signer, error) {
+	fimg, err := sif.LoadContainer(path, true)
+	if err != nil {
+		return nil, fmt.Errorf("could not load SIF: %v", err)
+	}
+	defer fimg.UnloadContainer()
+
+	part, _, err := fimg.GetPartPrimSys()
+	if err == sif.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not find primary partition: %v", err)
+	}
+	sigs, _, err := fimg.GetLinkedDescrsByType(part.ID, sif.DataSignature)
+	if err == sif.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not find signatures: %v", err)
+	}
+
+	hash := sha512.New384()
+	hash.Write(part.GetData(&fimg))
+	sifHash := fmt.Sprintf("SIFHASH:\n%x", hash.Sum(nil))
+
+	signers := make([]signer, 0, len(sigs))
+	for _, sig := range sigs {
+		fingerprint, err := sig.GetEntityString()
+		if err != nil {
+			return nil, fmt.Errorf("could not get signing key fingerprint: %v", err)
+		}
+		block, _ := clearsign.Decode(sig.GetData(&fimg))
+		if block == nil {
+			return nil, verificationFailed("signature by %s is corrupted", fingerprint)
+		}
+		if !bytes.Equal(bytes.TrimRight(block.Plaintext, "\n"), []byte(sifHash)) {
+			return nil, verificationFailed("data signed by %s differs from image content", fingerprint)
+		}
+
+		entity, err := checkSignature(keyring, block)
+		if err == pgperrors.ErrUnknownIssuer && keyServer != "" {
+			glog.V(4).Infof("Key %s is not found in keyring, fetching it from %s", fingerprint, keyServer)
+			var remote openpgp.EntityList
+			remote, err = sypgp.FetchPubkey(fingerprint, keyServer, "", true)
+			if err != nil {
+				glog.Warningf("Could not fetch key %s: %v", fingerprint, err)
+				err = pgperrors.ErrUnknownIssuer
+			} else {
+				entity, err = checkSignature(remote, block)
+			}
+		}
+		if err == pgperrors.ErrUnknownIssuer {
+			signers = append(signers, signer{fingerprint: fingerprint})
+			continue
+		}
+		if err != nil {
+			return nil, verificationFailed("signature by %s is invalid: %v", fingerprint, err)
+		}
+		signers = append(signers, signer{
+			fingerprint: fingerprint,
+			identity:    firstIdentity(entity),
+			known:       true,
+		})
+	}
+	return signers, nil
+}
+
+func checkSignature(keyring openpgp.EntityList, block *clearsign.Block) (*openpgp.Entity, error) {
+	return openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+}
+
+func verificationFailed(format string, args ...interface{}) error {
+	return &VerificationError{Reason: "verification failed: " + fmt.Sprintf(format, args...)}
+}
+
+func firstIdentity(e *openpgp.Entity) string {
+	for name := range e.Identities {
+		return name
+	}
+	return ""
+}
+
+// loadKeyring loads public keys from binary or ASCII armored keyring at path.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open keyring: %v", err)
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadKeyRing(f)
+	if err == nil {
+		return keyring, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not read keyring: %v", err)
+	}
+	keyring, err = openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keyring: %v", err)
+	}
+	return keyring, nil
+}
+
+// normalizeFingerprints converts key fingerprints into the form they
+// are stored in SIF, i.e. upper case hex with no spaces.
+func normalizeFingerprints(fingerprints []string) ([]string, error) {
+	normalized := make([]string, 0, len(fingerprints))
+	for _, fp := range fingerprints {
+		n := strings.ToUpper(strings.Replace(fp, " ", "", -1))
+		if b, err := hex.DecodeString(n); err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("invalid key fingerprint %q", fp)
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+func validMode(mode VerifyMode) bool {
+	switch mode {
+	case VerifyDisabled, VerifyWarn, VerifyRequireSigned:
+		return true
+	}
+	return false
+}
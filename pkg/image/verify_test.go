@@ -0,0 +1,380 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+func TestInfo_VerifyPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	signer := newTestEntity(t, "signer")
+	other := newTestEntity(t, "other")
+	signerFp := fingerprint(signer)
+	otherFp := fingerprint(other)
+
+	keyring := filepath.Join(dir, "keyring")
+	writeKeyring(t, keyring, signer, other)
+	otherKeyring := filepath.Join(dir, "other-keyring")
+	writeKeyring(t, otherKeyring, other)
+
+	unsigned := filepath.Join(dir, "unsigned.sif")
+	writeSIF(t, unsigned, nil, false)
+	signed := filepath.Join(dir, "signed.sif")
+	writeSIF(t, signed, signer, false)
+	corrupted := filepath.Join(dir, "corrupted.sif")
+	writeSIF(t, corrupted, signer, true)
+
+	libraryRef := &Reference{
+		uri:  singularity.LibraryDomain,
+		tags: []string{"cloud.sylabs.io/sylabs/tests/app:1.0"},
+	}
+	dockerRef := &Reference{
+		uri:  singularity.DockerDomain,
+		tags: []string{"busybox:1.31"},
+	}
+	gcrRef := &Reference{
+		uri:  singularity.DockerDomain,
+		tags: []string{"gcr.io/foo/bar:1.0"},
+	}
+	portRef := &Reference{
+		uri:  singularity.DockerDomain,
+		tags: []string{"registry.local:5000/team/app:1.0"},
+	}
+
+	tt := []struct {
+		name        string
+		policy      VerifyPolicy
+		path        string
+		ref         *Reference
+		expectError string
+	}{
+		{
+			name:   "disabled",
+			policy: VerifyPolicy{Mode: VerifyDisabled},
+			path:   corrupted,
+			ref:    libraryRef,
+		},
+		{
+			name:   "warn unsigned",
+			policy: VerifyPolicy{Mode: VerifyWarn, Offline: true, Keyring: keyring},
+			path:   unsigned,
+			ref:    libraryRef,
+		},
+		{
+			name:   "warn unknown key",
+			policy: VerifyPolicy{Mode: VerifyWarn, Offline: true, Keyring: otherKeyring},
+			path:   signed,
+			ref:    libraryRef,
+		},
+		{
+			name:        "warn corrupted",
+			policy:      VerifyPolicy{Mode: VerifyWarn, Offline: true, Keyring: keyring},
+			path:        corrupted,
+			ref:         libraryRef,
+			expectError: "verification failed: data signed by " + signerFp + " differs from image content",
+		},
+		{
+			name:        "require unsigned",
+			policy:      VerifyPolicy{Mode: VerifyRequireSigned, Offline: true, Keyring: keyring},
+			path:        unsigned,
+			ref:         libraryRef,
+			expectError: "image cloud.sylabs.io/sylabs/tests/app:1.0 is rejected by verification policy: image is not signed",
+		},
+		{
+			name:   "require signed",
+			policy: VerifyPolicy{Mode: VerifyRequireSigned, Offline: true, Keyring: keyring},
+			path:   signed,
+			ref:    libraryRef,
+		},
+		{
+			name:        "require unknown key",
+			policy:      VerifyPolicy{Mode: VerifyRequireSigned, Offline: true, Keyring: otherKeyring},
+			path:        signed,
+			ref:         libraryRef,
+			expectError: "image is not signed by a trusted key",
+		},
+		{
+			name: "require trusted key",
+			policy: VerifyPolicy{
+				Mode:        VerifyRequireSigned,
+				Offline:     true,
+				Keyring:     keyring,
+				TrustedKeys: []string{signerFp},
+			},
+			path: signed,
+			ref:  libraryRef,
+		},
+		{
+			name: "require untrusted key",
+			policy: VerifyPolicy{
+				Mode:        VerifyRequireSigned,
+				Offline:     true,
+				Keyring:     keyring,
+				TrustedKeys: []string{otherFp},
+			},
+			path:        signed,
+			ref:         libraryRef,
+			expectError: "image is not signed by a trusted key",
+		},
+		{
+			name: "namespace rule",
+			policy: VerifyPolicy{
+				Mode:    VerifyRequireSigned,
+				Offline: true,
+				Keyring: keyring,
+				Rules: []VerifyRule{
+					{Prefix: "cloud.sylabs.io/sylabs/", TrustedKeys: []string{otherFp}},
+				},
+			},
+			path:        signed,
+			ref:         libraryRef,
+			expectError: "image is not signed by a trusted key",
+		},
+		{
+			name: "registry rule",
+			policy: VerifyPolicy{
+				Mode:    VerifyRequireSigned,
+				Offline: true,
+				Keyring: keyring,
+				Rules: []VerifyRule{
+					{Prefix: "docker.io/", Mode: VerifyWarn},
+				},
+			},
+			path: unsigned,
+			ref:  dockerRef,
+		},
+		{
+			name: "official images rule",
+			policy: VerifyPolicy{
+				Mode:    VerifyRequireSigned,
+				Offline: true,
+				Keyring: keyring,
+				Rules: []VerifyRule{
+					{Prefix: "docker.io/library/", Mode: VerifyWarn},
+				},
+			},
+			path: unsigned,
+			ref:  dockerRef,
+		},
+		{
+			name: "gcr rule",
+			policy: VerifyPolicy{
+				Mode:    VerifyWarn,
+				Offline: true,
+				Keyring: keyring,
+				Rules: []VerifyRule{
+					{Prefix: "docker.io/", Mode: VerifyWarn},
+					{Prefix: "gcr.io/", Mode: VerifyRequireSigned},
+				},
+			},
+			path:        unsigned,
+			ref:         gcrRef,
+			expectError: "image gcr.io/foo/bar:1.0 is rejected by verification policy: image is not signed",
+		},
+		{
+			name: "registry with port rule",
+			policy: VerifyPolicy{
+				Mode:    VerifyWarn,
+				Offline: true,
+				Keyring: keyring,
+				Rules: []VerifyRule{
+					{Prefix: "registry.local:5000/", Mode: VerifyRequireSigned},
+				},
+			},
+			path:        unsigned,
+			ref:         portRef,
+			expectError: "image registry.local:5000/team/app:1.0 is rejected by verification policy",
+		},
+		{
+			name:        "missing image",
+			policy:      VerifyPolicy{Mode: VerifyWarn, Offline: true, Keyring: keyring},
+			path:        filepath.Join(dir, "missing.sif"),
+			ref:         libraryRef,
+			expectError: "no such file or directory",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewVerifyPolicy(tc.policy)
+			require.NoError(t, err)
+			info := &Info{
+				Path: tc.path,
+				Ref:  tc.ref,
+			}
+			err = info.Verify(context.Background(), p, nil)
+			if tc.expectError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectError)
+		})
+	}
+}
+
+func TestNewVerifyPolicy(t *testing.T) {
+	tt := []struct {
+		name        string
+		policy      VerifyPolicy
+		expectError string
+	}{
+		{
+			name:   "defaults",
+			policy: VerifyPolicy{},
+		},
+		{
+			name:        "unknown mode",
+			policy:      VerifyPolicy{Mode: "strict"},
+			expectError: `unknown verification mode "strict"`,
+		},
+		{
+			name: "unknown rule mode",
+			policy: VerifyPolicy{
+				Rules: []VerifyRule{{Prefix: "docker.io/", Mode: "off"}},
+			},
+			expectError: `unknown verification mode "off" for docker.io/`,
+		},
+		{
+			name: "invalid fingerprint",
+			policy: VerifyPolicy{
+				TrustedKeys: []string{"8883491F4268F173C6E5DC49EDECE4F3F38D871E", "F38D871E"},
+			},
+			expectError: `invalid key fingerprint "F38D871E"`,
+		},
+		{
+			name: "fingerprint with spaces",
+			policy: VerifyPolicy{
+				TrustedKeys: []string{"8883 491f 4268 f173 c6e5  dc49 edec e4f3 f38d 871e"},
+			},
+		},
+		{
+			name:        "offline without keyring",
+			policy:      VerifyPolicy{Offline: true},
+			expectError: "keyring is required for offline verification",
+		},
+		{
+			name:        "missing keyring",
+			policy:      VerifyPolicy{Keyring: "/not/exist/keyring"},
+			expectError: "could not open keyring",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewVerifyPolicy(tc.policy)
+			if tc.expectError == "" {
+				require.NoError(t, err)
+				require.NotEmpty(t, p.Mode)
+				require.NotEmpty(t, p.KeyServer)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.expectError)
+		})
+	}
+}
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	require.NoError(t, err, "could not generate key")
+	return e
+}
+
+func fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%0X", e.PrimaryKey.Fingerprint[:])
+}
+
+func writeKeyring(t *testing.T, path string, entities ...*openpgp.Entity) {
+	var buf bytes.Buffer
+	for _, e := range entities {
+		require.NoError(t, e.Serialize(&buf), "could not serialize key")
+	}
+	require.NoError(t, ioutil.WriteFile(path, buf.Bytes(), 0644))
+}
+
+// writeSIF creates SIF with a dummy primary partition at path. If signer is not nil
+// partition is signed the same way singularity sign does. When corrupt is true
+// signed hash does not match partition content.
+func writeSIF(t *testing.T, path string, signer *openpgp.Entity, corrupt bool) {
+	data := []byte("pretend this is a squashfs")
+	part := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Fname:    "rootfs",
+		Data:     data,
+		Size:     int64(len(data)),
+	}
+	require.NoError(t, part.SetPartExtra(sif.FsSquash, sif.PartPrimSys, sif.GetSIFArch(runtime.GOARCH)))
+	_, err := sif.CreateContainer(sif.CreateInfo{
+		Pathname:   path,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		InputDescr: []sif.DescriptorInput{part},
+	})
+	require.NoError(t, err, "could not create SIF")
+	if signer == nil {
+		return
+	}
+
+	if corrupt {
+		data = []byte("something else")
+	}
+	hash := sha512.New384()
+	hash.Write(data)
+	var signature bytes.Buffer
+	plaintext, err := clearsign.Encode(&signature, signer.PrivateKey, nil)
+	require.NoError(t, err)
+	_, err = fmt.Fprintf(plaintext, "SIFHASH:\n%x", hash.Sum(nil))
+	require.NoError(t, err)
+	require.NoError(t, plaintext.Close())
+
+	fimg, err := sif.LoadContainer(path, false)
+	require.NoError(t, err, "could not load SIF")
+	defer fimg.UnloadContainer()
+	primary, _, err := fimg.GetPartPrimSys()
+	require.NoError(t, err)
+
+	sig := sif.DescriptorInput{
+		Datatype: sif.DataSignature,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     primary.ID,
+		Fname:    "part-signature",
+		Data:     signature.Bytes(),
+		Size:     int64(signature.Len()),
+	}
+	require.NoError(t, sig.SetSignExtra(sif.HashSHA384, hex.EncodeToString(signer.PrimaryKey.Fingerprint[:])))
+	require.NoError(t, fimg.AddObject(sig), "could not sign SIF")
+}
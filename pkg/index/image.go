@@ -25,16 +25,21 @@ import (
 // ImageIndex provides a convenient and thread-safe way for storing images.
 type ImageIndex struct {
 	indx *truncindex.TruncIndex
+	// libraries are used to normalize references images are looked up with
+	libraries *image.Libraries
 
 	mu      sync.RWMutex
 	refToID map[string]string
 }
 
-// NewImageIndex returns new ImageIndex ready to use.
-func NewImageIndex() *ImageIndex {
+// NewImageIndex returns new ImageIndex ready to use. Image references
+// with domains of libraries are recognized as library ones, nil
+// libraries mean Sylabs Cloud only.
+func NewImageIndex(libraries *image.Libraries) *ImageIndex {
 	return &ImageIndex{
-		indx:    truncindex.NewTruncIndex(image.IDLen),
-		refToID: make(map[string]string),
+		indx:      truncindex.NewTruncIndex(image.IDLen),
+		libraries: libraries,
+		refToID:   make(map[string]string),
 	}
 }
 
@@ -44,7 +49,7 @@ func NewImageIndex() *ImageIndex {
 func (i *ImageIndex) Find(id string) (*image.Info, error) {
 	info, err := i.find(id)
 	if err == ErrNotFound {
-		id = i.readRef(image.NormalizedImageRef(id))
+		id = i.readRef(i.libraries.NormalizedImageRef(id))
 		if id == "" {
 			return nil, ErrNotFound
 		}
@@ -82,6 +87,23 @@ func (i *ImageIndex) Remove(id string) error {
 	return nil
 }
 
+// Untag removes tags from the image with the given id. Tags pointing to
+// other images are left intact. Image stays in index even if no tags are left.
+func (i *ImageIndex) Untag(id string, tags ...string) error {
+	imgInfo, err := i.Find(id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if i.readRef(tag) != imgInfo.ID {
+			continue
+		}
+		imgInfo.Ref.RemoveTag(tag)
+		i.removeRefs(tag)
+	}
+	return nil
+}
+
 // Iterate calls handler func on each pod registered in index.
 func (i *ImageIndex) Iterate(handler func(image *image.Info)) {
 	innerIterate := func(key string, item interface{}) {
@@ -127,16 +149,18 @@ func (i *ImageIndex) merge(oldImage, image *image.Info) error {
 		oldID := i.readRef(tag)
 		i.setRef(tag, image.ID)
 		if oldID != "" && oldID != image.ID {
-			oldInfo, _ := i.Find(image.ID)
-			oldInfo.Ref.RemoveTag(tag)
+			if oldInfo, err := i.find(oldID); err == nil {
+				oldInfo.Ref.RemoveTag(tag)
+			}
 		}
 	}
 	for _, digest := range image.Ref.Digests() {
 		oldID := i.readRef(digest)
 		i.setRef(digest, image.ID)
-		if oldID != "" && oldID == image.ID {
-			oldInfo, _ := i.Find(image.ID)
-			oldInfo.Ref.RemoveDigest(digest)
+		if oldID != "" && oldID != image.ID {
+			if oldInfo, err := i.find(oldID); err == nil {
+				oldInfo.Ref.RemoveDigest(digest)
+			}
 		}
 	}
 	return nil
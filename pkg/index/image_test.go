@@ -27,7 +27,7 @@ func TestImageIndex(t *testing.T) {
 }
 
 func SmokeTestImageIndex(t *testing.T) {
-	indx := NewImageIndex()
+	indx := NewImageIndex(nil)
 
 	ref, err := image.ParseRef("library://library/default/busybox:1.29")
 	require.NoError(t, err, "could not parse busybox ref")
@@ -141,7 +141,7 @@ func SmokeTestImageIndex(t *testing.T) {
 }
 
 func AdvancedTestImageIndex(t *testing.T) {
-	indx := NewImageIndex()
+	indx := NewImageIndex(nil)
 
 	ref, err := image.ParseRef("library://library/default/busybox:1.29")
 	require.NoError(t, err, "could not parse busybox ref")
@@ -200,3 +200,97 @@ func AdvancedTestImageIndex(t *testing.T) {
 		require.Equal(t, 2, count)
 	})
 }
+
+func TestImageIndex_MoveTag(t *testing.T) {
+	indx := NewImageIndex(nil)
+
+	ref, err := image.ParseRef("library://library/default/busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	busybox := &image.Info{
+		ID:  "busybox",
+		Ref: ref,
+	}
+	ref, err = image.ParseRef("library://library/default/busybox:1.30")
+	require.NoError(t, err, "could not parse busybox ref")
+	updated := &image.Info{
+		ID:  "updated",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(busybox))
+	require.NoError(t, indx.Add(updated))
+
+	ref, err = image.ParseRef("library://library/default/busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	expectTags := append(ref.Tags(), updated.Ref.Tags()...)
+	err = indx.Add(&image.Info{
+		ID:  updated.ID,
+		Ref: ref,
+	})
+	require.NoError(t, err)
+
+	found, err := indx.Find("library://library/default/busybox:1.29")
+	require.NoError(t, err, "index returned unexpected error")
+	require.Equal(t, updated.ID, found.ID, "tag points to wrong image")
+	require.ElementsMatch(t, expectTags, found.Ref.Tags())
+
+	found, err = indx.Find(busybox.ID)
+	require.NoError(t, err, "index returned unexpected error")
+	require.Empty(t, found.Ref.Tags(), "tag is not removed from previous image")
+}
+
+func TestImageIndex_Untag(t *testing.T) {
+	indx := NewImageIndex(nil)
+
+	ref, err := image.ParseRef("library://library/default/busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	ref.AddTags([]string{"busybox:1.29"})
+	busybox := &image.Info{
+		ID:  "busybox",
+		Ref: ref,
+	}
+	ref, err = image.ParseRef("library://library/default/alpine:3.9")
+	require.NoError(t, err, "could not parse alpine ref")
+	alpine := &image.Info{
+		ID:  "alpine",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(busybox))
+	require.NoError(t, indx.Add(alpine))
+
+	err = indx.Untag(busybox.ID, "busybox:1.29", "cloud.sylabs.io/library/default/alpine:3.9")
+	require.NoError(t, err)
+
+	_, err = indx.Find("busybox:1.29")
+	require.Equal(t, ErrNotFound, err, "tag should be removed")
+	found, err := indx.Find("library://library/default/busybox:1.29")
+	require.NoError(t, err, "index returned unexpected error")
+	require.Equal(t, []string{"cloud.sylabs.io/library/default/busybox:1.29"}, found.Ref.Tags())
+
+	found, err = indx.Find("library://library/default/alpine:3.9")
+	require.NoError(t, err, "tag of another image should be left intact")
+	require.Equal(t, alpine.ID, found.ID)
+
+	require.Equal(t, ErrNotFound, indx.Untag("unknown", "busybox:1.29"))
+}
+
+func TestImageIndex_Pinned(t *testing.T) {
+	const pinned = "nginx:1.17@sha256:31b8e90a349d1fce7621f5a5a08e4fc519b634f7d3feb09d53fac9b12aa4d991"
+
+	indx := NewImageIndex(nil)
+
+	ref, err := image.ParseRef(pinned)
+	require.NoError(t, err, "could not parse nginx ref")
+	nginx := &image.Info{
+		ID:  "nginx",
+		Ref: ref,
+	}
+	require.NoError(t, indx.Add(nginx))
+	require.Equal(t, []string{"nginx:1.17"}, nginx.Ref.Tags())
+	require.Equal(t, []string{"nginx@sha256:31b8e90a349d1fce7621f5a5a08e4fc519b634f7d3feb09d53fac9b12aa4d991"}, nginx.Ref.Digests())
+
+	for _, id := range []string{pinned, "docker.io/library/nginx:1.17", nginx.Ref.Digests()[0]} {
+		found, err := indx.Find(id)
+		require.NoError(t, err, "index returned unexpected error for %s", id)
+		require.Equal(t, nginx.ID, found.ID, "index returned wrong image for %s", id)
+	}
+}
@@ -41,6 +41,9 @@ var (
 	// ErrContainerNotCreated is used when attempting to perform operations on containers that
 	// are not in CONTAINER_CREATED state, e.g. start already started container.
 	ErrContainerNotCreated = fmt.Errorf("container is not in %s state", k8s.ContainerState_CONTAINER_CREATED.String())
+	// ErrRemoved is returned when restoring pod or container that was
+	// removed, but which base directory was not cleaned up completely.
+	ErrRemoved = fmt.Errorf("already removed")
 )
 
 // Container represents kubernetes container inside a pod. It encapsulates
@@ -72,14 +75,6 @@ type Container struct {
 // NewContainer constructs Container instance. Container is thread safe to use.
 func NewContainer(config *k8s.ContainerConfig, pod *Pod, info *image.Info, trashDir string) *Container {
 	contID := rand.GenerateID(ContainerIDLen)
-	var execEnvs []string
-	if info.OciConfig != nil {
-		execEnvs = info.OciConfig.Env
-	}
-	// environments from config will override oci image values
-	for _, kv := range config.GetEnvs() {
-		execEnvs = append(execEnvs, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
-	}
 	return &Container{
 		id:              contID,
 		ContainerConfig: config,
@@ -87,7 +82,7 @@ func NewContainer(config *k8s.ContainerConfig, pod *Pod, info *image.Info, trash
 		imgInfo:         info,
 		cli:             runtime.NewCLIClient(),
 		trashDir:        trashDir,
-		execEnvs:        execEnvs,
+		execEnvs:        execEnvs(config, info),
 	}
 }
 
@@ -265,6 +260,10 @@ func (c *Container) Create(baseDir string) error {
 	if err != nil {
 		return fmt.Errorf("could not update container state: %v", err)
 	}
+	err = c.saveInfo()
+	if err != nil {
+		return fmt.Errorf("could not save container info: %v", err)
+	}
 	c.pod.addContainer(c)
 	return nil
 }
@@ -309,6 +308,9 @@ func (c *Container) Stop(timeout int64) error {
 		return fmt.Errorf("could not update container state: %v", err)
 	}
 	c.isStopped = true
+	if err := c.saveInfo(); err != nil {
+		glog.Errorf("Could not save container info: %v", err)
+	}
 	return nil
 }
 
@@ -331,6 +333,11 @@ func (c *Container) Remove() error {
 			return fmt.Errorf("could not delete container: %v", err)
 		}
 	}
+	// container is never restored again even if its files are not cleaned up
+	c.isRemoved = true
+	if err := c.saveInfo(); err != nil {
+		glog.Errorf("Could not save container info: %v", err)
+	}
 	if err := c.CloseStdin(); err != nil {
 		glog.Errorf("Could not close container stdin: %v", err)
 	}
@@ -342,7 +349,6 @@ func (c *Container) Remove() error {
 	}
 	c.imgInfo.Return(c.id)
 	c.pod.removeContainer(c)
-	c.isRemoved = true
 	return nil
 }
 
@@ -355,7 +361,7 @@ func (c *Container) ExecSync(timeout time.Duration, cmd []string) (*k8s.ExecSync
 		defer cancel()
 	}
 
-	if c.imgInfo.Ref.URI() != singularity.DockerDomain || c.imgInfo.OciConfig == nil {
+	if !c.imgInfo.Ref.IsOCI() || c.imgInfo.OciConfig == nil {
 		cmd = append([]string{singularity.ExecScript}, cmd...)
 	}
 	resp, err := c.cli.ExecSync(ctx, c.id, cmd, c.execEnvs)
@@ -374,7 +380,7 @@ func (c *Container) ExecSync(timeout time.Duration, cmd []string) (*k8s.ExecSync
 func (c *Container) Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	ctx := context.Background()
 
-	if c.imgInfo.Ref.URI() != singularity.DockerDomain || c.imgInfo.OciConfig == nil {
+	if !c.imgInfo.Ref.IsOCI() || c.imgInfo.OciConfig == nil {
 		cmd = append([]string{singularity.ExecScript}, cmd...)
 	}
 	err := c.cli.Exec(ctx, c.id, stdin, stdout, stderr, cmd, c.execEnvs)
@@ -389,7 +395,7 @@ func (c *Container) Exec(cmd []string, stdin io.Reader, stdout, stderr io.Writer
 // later to run a command inside an allocated tty.
 func (c *Container) PrepareExec(cmd []string) *exec.Cmd {
 	ctx := context.Background()
-	if c.imgInfo.Ref.URI() != singularity.DockerDomain || c.imgInfo.OciConfig == nil {
+	if !c.imgInfo.Ref.IsOCI() || c.imgInfo.OciConfig == nil {
 		cmd = append([]string{singularity.ExecScript}, cmd...)
 	}
 	return c.cli.PrepareExec(ctx, c.id, cmd, c.execEnvs)
@@ -454,3 +460,17 @@ func (c *Container) MatchesFilter(filter *k8s.ContainerFilter) bool {
 	}
 	return true
 }
+
+// execEnvs returns environment variables that should be set for any
+// process executed in container created from the passed config and image.
+func execEnvs(config *k8s.ContainerConfig, info *image.Info) []string {
+	var envs []string
+	if info.OciConfig != nil {
+		envs = info.OciConfig.Env
+	}
+	// environments from config will override oci image values
+	for _, kv := range config.GetEnvs() {
+		envs = append(envs, fmt.Sprintf("%s=%s", kv.Key, kv.Value))
+	}
+	return envs
+}
@@ -27,6 +27,7 @@ import (
 
 const (
 	contSocketPath    = "sync.sock"
+	contInfoPath      = "container.json"
 	contBundlePath    = "bundle/"
 	contRootfsPath    = "rootfs/"
 	contOCIConfigPath = "config.json"
@@ -47,6 +48,12 @@ func (c *Container) socketPath() string {
 	return filepath.Join(c.baseDir, contSocketPath)
 }
 
+// infoFilePath returns path to container's info file that is
+// used to restore container after CRI restart.
+func (c *Container) infoFilePath() string {
+	return filepath.Join(c.baseDir, contInfoPath)
+}
+
 // bundlePath returns path to container's filesystem bundle directory.
 func (c *Container) bundlePath() string {
 	return filepath.Join(c.baseDir, contBundlePath)
@@ -129,6 +136,29 @@ func (c *Container) cleanupFiles(silent bool) error {
 	return nil
 }
 
+// CleanupContainerDir deletes SIF bundle mounted in container's base directory
+// and removes it. It should be used to cleanup containers that are not known to CRI
+// anymore, e.g. left after crash, otherwise Remove should be called. Directory is left
+// untouched if bundle cannot be deleted to not remove anything through the mounted rootfs.
+func CleanupContainerDir(baseDir string) error {
+	bundle := filepath.Join(baseDir, contBundlePath)
+	if _, err := os.Stat(bundle); err == nil {
+		glog.V(5).Infof("Removing bundle at %s", bundle)
+		d, err := ocibundle.FromSif("", bundle, true)
+		if err != nil {
+			return fmt.Errorf("could not create SIF bundle driver: %v", err)
+		}
+		if err := d.Delete(); err != nil {
+			return fmt.Errorf("could not delete SIF bundle: %v", err)
+		}
+	}
+	glog.V(5).Infof("Removing container base directory %s", baseDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return fmt.Errorf("could not remove container directory: %v", err)
+	}
+	return nil
+}
+
 func (c *Container) collectTrash() error {
 	if c.trashDir == "" {
 		return nil
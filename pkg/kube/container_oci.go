@@ -282,7 +282,7 @@ func (t *containerTranslator) configureProcess() error {
 	args := t.cont.GetArgs()
 	cwd := t.cont.GetWorkingDir()
 
-	if t.cont.imgInfo.Ref.URI() == singularity.DockerDomain && t.cont.imgInfo.OciConfig != nil {
+	if t.cont.imgInfo.Ref.IsOCI() && t.cont.imgInfo.OciConfig != nil {
 		// if that is a freshly built SIF from OCI image
 		// use embedded config as much as possible
 
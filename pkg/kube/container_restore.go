@@ -0,0 +1,128 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// containerInfo holds everything that is needed to restore container after CRI restart.
+type containerInfo struct {
+	ID       string               `json:"id"`
+	PodID    string               `json:"podID"`
+	ImageID  string               `json:"imageID"`
+	Config   *k8s.ContainerConfig `json:"config"`
+	LogPath  string               `json:"logPath,omitempty"`
+	TrashDir string               `json:"trashDir,omitempty"`
+	Stopped  bool                 `json:"stopped,omitempty"`
+	Removed  bool                 `json:"removed,omitempty"`
+}
+
+// RestoreContainer restores container that was previously created in baseDir,
+// e.g. before CRI restart. Pod and image the container is based on are looked
+// up by their IDs with passed findPod and findImage functions correspondingly.
+// Container's stdin, if any, cannot be restored and is considered closed.
+func RestoreContainer(baseDir string,
+	findPod func(id string) (*Pod, error),
+	findImage func(id string) (*image.Info, error)) (*Container, error) {
+	var info containerInfo
+	if err := readJSON(filepath.Join(baseDir, contInfoPath), &info); err != nil {
+		return nil, fmt.Errorf("could not read container info: %v", err)
+	}
+	if info.ID == "" || info.Config == nil {
+		return nil, fmt.Errorf("invalid container info")
+	}
+	if info.Removed {
+		return nil, ErrRemoved
+	}
+
+	pod, err := findPod(info.PodID)
+	if err != nil {
+		return nil, fmt.Errorf("could not find pod %s: %v", info.PodID, err)
+	}
+	imgInfo, err := findImage(info.ImageID)
+	if err != nil {
+		return nil, fmt.Errorf("could not find image %s: %v", info.ImageID, err)
+	}
+
+	c := &Container{
+		id:              info.ID,
+		ContainerConfig: info.Config,
+		pod:             pod,
+		imgInfo:         imgInfo,
+		baseDir:         baseDir,
+		trashDir:        info.TrashDir,
+		logPath:         info.LogPath,
+		execEnvs:        execEnvs(info.Config, imgInfo),
+		isStdinClosed:   true,
+		isStopped:       info.Stopped,
+		cli:             runtime.NewCLIClient(),
+	}
+	if err := c.UpdateState(); err != nil {
+		return nil, err
+	}
+	if c.runtimeState != runtime.StateExited {
+		if err := c.observeState(); err != nil {
+			return nil, err
+		}
+	}
+
+	imgInfo.Borrow(c.id)
+	pod.addContainer(c)
+	glog.V(3).Infof("Restored container %s in %s state", c.id, c.runtimeState)
+	return c, nil
+}
+
+// saveInfo dumps container info into container's base directory
+// so that it may be restored after CRI restart.
+func (c *Container) saveInfo() error {
+	info := containerInfo{
+		ID:       c.id,
+		PodID:    c.pod.id,
+		ImageID:  c.imgInfo.ID,
+		Config:   c.ContainerConfig,
+		LogPath:  c.logPath,
+		TrashDir: c.trashDir,
+		Stopped:  c.isStopped,
+		Removed:  c.isRemoved,
+	}
+	glog.V(5).Infof("Saving container info to %s", c.infoFilePath())
+	return writeJSON(c.infoFilePath(), info)
+}
+
+// observeState starts listening on container's sync socket again. Socket
+// file left from the previous listener is removed beforehand.
+func (c *Container) observeState() error {
+	err := os.Remove(c.socketPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove stale sync socket: %v", err)
+	}
+	syncCtx, cancel := context.WithCancel(context.Background())
+	c.syncCancel = cancel
+	c.syncChan, err = runtime.ObserveState(syncCtx, c.socketPath())
+	if err != nil {
+		cancel()
+		return fmt.Errorf("could not listen for state changes: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestContainer_SaveInfo(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "container-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(baseDir)
+
+	config := &k8s.ContainerConfig{
+		Metadata: &k8s.ContainerMetadata{
+			Name: "test-container",
+		},
+		Image: &k8s.ImageSpec{
+			Image: "busybox",
+		},
+	}
+	notFound := fmt.Errorf("not found")
+	findPod := func(id string) (*Pod, error) {
+		return nil, notFound
+	}
+	findImage := func(id string) (*image.Info, error) {
+		return nil, notFound
+	}
+
+	tt := []struct {
+		name       string
+		isStopped  bool
+		isRemoved  bool
+		expectInfo containerInfo
+		expectErr  error
+	}{
+		{
+			name: "running container",
+			expectInfo: containerInfo{
+				ID:       "container-id",
+				PodID:    "pod-id",
+				ImageID:  "image-id",
+				Config:   config,
+				LogPath:  "/var/log/pods/container.log",
+				TrashDir: "/var/run/trash",
+			},
+			expectErr: fmt.Errorf("could not find pod pod-id: %v", notFound),
+		},
+		{
+			name:      "stopped container",
+			isStopped: true,
+			expectInfo: containerInfo{
+				ID:       "container-id",
+				PodID:    "pod-id",
+				ImageID:  "image-id",
+				Config:   config,
+				LogPath:  "/var/log/pods/container.log",
+				TrashDir: "/var/run/trash",
+				Stopped:  true,
+			},
+			expectErr: fmt.Errorf("could not find pod pod-id: %v", notFound),
+		},
+		{
+			name:      "removed container",
+			isStopped: true,
+			isRemoved: true,
+			expectInfo: containerInfo{
+				ID:       "container-id",
+				PodID:    "pod-id",
+				ImageID:  "image-id",
+				Config:   config,
+				LogPath:  "/var/log/pods/container.log",
+				TrashDir: "/var/run/trash",
+				Stopped:  true,
+				Removed:  true,
+			},
+			expectErr: ErrRemoved,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Container{
+				id:              "container-id",
+				ContainerConfig: config,
+				pod:             &Pod{id: "pod-id"},
+				imgInfo:         &image.Info{ID: "image-id"},
+				baseDir:         baseDir,
+				logPath:         "/var/log/pods/container.log",
+				trashDir:        "/var/run/trash",
+				isStopped:       tc.isStopped,
+				isRemoved:       tc.isRemoved,
+			}
+			require.NoError(t, c.saveInfo())
+
+			var info containerInfo
+			require.NoError(t, readJSON(c.infoFilePath(), &info))
+			require.Equal(t, tc.expectInfo, info)
+
+			_, err := RestoreContainer(baseDir, findPod, findImage)
+			require.Equal(t, tc.expectErr, err)
+		})
+	}
+}
@@ -85,7 +85,9 @@ func (c *Container) terminate(timeout int64) error {
 	// We should call it when sync socket will no longer be used, and
 	// since multiple calls are fine with cancel func, call it at
 	// the end of terminate.
-	defer c.syncCancel()
+	if c.syncCancel != nil {
+		defer c.syncCancel()
+	}
 
 	if c.runtimeState == runtime.StateExited {
 		return nil
@@ -15,12 +15,14 @@
 package kube
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 )
 
@@ -68,3 +70,28 @@ func copyFile(from, to string) error {
 	}
 	return nil
 }
+
+// writeJSON encodes v into a file at path. The file is replaced atomically,
+// so readers never observe partially written content.
+func writeJSON(path string, v interface{}) error {
+	return fs.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			return fmt.Errorf("could not encode json: %v", err)
+		}
+		return nil
+	})
+}
+
+// readJSON decodes content of a file at path into v.
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("could not decode json: %v", err)
+	}
+	return nil
+}
@@ -69,3 +69,31 @@ func TestWriteResolvConf(t *testing.T) {
 	}
 
 }
+
+func TestWriteReadJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "pod.json")
+	expect := podInfo{
+		ID: "7b0178cb4bac7227f83a56d62d3fdf9900645b6d53578aaad25a7df61ae15b39",
+		Config: &k8s.PodSandboxConfig{
+			Metadata: &k8s.PodSandboxMetadata{
+				Name:      "test",
+				Namespace: "default",
+			},
+			Hostname: "test-host",
+		},
+		IP: "10.244.0.12",
+	}
+	require.NoError(t, writeJSON(path, expect), "could not write json")
+
+	fii, err := ioutil.ReadDir(dir)
+	require.NoError(t, err, "could not read temp directory")
+	require.Len(t, fii, 1, "temporary files are left")
+
+	var actual podInfo
+	require.NoError(t, readJSON(path, &actual), "could not read json")
+	require.Equal(t, expect, actual)
+}
@@ -123,6 +123,9 @@ func (p *Pod) Run(baseDir string) error {
 	if err = p.UpdateState(); err != nil {
 		return fmt.Errorf("could not update pod state: %v", err)
 	}
+	if err = p.saveInfo(); err != nil {
+		return fmt.Errorf("could not save pod info: %v", err)
+	}
 	return nil
 }
 
@@ -147,7 +150,10 @@ func (p *Pod) Stop() error {
 		return fmt.Errorf("could not update container state: %v", err)
 	}
 	p.isStopped = true
-	return err
+	if err := p.saveInfo(); err != nil {
+		glog.Errorf("Could not save pod info: %v", err)
+	}
+	return nil
 }
 
 // Remove removes pod and all its containers, making sure nothing
@@ -171,10 +177,14 @@ func (p *Pod) Remove() error {
 	if err := p.cli.Delete(p.id); err != nil && err != runtime.ErrNotFound {
 		return fmt.Errorf("could not remove pod: %v", err)
 	}
+	// pod is never restored again even if its files are not cleaned up
+	p.isRemoved = true
+	if err := p.saveInfo(); err != nil {
+		glog.Errorf("Could not save pod info: %v", err)
+	}
 	if err := p.cleanupFiles(false); err != nil {
 		glog.Errorf("Pod cleanup failed: %v", err)
 	}
-	p.isRemoved = true
 	return nil
 }
 
@@ -17,12 +17,14 @@ package kube
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
 	"github.com/golang/glog"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/sylabs/singularity-cri/pkg/namespace"
+	"github.com/sylabs/singularity-cri/pkg/network"
 )
 
 const (
@@ -30,6 +32,7 @@ const (
 	podResolvConfPath = "resolv.conf"
 	podHostnamePath   = "hostname"
 	podSocketPath     = "sync.sock"
+	podInfoPath       = "pod.json"
 
 	podBundlePath    = "bundle/"
 	podRootfsPath    = "rootfs/"
@@ -78,6 +81,12 @@ func (p *Pod) socketPath() string {
 	return filepath.Join(p.baseDir, podSocketPath)
 }
 
+// infoFilePath returns path to pod's info file that is
+// used to restore pod after CRI restart.
+func (p *Pod) infoFilePath() string {
+	return filepath.Join(p.baseDir, podInfoPath)
+}
+
 // bindNamespacePath returns path to pod's namespace file of the passed type.
 func (p *Pod) bindNamespacePath(nsType specs.LinuxNamespaceType) string {
 	return filepath.Join(p.baseDir, podNsStorePath, string(nsType))
@@ -182,3 +191,35 @@ func (p *Pod) cleanupFiles(silent bool) error {
 	}
 	return nil
 }
+
+// CleanupPodDir tears down pod network with the passed manager, if any, unmounts
+// all namespaces bound in pod's base directory and removes it. It should be used to
+// cleanup pods that are not known to CRI anymore, e.g. left after crash, otherwise
+// Remove should be called. Directory is left untouched if network cannot be torn
+// down so that pod IP is released by the next attempt.
+func CleanupPodDir(baseDir string, manager *network.Manager) error {
+	if manager != nil {
+		if err := tearDownPodDirNetwork(baseDir, manager); err != nil {
+			return err
+		}
+	}
+	nsDir := filepath.Join(baseDir, podNsStorePath)
+	fii, err := ioutil.ReadDir(nsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not read namespaces directory: %v", err)
+	}
+	for _, fi := range fii {
+		ns := specs.LinuxNamespace{
+			Path: filepath.Join(nsDir, fi.Name()),
+		}
+		glog.V(5).Infof("Removing binded namespace %s", ns.Path)
+		if err := namespace.Remove(ns); err != nil {
+			return fmt.Errorf("could not remove namespace: %v", err)
+		}
+	}
+	glog.V(5).Infof("Removing pod base directory %s", baseDir)
+	if err := os.RemoveAll(baseDir); err != nil {
+		return fmt.Errorf("could not remove pod directory: %v", err)
+	}
+	return nil
+}
@@ -39,22 +39,18 @@ func (p *Pod) NetworkStatus() *k8s.PodSandboxNetworkStatus {
 // SetUpNetwork brings up network interface and configure it
 // inside pod's network namespace.
 func (p *Pod) SetUpNetwork(manager *network.Manager) error {
-	nsPath := p.namespacePath(specs.NetworkNamespace)
-	if nsPath == "" {
+	networkConfig := p.networkConfig()
+	if networkConfig == nil {
 		return nil
 	}
-	networkConfig := &network.PodConfig{
-		ID:           p.id,
-		Namespace:    p.GetMetadata().Namespace,
-		Name:         p.GetMetadata().Name,
-		NsPath:       nsPath,
-		PortMappings: p.GetPortMappings(),
-	}
 	net, err := manager.SetUpPod(networkConfig)
 	if err != nil {
 		return fmt.Errorf("could not set up pod's network: %v", err)
 	}
 	p.network = net
+	if err := p.saveInfo(); err != nil {
+		return fmt.Errorf("could not save pod info: %v", err)
+	}
 	return nil
 }
 
@@ -69,5 +65,24 @@ func (p *Pod) TearDownNetwork(manager *network.Manager) error {
 		return fmt.Errorf("could not tear down network: %v", err)
 	}
 	p.network = nil
+	if err := p.saveInfo(); err != nil {
+		return fmt.Errorf("could not save pod info: %v", err)
+	}
 	return nil
 }
+
+// networkConfig returns pod's network configuration or nil
+// if pod doesn't have a dedicated network namespace.
+func (p *Pod) networkConfig() *network.PodConfig {
+	nsPath := p.namespacePath(specs.NetworkNamespace)
+	if nsPath == "" {
+		return nil
+	}
+	return &network.PodConfig{
+		ID:           p.id,
+		Namespace:    p.GetMetadata().Namespace,
+		Name:         p.GetMetadata().Name,
+		NsPath:       nsPath,
+		PortMappings: p.GetPortMappings(),
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sylabs/singularity-cri/pkg/network"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// podInfo holds everything that is needed to restore pod after CRI restart.
+type podInfo struct {
+	ID         string                 `json:"id"`
+	Config     *k8s.PodSandboxConfig  `json:"config"`
+	Namespaces []specs.LinuxNamespace `json:"namespaces"`
+	IP         string                 `json:"ip,omitempty"`
+	Stopped    bool                   `json:"stopped,omitempty"`
+	Removed    bool                   `json:"removed,omitempty"`
+}
+
+// RestorePod restores pod that was previously run in baseDir, e.g. before
+// CRI restart. Pod network is restored with the passed manager, if any.
+func RestorePod(baseDir string, manager *network.Manager) (*Pod, error) {
+	var info podInfo
+	if err := readJSON(filepath.Join(baseDir, podInfoPath), &info); err != nil {
+		return nil, fmt.Errorf("could not read pod info: %v", err)
+	}
+	if info.ID == "" || info.Config == nil {
+		return nil, fmt.Errorf("invalid pod info")
+	}
+	if info.Removed {
+		return nil, ErrRemoved
+	}
+
+	p := &Pod{
+		id:               info.ID,
+		PodSandboxConfig: info.Config,
+		baseDir:          baseDir,
+		namespaces:       info.Namespaces,
+		isStopped:        info.Stopped,
+		cli:              runtime.NewCLIClient(),
+	}
+	if err := p.UpdateState(); err != nil {
+		return nil, err
+	}
+	if p.runtimeState != runtime.StateExited {
+		if err := p.observeState(); err != nil {
+			return nil, err
+		}
+	}
+
+	if info.IP != "" && manager != nil {
+		if err := p.restoreNetwork(manager, info.IP); err != nil {
+			return nil, err
+		}
+	}
+	glog.V(3).Infof("Restored pod %s in %s state", p.id, p.runtimeState)
+	return p, nil
+}
+
+func (p *Pod) restoreNetwork(manager *network.Manager, ip string) error {
+	networkConfig := p.networkConfig()
+	if networkConfig == nil {
+		return fmt.Errorf("pod has IP but no network namespace")
+	}
+	podNetwork, err := manager.RestorePod(networkConfig, net.ParseIP(ip))
+	if err != nil {
+		return fmt.Errorf("could not restore pod network: %v", err)
+	}
+	p.network = podNetwork
+	return nil
+}
+
+// tearDownPodDirNetwork tears down network of the pod that was run in baseDir
+// according to the saved pod info. Pods without saved IP are left as is.
+func tearDownPodDirNetwork(baseDir string, manager *network.Manager) error {
+	path := filepath.Join(baseDir, podInfoPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	var info podInfo
+	if err := readJSON(path, &info); err != nil {
+		glog.Warningf("Could not read pod info in %s, skipping network teardown: %v", baseDir, err)
+		return nil
+	}
+	if info.IP == "" || info.Config == nil {
+		return nil
+	}
+
+	p := &Pod{
+		id:               info.ID,
+		PodSandboxConfig: info.Config,
+		baseDir:          baseDir,
+		namespaces:       info.Namespaces,
+	}
+	if err := p.restoreNetwork(manager, info.IP); err != nil {
+		return err
+	}
+	glog.V(5).Infof("Tearing down network of pod %s", p.id)
+	if err := manager.TearDownPod(p.network); err != nil {
+		return fmt.Errorf("could not tear down pod network: %v", err)
+	}
+	return nil
+}
+
+// saveInfo dumps pod info into pod's base directory so
+// that it may be restored after CRI restart.
+func (p *Pod) saveInfo() error {
+	info := podInfo{
+		ID:         p.id,
+		Config:     p.PodSandboxConfig,
+		Namespaces: p.namespaces,
+		Stopped:    p.isStopped,
+		Removed:    p.isRemoved,
+	}
+	if p.network != nil {
+		ip, err := p.network.GetIP()
+		if err != nil {
+			return fmt.Errorf("could not get pod IP: %v", err)
+		}
+		info.IP = ip.String()
+	}
+	glog.V(5).Infof("Saving pod info to %s", p.infoFilePath())
+	return writeJSON(p.infoFilePath(), info)
+}
+
+// observeState starts listening on pod's sync socket again. Socket file
+// left from the previous listener is removed beforehand.
+func (p *Pod) observeState() error {
+	err := os.Remove(p.socketPath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove stale sync socket: %v", err)
+	}
+	syncCtx, cancel := context.WithCancel(context.Background())
+	p.syncCancel = cancel
+	p.syncChan, err = runtime.ObserveState(syncCtx, p.socketPath())
+	if err != nil {
+		cancel()
+		return fmt.Errorf("could not listen for state changes: %v", err)
+	}
+	return nil
+}
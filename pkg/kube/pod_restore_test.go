@@ -0,0 +1,121 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPod_SaveInfo(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "pod-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(baseDir)
+
+	config := &k8s.PodSandboxConfig{
+		Metadata: &k8s.PodSandboxMetadata{
+			Name:      "test-pod",
+			Namespace: "default",
+		},
+	}
+	namespaces := []specs.LinuxNamespace{
+		{Type: specs.NetworkNamespace, Path: filepath.Join(baseDir, podNsStorePath, "net")},
+	}
+
+	tt := []struct {
+		name       string
+		isStopped  bool
+		isRemoved  bool
+		expectInfo podInfo
+		expectErr  error
+	}{
+		{
+			name: "running pod",
+			expectInfo: podInfo{
+				ID:         "pod-id",
+				Config:     config,
+				Namespaces: namespaces,
+			},
+		},
+		{
+			name:      "stopped pod",
+			isStopped: true,
+			expectInfo: podInfo{
+				ID:         "pod-id",
+				Config:     config,
+				Namespaces: namespaces,
+				Stopped:    true,
+			},
+		},
+		{
+			name:      "removed pod",
+			isStopped: true,
+			isRemoved: true,
+			expectInfo: podInfo{
+				ID:         "pod-id",
+				Config:     config,
+				Namespaces: namespaces,
+				Stopped:    true,
+				Removed:    true,
+			},
+			expectErr: ErrRemoved,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &Pod{
+				id:               "pod-id",
+				PodSandboxConfig: config,
+				baseDir:          baseDir,
+				namespaces:       namespaces,
+				isStopped:        tc.isStopped,
+				isRemoved:        tc.isRemoved,
+			}
+			require.NoError(t, p.saveInfo())
+
+			var info podInfo
+			require.NoError(t, readJSON(p.infoFilePath(), &info))
+			require.Equal(t, tc.expectInfo, info)
+
+			if tc.expectErr != nil {
+				_, err := RestorePod(baseDir, nil)
+				require.Equal(t, tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestRestorePod_InvalidInfo(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "pod-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(baseDir)
+
+	_, err = RestorePod(baseDir, nil)
+	require.Error(t, err, "missing info should not be restored")
+
+	require.NoError(t, writeJSON(filepath.Join(baseDir, podInfoPath), podInfo{ID: "pod-id"}))
+	_, err = RestorePod(baseDir, nil)
+	require.EqualError(t, err, "invalid pod info")
+
+	require.NoError(t, tearDownPodDirNetwork(filepath.Join(baseDir, "missing"), nil),
+		"pod without info should be skipped")
+}
@@ -58,6 +58,7 @@ type PodConfig struct {
 type PodNetwork struct {
 	setup          *snetwork.Setup
 	defaultNetwork string
+	ip             net.IP
 }
 
 // Init initializes CNI network manager.
@@ -141,6 +142,35 @@ func (m *Manager) setDefaultNetwork() error {
 
 // SetUpPod bring up pod's network interface.
 func (m *Manager) SetUpPod(podConfig *PodConfig) (*PodNetwork, error) {
+	setup, err := m.newSetup(podConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := setup.AddNetworks(); err != nil {
+		return nil, err
+	}
+	return &PodNetwork{
+		setup:          setup,
+		defaultNetwork: m.defaultNetwork.Name,
+	}, nil
+}
+
+// RestorePod restores pod's network that was previously brought up with
+// SetUpPod, e.g. before CRI restart. No CNI plugins are invoked, so
+// the passed ip is reported as pod's IP address.
+func (m *Manager) RestorePod(podConfig *PodConfig, ip net.IP) (*PodNetwork, error) {
+	setup, err := m.newSetup(podConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &PodNetwork{
+		setup:          setup,
+		defaultNetwork: m.defaultNetwork.Name,
+		ip:             ip,
+	}, nil
+}
+
+func (m *Manager) newSetup(podConfig *PodConfig) (*snetwork.Setup, error) {
 	err := m.checkInit()
 	if err != nil {
 		return nil, err
@@ -207,13 +237,7 @@ func (m *Manager) SetUpPod(podConfig *PodConfig) (*PodNetwork, error) {
 	if err := setup.SetArgs([]string{args}); err != nil {
 		return nil, err
 	}
-	if err := setup.AddNetworks(); err != nil {
-		return nil, err
-	}
-	return &PodNetwork{
-		setup:          setup,
-		defaultNetwork: m.defaultNetwork.Name,
-	}, nil
+	return setup, nil
 }
 
 // TearDownPod tears down pod's network interface.
@@ -245,6 +269,10 @@ func (m *Manager) SetPodCIDR(cidr string) {
 // GetIP returns pod's IP address. It first tries to fetch IPv4
 // and in case of errors will try to fetch IPv6.
 func (n *PodNetwork) GetIP() (net.IP, error) {
+	if n.ip != nil {
+		return n.ip, nil
+	}
+
 	netIP, err := n.setup.GetNetworkIP(n.defaultNetwork, "4")
 	if err == nil {
 		return netIP, nil
@@ -0,0 +1,97 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	snetwork "github.com/sylabs/singularity/pkg/network"
+)
+
+const testNetwork = `{
+	"cniVersion": "0.3.1",
+	"name": "test-bridge",
+	"plugins": [{
+		"type": "bridge",
+		"bridge": "test0",
+		"ipam": {
+			"type": "host-local",
+			"subnet": "10.22.0.0/16"
+		}
+	}]
+}`
+
+func TestManager_RestorePod(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "cni-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(confDir)
+	err = ioutil.WriteFile(filepath.Join(confDir, "10-test.conflist"), []byte(testNetwork), 0644)
+	require.NoError(t, err, "could not write network config")
+
+	var m Manager
+	require.NoError(t, m.Init(&snetwork.CNIPath{Conf: confDir, Plugin: confDir}))
+
+	tt := []struct {
+		name      string
+		config    *PodConfig
+		ip        net.IP
+		expectErr bool
+	}{
+		{
+			name:      "nil config",
+			ip:        net.ParseIP("10.22.0.5"),
+			expectErr: true,
+		},
+		{
+			name: "no namespace path",
+			config: &PodConfig{
+				ID:        "pod-id",
+				Name:      "pod",
+				Namespace: "default",
+			},
+			ip:        net.ParseIP("10.22.0.5"),
+			expectErr: true,
+		},
+		{
+			name: "all ok",
+			config: &PodConfig{
+				ID:        "pod-id",
+				Name:      "pod",
+				Namespace: "default",
+				NsPath:    "/proc/self/ns/net",
+			},
+			ip: net.ParseIP("10.22.0.5"),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			podNetwork, err := m.RestorePod(tc.config, tc.ip)
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			ip, err := podNetwork.GetIP()
+			require.NoError(t, err)
+			require.Equal(t, tc.ip, ip)
+		})
+	}
+}
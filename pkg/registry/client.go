@@ -0,0 +1,340 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package registry implements a client for Docker registry HTTP API V2
+// that is capable of pulling OCI and Docker images into an OCI image layout.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DockerHubHost is the host Docker Hub registry API is served on.
+	DockerHubHost = "registry-1.docker.io"
+)
+
+// Client pulls images from a single registry. Client
+// is safe to use from multiple goroutines.
+type Client struct {
+	host       string
+	scheme     string
+	username   string
+	password   string
+	httpClient *http.Client
+	cacheDir   string
+
+	// identityToken is OAuth2 refresh token exchanged for bearer tokens
+	identityToken string
+
+	mu     sync.Mutex
+	basic  bool              // whether registry asked for basic auth
+	tokens map[string]string // bearer tokens by scope
+}
+
+// Option is used to tune Client behaviour.
+type Option func(c *Client)
+
+// WithCredentials sets username and password to authenticate in registry with.
+func WithCredentials(username, password string) Option {
+	return func(c *Client) {
+		c.username = username
+		c.password = password
+	}
+}
+
+// WithIdentityToken sets identity token, i.e. OAuth2 refresh token, to exchange
+// for bearer tokens. If set, it is used instead of username and password.
+func WithIdentityToken(token string) Option {
+	return func(c *Client) {
+		c.identityToken = token
+	}
+}
+
+// WithHTTPClient sets HTTP client to use for all requests.
+// By default http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithPlainHTTP makes client talk to registry over plain HTTP instead of HTTPS.
+func WithPlainHTTP(plain bool) Option {
+	return func(c *Client) {
+		if plain {
+			c.scheme = "http"
+		} else {
+			c.scheme = "https"
+		}
+	}
+}
+
+// WithBlobCache makes client keep downloaded layers in a content addressable cache
+// under dir/blobs and reuse them across pulls. Cached layers are hard linked into
+// pulled image layouts, so cache must reside on the same file system with layouts.
+func WithBlobCache(dir string) Option {
+	return func(c *Client) {
+		c.cacheDir = dir
+	}
+}
+
+// NewClient returns new client to talk to registry served on host.
+func NewClient(host string, opts ...Option) *Client {
+	c := &Client{
+		host:       host,
+		scheme:     "https",
+		httpClient: http.DefaultClient,
+		tokens:     make(map[string]string),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// get performs GET request against registry API path, e.g. /v2/foo/manifests/latest,
+// authenticating when registry asks for it. Caller must close returned response body.
+// Non 2xx responses are returned as *Error.
+func (c *Client) get(ctx context.Context, repo, path string, header http.Header) (*http.Response, error) {
+	return c.request(ctx, http.MethodGet, repo, path, header)
+}
+
+// request is the same as get, but allows to use other request methods, e.g. HEAD.
+func (c *Client) request(ctx context.Context, method, repo, path string, header http.Header) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:pull", repo)
+	resp, err := c.do(ctx, method, path, header, scope)
+	if err != nil {
+		return nil, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized && challenge != "" {
+		resp.Body.Close()
+		if err := c.authenticate(ctx, challenge, scope); err != nil {
+			return nil, err
+		}
+		resp, err = c.do(ctx, method, path, header, scope)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, parseError(resp)
+	}
+	return resp, nil
+}
+
+// do performs a single request against registry API path
+// using cached authentication for the passed scope, if any.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, scope string) (*http.Response, error) {
+	u := fmt.Sprintf("%s://%s%s", c.scheme, c.host, path)
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	c.mu.Lock()
+	token, basic := c.tokens[scope], c.basic
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if basic {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	glog.V(5).Infof("Requesting %s", u)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not perform request: %v", err)
+	}
+	return resp, nil
+}
+
+// authenticate handles authentication challenge received from registry.
+// Bearer tokens are cached for further requests within the same scope.
+func (c *Client) authenticate(ctx context.Context, challenge, scope string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" && c.password == "" && c.identityToken == "" {
+			return &Error{
+				StatusCode: http.StatusUnauthorized,
+				Code:       ErrCodeUnauthorized,
+				Message:    "registry requires credentials",
+			}
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, params["realm"], params["service"], scope)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[scope] = token
+		c.mu.Unlock()
+		return nil
+	default:
+		return fmt.Errorf("unsupported authentication scheme %q", scheme)
+	}
+}
+
+// fetchToken requests bearer token from token server according to
+// https://docs.docker.com/registry/spec/auth/token/.
+func (c *Client) fetchToken(ctx context.Context, realm, service, scope string) (string, error) {
+	if realm == "" {
+		return "", fmt.Errorf("bearer token realm is not set")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("could not parse bearer token realm: %v", err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+
+	var req *http.Request
+	if c.identityToken != "" {
+		// see https://docs.docker.com/registry/spec/auth/oauth/
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", c.identityToken)
+		q.Set("client_id", "sycri")
+		req, err = http.NewRequest(http.MethodPost, u.String(), strings.NewReader(q.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not create token request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if c.identityToken == "" && (c.username != "" || c.password != "") {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not perform token request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", parseError(resp)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("could not decode bearer token response: %v", err)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+	return "", fmt.Errorf("token server returned empty bearer token")
+}
+
+// parseChallenge parses WWW-Authenticate header value, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	challenge = strings.TrimSpace(challenge)
+	i := strings.IndexByte(challenge, ' ')
+	if i == -1 {
+		return challenge, params
+	}
+	scheme, rest := challenge[:i], challenge[i+1:]
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 {
+			return scheme, params
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				params[key] = rest[1:]
+				return scheme, params
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = strings.TrimSpace(rest[:end]), rest[end:]
+		}
+		params[key] = value
+	}
+}
+
+// copyN is like io.CopyN but reports progress after each chunk is written.
+func copyN(dst io.Writer, src io.Reader, n int64, progress func(written int64)) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for written < n {
+		chunk := buf
+		if remain := n - written; remain < int64(len(chunk)) {
+			chunk = chunk[:remain]
+		}
+		nr, err := src.Read(chunk)
+		if nr > 0 {
+			nw, werr := dst.Write(chunk[:nr])
+			written += int64(nw)
+			if progress != nil {
+				progress(written)
+			}
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF && written < n {
+			return written, io.ErrUnexpectedEOF
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
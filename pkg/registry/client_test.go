@@ -0,0 +1,401 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "password"
+	testToken    = "secret-token"
+	// testIdentityToken is a refresh token exchanged for testToken
+	testIdentityToken = "identity-token"
+)
+
+// testRegistry is a minimal registry v2 stand-in with token authentication.
+type testRegistry struct {
+	t         *testing.T
+	server    *httptest.Server
+	manifests map[string]testManifest // by repo:reference
+	blobs     map[digest.Digest][]byte
+
+	// noDigestHeader makes registry omit Docker-Content-Digest header
+	noDigestHeader bool
+	// manifestGets counts manifest downloads
+	manifestGets int
+}
+
+type testManifest struct {
+	mediaType string
+	body      []byte
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		t:         t,
+		manifests: make(map[string]testManifest),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) addBlob(content []byte, mediaType string) v1.Descriptor {
+	dgst := digest.FromBytes(content)
+	r.blobs[dgst] = content
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(content)),
+	}
+}
+
+func (r *testRegistry) addManifest(repo, tag, mediaType string, v interface{}) v1.Descriptor {
+	body, err := json.Marshal(v)
+	require.NoError(r.t, err, "could not marshal manifest")
+	dgst := digest.FromBytes(body)
+	m := testManifest{mediaType: mediaType, body: body}
+	r.manifests[repo+":"+dgst.String()] = m
+	if tag != "" {
+		r.manifests[repo+":"+tag] = m
+	}
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(body)),
+	}
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" && req.Method == http.MethodPost {
+		if req.FormValue("grant_type") != "refresh_token" || req.FormValue("refresh_token") != testIdentityToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"bad refresh token"}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":%q}`, testToken)
+		return
+	}
+	if req.URL.Path == "/token" {
+		user, password, _ := req.BasicAuth()
+		if user != testUser || password != testPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"bad credentials"}]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"token":%q}`, testToken)
+		return
+	}
+
+	if req.Header.Get("Authorization") != "Bearer "+testToken {
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:foo:pull"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if i := strings.Index(path, "/manifests/"); i != -1 {
+		m, ok := r.manifests[path[:i]+":"+path[i+len("/manifests/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		if !r.noDigestHeader {
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.body).String())
+		}
+		if req.Method == http.MethodGet {
+			r.manifestGets++
+		}
+		w.Write(m.body)
+		return
+	}
+	if i := strings.Index(path, "/blobs/"); i != -1 {
+		blob, ok := r.blobs[digest.Digest(path[i+len("/blobs/"):])]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN","message":"blob unknown"}]}`)
+			return
+		}
+		w.Write(blob)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:foo:pull,push"`)
+	require.Equal(t, "Bearer", scheme)
+	require.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:foo:pull,push",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	require.Equal(t, "Basic", scheme)
+	require.Equal(t, map[string]string{"realm": "registry"}, params)
+}
+
+func TestPullLayout(t *testing.T) {
+	r := newTestRegistry(t)
+	defer r.server.Close()
+
+	config := r.addBlob([]byte(`{"architecture":"amd64","os":"linux"}`), mediaTypeDockerConfig)
+	layer := r.addBlob([]byte("layer content"), mediaTypeDockerLayer)
+	manifest := r.addManifest("foo/bar", "", MediaTypeDockerManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []v1.Descriptor{layer},
+	})
+	manifest.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	other := v1.Descriptor{
+		MediaType: MediaTypeDockerManifest,
+		Digest:    digest.FromString("other"),
+		Platform:  &v1.Platform{OS: "linux", Architecture: "arm64"},
+	}
+	list := r.addManifest("foo/bar", "1.0", MediaTypeDockerManifestList, v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{other, manifest},
+	})
+
+	corrupted := v1.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("original content"),
+		Size:      int64(len("layer content")),
+	}
+	r.blobs[corrupted.Digest] = []byte("layer content")
+	r.addManifest("foo/corrupted", "latest", v1.MediaTypeImageManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []v1.Descriptor{corrupted},
+	})
+
+	r.addManifest("foo/missing", "latest", v1.MediaTypeImageManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers: []v1.Descriptor{{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Digest:    digest.FromString("missing content"),
+			Size:      int64(len("missing content")),
+		}},
+	})
+
+	platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	t.Run("manifest list", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "layout-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dir)
+
+		var downloaded []string
+		progress := func(p Progress) {
+			if p.Downloaded == p.Total {
+				downloaded = append(downloaded, p.Digest)
+			}
+		}
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+		pulled, dgst, err := c.PullLayout(context.Background(), "foo/bar", "1.0", dir, "image", platform, progress)
+		require.NoError(t, err)
+		require.Equal(t, list.Digest, dgst)
+		require.Len(t, pulled.Layers, 1)
+		require.Equal(t, layer.Digest, pulled.Layers[0].Digest)
+		require.ElementsMatch(t, []string{config.Digest.String(), layer.Digest.String()}, downloaded)
+
+		var index v1.Index
+		data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &index))
+		require.Len(t, index.Manifests, 1)
+		require.Equal(t, v1.MediaTypeImageManifest, index.Manifests[0].MediaType)
+		require.Equal(t, "image", index.Manifests[0].Annotations[v1.AnnotationRefName])
+
+		var m v1.Manifest
+		data, err = ioutil.ReadFile(blobPath(dir, index.Manifests[0].Digest))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &m))
+		require.Equal(t, v1.MediaTypeImageConfig, m.Config.MediaType)
+		require.Len(t, m.Layers, 1)
+		require.Equal(t, v1.MediaTypeImageLayerGzip, m.Layers[0].MediaType)
+
+		data, err = ioutil.ReadFile(blobPath(dir, layer.Digest))
+		require.NoError(t, err)
+		require.Equal(t, "layer content", string(data))
+		require.FileExists(t, filepath.Join(dir, v1.ImageLayoutFile))
+	})
+
+	t.Run("blob cache", func(t *testing.T) {
+		cacheDir, err := ioutil.TempDir("", "cache-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(cacheDir)
+
+		var downloaded []string
+		progress := func(p Progress) {
+			if p.Downloaded == p.Total {
+				downloaded = append(downloaded, p.Digest)
+			}
+		}
+		c := NewClient(r.host(),
+			WithPlainHTTP(true),
+			WithCredentials(testUser, testPassword),
+			WithBlobCache(cacheDir),
+		)
+		for i := 0; i < 2; i++ {
+			dir, err := ioutil.TempDir(cacheDir, ".layout-")
+			require.NoError(t, err, "could not create temp directory")
+
+			_, _, err = c.PullLayout(context.Background(), "foo/bar", "1.0", dir, "image", platform, progress)
+			require.NoError(t, err)
+			data, err := ioutil.ReadFile(blobPath(dir, layer.Digest))
+			require.NoError(t, err)
+			require.Equal(t, "layer content", string(data))
+			require.NoError(t, os.RemoveAll(dir))
+		}
+		// layer is downloaded only once while config is downloaded for each pull
+		require.ElementsMatch(t, []string{
+			config.Digest.String(),
+			layer.Digest.String(),
+			config.Digest.String(),
+		}, downloaded)
+		require.FileExists(t, blobPath(cacheDir, layer.Digest))
+	})
+
+	t.Run("no platform", func(t *testing.T) {
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+		_, _, err := c.Manifest(context.Background(), "foo/bar", "1.0", v1.Platform{OS: "linux", Architecture: "s390x"})
+		require.EqualError(t, err, "no manifest found for platform linux/s390x")
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+		_, _, err := c.Manifest(context.Background(), "foo/bar", "2.0", platform)
+		require.True(t, IsNotFound(err), "unexpected error: %v", err)
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, "wrong"))
+		_, _, err := c.Manifest(context.Background(), "foo/bar", "1.0", platform)
+		require.True(t, IsUnauthorized(err), "unexpected error: %v", err)
+	})
+
+	t.Run("layer not found", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "layout-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dir)
+
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+		pulled, _, err := c.PullLayout(context.Background(), "foo/missing", "latest", dir, "image", platform, nil)
+		require.True(t, IsNotFound(err), "unexpected error: %v", err)
+		require.True(t, IsPermanent(err), "unexpected error: %v", err)
+		require.Contains(t, err.Error(), "could not pull layer")
+		require.NotNil(t, pulled, "manifest is not returned with layer error")
+		require.Len(t, pulled.Layers, 1)
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "layout-")
+		require.NoError(t, err, "could not create temp directory")
+		defer os.RemoveAll(dir)
+
+		c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+		_, _, err = c.PullLayout(context.Background(), "foo/corrupted", "latest", dir, "image", platform, nil)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "digest mismatch")
+
+		fii, err := ioutil.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+		require.NoError(t, err)
+		for _, fi := range fii {
+			require.NotEqual(t, corrupted.Digest.Hex(), fi.Name(), "corrupted blob is saved")
+			require.False(t, strings.HasPrefix(fi.Name(), ".blob-"), "temporary blob file is left")
+		}
+	})
+}
+
+func TestManifestDigest(t *testing.T) {
+	r := newTestRegistry(t)
+	defer r.server.Close()
+
+	config := r.addBlob([]byte(`{"architecture":"amd64","os":"linux"}`), mediaTypeDockerConfig)
+	manifest := r.addManifest("foo/bar", "1.0", MediaTypeDockerManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+	})
+	c := NewClient(r.host(), WithPlainHTTP(true), WithCredentials(testUser, testPassword))
+
+	t.Run("head", func(t *testing.T) {
+		r.manifestGets = 0
+		dgst, err := c.ManifestDigest(context.Background(), "foo/bar", "1.0")
+		require.NoError(t, err)
+		require.Equal(t, manifest.Digest, dgst)
+		require.Zero(t, r.manifestGets, "manifest should not be downloaded")
+	})
+
+	t.Run("no digest header", func(t *testing.T) {
+		r.noDigestHeader = true
+		defer func() { r.noDigestHeader = false }()
+		r.manifestGets = 0
+		dgst, err := c.ManifestDigest(context.Background(), "foo/bar", "1.0")
+		require.NoError(t, err)
+		require.Equal(t, manifest.Digest, dgst)
+		require.Equal(t, 1, r.manifestGets)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := c.ManifestDigest(context.Background(), "foo/bar", "2.0")
+		require.True(t, IsNotFound(err), "unexpected error: %v", err)
+	})
+}
+
+func TestIdentityToken(t *testing.T) {
+	r := newTestRegistry(t)
+	defer r.server.Close()
+
+	config := r.addBlob([]byte(`{"architecture":"amd64","os":"linux"}`), mediaTypeDockerConfig)
+	manifest := r.addManifest("foo/bar", "1.0", MediaTypeDockerManifest, v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+	})
+
+	c := NewClient(r.host(), WithPlainHTTP(true), WithIdentityToken(testIdentityToken))
+	dgst, err := c.ManifestDigest(context.Background(), "foo/bar", "1.0")
+	require.NoError(t, err)
+	require.Equal(t, manifest.Digest, dgst)
+
+	c = NewClient(r.host(), WithPlainHTTP(true), WithIdentityToken("expired"))
+	_, err = c.ManifestDigest(context.Background(), "foo/bar", "1.0")
+	require.Error(t, err)
+}
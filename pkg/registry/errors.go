@@ -0,0 +1,162 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Error codes defined by registry API, see
+// https://docs.docker.com/registry/spec/api/#errors-2.
+const (
+	ErrCodeBlobUnknown     = "BLOB_UNKNOWN"
+	ErrCodeManifestUnknown = "MANIFEST_UNKNOWN"
+	ErrCodeNameUnknown     = "NAME_UNKNOWN"
+	ErrCodeUnauthorized    = "UNAUTHORIZED"
+	ErrCodeDenied          = "DENIED"
+)
+
+// Error is returned when registry responds with an error.
+type Error struct {
+	// StatusCode is HTTP status code of the response.
+	StatusCode int
+	// Code is an error code reported by registry, if any.
+	Code string
+	// Message is a human readable error description.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("registry responded with %d %s: %s",
+			e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	// format error the same way docker does, e.g. unauthorized: authentication required
+	return fmt.Sprintf("%s: %s", strings.ToLower(strings.Replace(e.Code, "_", " ", -1)), e.Message)
+}
+
+// DigestError is returned when downloaded content doesn't match expected digest.
+type DigestError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("digest mismatch: expected %s, got %s", e.Expected, e.Actual)
+}
+
+// wrappedError annotates error with the context it occurred in and keeps
+// the original error available to IsNotFound, IsUnauthorized and IsPermanent.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+// Cause returns the original error.
+func (e *wrappedError) Cause() error {
+	return e.err
+}
+
+// wrapError prefixes err with msg the same way fmt.Errorf("msg: %v", err)
+// does, but without losing *Error type.
+func wrapError(err error, msg string) error {
+	return &wrappedError{msg: msg, err: err}
+}
+
+// asError finds *Error err was wrapped around, if any.
+func asError(err error) (*Error, bool) {
+	for {
+		switch e := err.(type) {
+		case *Error:
+			return e, true
+		case *wrappedError:
+			err = e.err
+		default:
+			return nil, false
+		}
+	}
+}
+
+// IsNotFound returns true if err reports that requested repository,
+// manifest or blob doesn't exist.
+func IsNotFound(err error) bool {
+	e, ok := asError(err)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case ErrCodeBlobUnknown, ErrCodeManifestUnknown, ErrCodeNameUnknown:
+		return true
+	}
+	return e.StatusCode == http.StatusNotFound
+}
+
+// IsUnauthorized returns true if err reports that
+// access to the requested resource is denied.
+func IsUnauthorized(err error) bool {
+	e, ok := asError(err)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case ErrCodeUnauthorized, ErrCodeDenied:
+		return true
+	}
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsPermanent returns true if err reports that registry rejected request
+// and repeating it won't help, e.g. due to bad credentials or missing image.
+// Server side errors and rate limiting are considered temporary.
+func IsPermanent(err error) bool {
+	e, ok := asError(err)
+	if !ok {
+		return false
+	}
+	if e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError {
+		return false
+	}
+	return e.StatusCode >= http.StatusBadRequest
+}
+
+// parseError converts non successful registry response into *Error.
+func parseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+
+	var errResp struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &errResp); err == nil && len(errResp.Errors) > 0 {
+		e.Code = errResp.Errors[0].Code
+		e.Message = errResp.Errors[0].Message
+	}
+	return e
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Progress describes the state of a blob download.
+type Progress struct {
+	// Digest is the digest of the blob being downloaded.
+	Digest string
+	// Downloaded is the number of bytes downloaded so far.
+	Downloaded int64
+	// Total is the blob size.
+	Total int64
+}
+
+// ProgressFunc is called each time a chunk of blob is downloaded.
+type ProgressFunc func(p Progress)
+
+// Blob downloads blob described by desc from repo and writes it to w.
+// Downloaded content is verified against descriptor size and digest.
+func (c *Client) Blob(ctx context.Context, repo string, desc v1.Descriptor, w io.Writer, progress ProgressFunc) error {
+	if err := desc.Digest.Validate(); err != nil {
+		return fmt.Errorf("invalid blob digest %q: %v", desc.Digest, err)
+	}
+	resp, err := c.get(ctx, repo, fmt.Sprintf("/v2/%s/blobs/%s", repo, desc.Digest), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	digester := desc.Digest.Algorithm().Digester()
+	var report func(int64)
+	if progress != nil {
+		report = func(written int64) {
+			progress(Progress{
+				Digest:     desc.Digest.String(),
+				Downloaded: written,
+				Total:      desc.Size,
+			})
+		}
+	}
+	_, err = copyN(io.MultiWriter(w, digester.Hash()), resp.Body, desc.Size, report)
+	if err != nil {
+		return fmt.Errorf("could not download blob %s: %v", desc.Digest, err)
+	}
+	if actual := digester.Digest(); actual != desc.Digest {
+		return &DigestError{Expected: desc.Digest.String(), Actual: actual.String()}
+	}
+	return nil
+}
+
+// PullLayout pulls image referenced by tag or digest from repo into an OCI image
+// layout at dir under passed tag. Docker manifests are converted into OCI ones
+// on the fly. Returned are the pulled manifest and the digest of the pulled
+// image in registry. When blob cache is set layers are taken from it. If blobs
+// cannot be pulled, the manifest is returned along with the error so that caller
+// knows which layers may have been cached before the failure.
+func (c *Client) PullLayout(ctx context.Context, repo, reference, dir, tag string,
+	platform v1.Platform, progress ProgressFunc) (*v1.Manifest, digest.Digest, error) {
+	manifest, dgst, err := c.Manifest(ctx, repo, reference, platform)
+	if err != nil {
+		return nil, "", err
+	}
+
+	blobsDir := filepath.Join(dir, "blobs", string(digest.Canonical))
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return nil, "", fmt.Errorf("could not create blobs directory: %v", err)
+	}
+
+	manifest.Config.MediaType = ociMediaType(manifest.Config.MediaType)
+	if err := c.pullBlob(ctx, repo, manifest.Config, dir, progress); err != nil {
+		return manifest, "", wrapError(err, "could not pull config")
+	}
+	for i, layer := range manifest.Layers {
+		manifest.Layers[i].MediaType = ociMediaType(layer.MediaType)
+		if err := c.pullLayer(ctx, repo, layer, dir, progress); err != nil {
+			return manifest, "", wrapError(err, "could not pull layer")
+		}
+	}
+
+	manifest.Versioned = specs.Versioned{SchemaVersion: 2}
+	manifestDesc, err := writeJSONBlob(dir, manifest)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not write manifest: %v", err)
+	}
+	manifestDesc.MediaType = v1.MediaTypeImageManifest
+	manifestDesc.Annotations = map[string]string{
+		v1.AnnotationRefName: tag,
+	}
+
+	index := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []v1.Descriptor{manifestDesc},
+	}
+	if err := writeJSON(filepath.Join(dir, "index.json"), index); err != nil {
+		return nil, "", fmt.Errorf("could not write index: %v", err)
+	}
+	layout := v1.ImageLayout{
+		Version: v1.ImageLayoutVersion,
+	}
+	if err := writeJSON(filepath.Join(dir, v1.ImageLayoutFile), layout); err != nil {
+		return nil, "", fmt.Errorf("could not write layout file: %v", err)
+	}
+	return manifest, dgst, nil
+}
+
+// pullLayer puts layer into layout at dir. When blob cache is set layer is
+// downloaded into cache, if not already there, and then linked into layout.
+func (c *Client) pullLayer(ctx context.Context, repo string, desc v1.Descriptor, dir string, progress ProgressFunc) error {
+	if c.cacheDir == "" {
+		return c.pullBlob(ctx, repo, desc, dir, progress)
+	}
+	if err := checkDigest(desc.Digest); err != nil {
+		return err
+	}
+
+	cachePath := blobPath(c.cacheDir, desc.Digest)
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := c.pullBlob(ctx, repo, desc, c.cacheDir, progress); err != nil {
+			return err
+		}
+		err := os.Link(cachePath, blobPath(dir, desc.Digest))
+		if err == nil {
+			glog.V(5).Infof("Linked cached layer %s", desc.Digest)
+			return nil
+		}
+		// layer may be removed from cache concurrently, try to download it again
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("could not link cached layer: %v", err)
+		}
+	}
+	return fmt.Errorf("could not link cached layer %s: it keeps disappearing", desc.Digest)
+}
+
+// pullBlob downloads blob into blobs directory at dir unless it is already there.
+func (c *Client) pullBlob(ctx context.Context, repo string, desc v1.Descriptor, dir string, progress ProgressFunc) error {
+	if err := checkDigest(desc.Digest); err != nil {
+		return err
+	}
+	path := blobPath(dir, desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create blobs directory: %v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		glog.V(5).Infof("Blob %s is already present", desc.Digest)
+		return nil
+	}
+
+	glog.V(4).Infof("Downloading blob %s (%d bytes)", desc.Digest, desc.Size)
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".blob-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = c.Blob(ctx, repo, desc, tmp, progress)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("could not close blob file: %v", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("could not save blob: %v", err)
+	}
+	return nil
+}
+
+// ociMediaType converts Docker media type into the corresponding OCI one.
+func ociMediaType(mediaType string) string {
+	switch mediaType {
+	case mediaTypeDockerConfig:
+		return v1.MediaTypeImageConfig
+	case mediaTypeDockerLayer:
+		return v1.MediaTypeImageLayerGzip
+	case mediaTypeDockerForeignLayer:
+		return v1.MediaTypeImageLayerNonDistributableGzip
+	}
+	return mediaType
+}
+
+// checkDigest makes sure dgst is a valid digest that can be stored in a layout.
+func checkDigest(dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return fmt.Errorf("invalid digest %q: %v", dgst, err)
+	}
+	if dgst.Algorithm() != digest.Canonical {
+		return fmt.Errorf("unsupported digest algorithm %q", dgst.Algorithm())
+	}
+	return nil
+}
+
+func blobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// writeJSONBlob stores v as a blob in layout at dir and returns its descriptor.
+func writeJSONBlob(dir string, v interface{}) (v1.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	dgst := digest.FromBytes(data)
+	if err := ioutil.WriteFile(blobPath(dir, dgst), data, 0644); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		Digest: dgst,
+		Size:   int64(len(data)),
+	}, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	_ "crypto/sha256" // register sha256 for digest package
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker image media types, see
+// https://docs.docker.com/registry/spec/manifest-v2-2/#media-types.
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// maxManifestSize limits size of manifests that registry may return.
+const maxManifestSize = 4 * 1024 * 1024
+
+var manifestAccept = strings.Join([]string{
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}, ", ")
+
+// DefaultPlatform returns platform sycri is running on.
+func DefaultPlatform() v1.Platform {
+	return v1.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+}
+
+// Manifest fetches image manifest referenced by tag or digest from repo. Manifest
+// lists and image indexes are resolved to the manifest for the passed platform.
+// Returned digest is the digest of the content referenced by tag, i.e. the
+// manifest list digest for multi platform images.
+func (c *Client) Manifest(ctx context.Context, repo, reference string, platform v1.Platform) (*v1.Manifest, digest.Digest, error) {
+	body, mediaType, dgst, err := c.fetchManifest(ctx, repo, reference)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mediaType == v1.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList {
+		var index v1.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, "", fmt.Errorf("could not decode manifest list: %v", err)
+		}
+		desc, err := selectPlatform(index.Manifests, platform)
+		if err != nil {
+			return nil, "", err
+		}
+		glog.V(4).Infof("Selected manifest %s for platform %s/%s", desc.Digest, platform.OS, platform.Architecture)
+		body, mediaType, _, err = c.fetchManifest(ctx, repo, desc.Digest.String())
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if mediaType != v1.MediaTypeImageManifest && mediaType != MediaTypeDockerManifest {
+		return nil, "", fmt.Errorf("unsupported manifest media type %q", mediaType)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("could not decode manifest: %v", err)
+	}
+	return &manifest, dgst, nil
+}
+
+// ManifestDigest resolves digest of the manifest referenced by tag or digest in repo
+// without downloading it, i.e. with HEAD request. Like with Manifest, the digest of
+// manifest list is returned for multi platform images. Registries that do not report
+// Docker-Content-Digest header or do not support HEAD requests are handled by
+// fetching the manifest.
+func (c *Client) ManifestDigest(ctx context.Context, repo, reference string) (digest.Digest, error) {
+	header := http.Header{}
+	header.Set("Accept", manifestAccept)
+	resp, err := c.request(ctx, http.MethodHead, repo, fmt.Sprintf("/v2/%s/manifests/%s", repo, reference), header)
+	if err != nil && !isMethodNotAllowed(err) {
+		return "", err
+	}
+	if err == nil {
+		resp.Body.Close()
+		dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err == nil {
+			return dgst, nil
+		}
+	}
+	glog.V(4).Infof("Registry %s did not report digest of %s:%s, fetching manifest", c.host, repo, reference)
+	_, _, dgst, err := c.fetchManifest(ctx, repo, reference)
+	return dgst, err
+}
+
+func isMethodNotAllowed(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusMethodNotAllowed
+}
+
+// fetchManifest fetches raw manifest content along with its media type and digest.
+// When reference is a digest content is verified against it.
+func (c *Client) fetchManifest(ctx context.Context, repo, reference string) ([]byte, string, digest.Digest, error) {
+	header := http.Header{}
+	header.Set("Accept", manifestAccept)
+	resp, err := c.get(ctx, repo, fmt.Sprintf("/v2/%s/manifests/%s", repo, reference), header)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("could not read manifest: %v", err)
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+
+	dgst := digest.FromBytes(body)
+	if expected, err := digest.Parse(reference); err == nil && expected != dgst {
+		return nil, "", "", &DigestError{Expected: expected.String(), Actual: dgst.String()}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "" || mediaType == "application/json" || mediaType == "text/plain" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(body, &versioned); err == nil {
+			mediaType = versioned.MediaType
+		}
+	}
+	return body, mediaType, dgst, nil
+}
+
+// selectPlatform returns descriptor of the manifest built for the passed platform.
+func selectPlatform(manifests []v1.Descriptor, platform v1.Platform) (v1.Descriptor, error) {
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS != platform.OS || desc.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && desc.Platform.Variant != platform.Variant {
+			continue
+		}
+		return desc, nil
+	}
+	return v1.Descriptor{}, fmt.Errorf("no manifest found for platform %s/%s", platform.OS, platform.Architecture)
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+// FsckReport holds inconsistencies found in image storage directory.
+type FsckReport struct {
+	// Corrupted is true when registry info file was corrupted and
+	// registry needs to be rebuilt, or was rebuilt, from image files.
+	Corrupted bool
+	// TempFiles are paths to temporary files and directories
+	// left by interrupted image pulls or registry updates.
+	TempFiles []string
+	// Unreferenced are paths to image files and cached
+	// layers that are not referenced by any registry entry.
+	Unreferenced []string
+	// Missing are IDs of registry entries which image file is missing.
+	Missing []string
+	// CorruptedImages are IDs of registry entries which image
+	// file checksum doesn't match the one recorded.
+	CorruptedImages []string
+	// Expired are paths to partially downloaded and quarantined
+	// images that are kept longer than allowed.
+	Expired []string
+}
+
+// IsClean returns true when no inconsistencies are found.
+func (r *FsckReport) IsClean() bool {
+	return !r.Corrupted && len(r.TempFiles) == 0 && len(r.Unreferenced) == 0 &&
+		len(r.Missing) == 0 && len(r.CorruptedImages) == 0 && len(r.Expired) == 0
+}
+
+// Fsck checks consistency of registry info file and image files found in storage
+// directory. When repair is true all found problems are fixed: temporary and
+// unreferenced files are removed, entries with missing or corrupted image files
+// are dropped from registry, corrupted registry info file is rebuilt and expired
+// partial downloads and quarantined images are removed.
+// Fsck must not be called while SingularityRegistry serves the same storage
+// directory since images that are being pulled may be reported as dangling.
+func Fsck(storage string, repair bool) (*FsckReport, error) {
+	storage, err := filepath.Abs(storage)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute storage directory path: %v", err)
+	}
+
+	var report FsckReport
+	infoPath := filepath.Join(storage, registryInfoFile)
+	images, err := readRegistryInfo(infoPath)
+	if _, ok := err.(errCorrupted); ok {
+		report.Corrupted = true
+		glog.Errorf("Could not load registry info: %v", err)
+		// corrupted file is left in place when only checking,
+		// the rest of storage is checked against rescanned images
+		if repair {
+			images, err = recoverRegistryInfo(storage)
+		} else {
+			images, err = rescanStorage(storage)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read registry info: %v", err)
+	}
+
+	referenced := make(map[string]bool)
+	var valid []*image.Info
+	for _, info := range images {
+		referenced[info.Path] = true
+		if _, err := os.Stat(info.Path); os.IsNotExist(err) {
+			report.Missing = append(report.Missing, info.ID)
+			continue
+		}
+		checksum, err := image.Checksum(info.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not check image %s: %v", info.ID, err)
+		}
+		if checksum != info.Sha256 {
+			report.CorruptedImages = append(report.CorruptedImages, info.ID)
+			if repair {
+				removeFile(info.Path)
+			}
+			continue
+		}
+		valid = append(valid, info)
+		for _, layer := range info.Layers {
+			referenced[filepath.Join(image.LayerCacheDir(storage), strings.TrimPrefix(layer, "sha256:"))] = true
+		}
+	}
+
+	fii, err := ioutil.ReadDir(storage)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read storage directory: %v", err)
+	}
+	for _, fi := range fii {
+		path := filepath.Join(storage, fi.Name())
+		if _, ok := image.PartialFile(fi.Name()); ok {
+			// partial downloads are kept to be resumed until they expire
+			continue
+		}
+		switch {
+		case fi.IsDir() && image.IsLayoutDir(fi.Name()):
+			report.TempFiles = append(report.TempFiles, path)
+		case !fi.Mode().IsRegular():
+			continue
+		case isTempFile(fi.Name()):
+			report.TempFiles = append(report.TempFiles, path)
+		case isImageFile(fi.Name()) && !referenced[path]:
+			report.Unreferenced = append(report.Unreferenced, path)
+		default:
+			continue
+		}
+		if repair {
+			removeFile(path)
+		}
+	}
+
+	cacheDir := image.LayerCacheDir(storage)
+	fii, err = ioutil.ReadDir(cacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read layer cache directory: %v", err)
+	}
+	for _, fi := range fii {
+		path := filepath.Join(cacheDir, fi.Name())
+		switch {
+		case strings.HasPrefix(fi.Name(), "."):
+			report.TempFiles = append(report.TempFiles, path)
+		case !referenced[path]:
+			report.Unreferenced = append(report.Unreferenced, path)
+		default:
+			continue
+		}
+		if repair {
+			removeFile(path)
+		}
+	}
+
+	report.Expired, err = expiredFiles(storage, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if repair {
+		for _, path := range report.Expired {
+			removeFile(path)
+		}
+	}
+
+	if repair && (report.Corrupted || len(valid) != len(images)) {
+		if err := writeRegistryInfo(infoPath, valid); err != nil {
+			return nil, fmt.Errorf("could not update registry info: %v", err)
+		}
+	}
+	return &report, nil
+}
+
+// isTempFile returns true if name looks like a temporary file created
+// either by image pull or by registry info file update.
+func isTempFile(name string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	name = name[1:]
+	return strings.HasPrefix(name, registryInfoFile) || isImageFile(name)
+}
+
+func removeFile(path string) {
+	glog.V(2).Infof("Removing %s", path)
+	if err := os.RemoveAll(path); err != nil {
+		glog.Errorf("Could not remove %s: %v", path, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+func TestFsck(t *testing.T) {
+	storage, err := ioutil.TempDir("", "fsck-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	writeImage := func(content string) *image.Info {
+		tmp := filepath.Join(storage, ".tmp")
+		require.NoError(t, ioutil.WriteFile(tmp, []byte(content), 0644))
+		checksum, err := image.Checksum(tmp)
+		require.NoError(t, err)
+		path := filepath.Join(storage, checksum)
+		require.NoError(t, os.Rename(tmp, path))
+		return &image.Info{
+			ID:     checksum,
+			Sha256: checksum,
+			Size:   uint64(len(content)),
+			Path:   path,
+		}
+	}
+
+	good := writeImage("good image")
+	missing := writeImage("missing image")
+	require.NoError(t, os.Remove(missing.Path))
+	corrupted := writeImage("corrupted image")
+	require.NoError(t, ioutil.WriteFile(corrupted.Path, []byte("changed"), 0644))
+	unreferenced := writeImage("unreferenced image")
+	tempFile := filepath.Join(storage, ".0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	require.NoError(t, ioutil.WriteFile(tempFile, []byte("partial"), 0644))
+
+	expiredTime := time.Now().Add(-2 * partialExpiry)
+	expiredPartial := filepath.Join(storage, ".partial-expired")
+	require.NoError(t, ioutil.WriteFile(expiredPartial, []byte("partial"), 0644))
+	require.NoError(t, os.Chtimes(expiredPartial, expiredTime, expiredTime))
+	freshPartial := filepath.Join(storage, ".partial-fresh")
+	require.NoError(t, ioutil.WriteFile(freshPartial, []byte("partial"), 0644))
+	quarantined := filepath.Join(image.QuarantineDir(storage), "quarantined")
+	require.NoError(t, os.MkdirAll(filepath.Dir(quarantined), 0755))
+	require.NoError(t, ioutil.WriteFile(quarantined, []byte("quarantined"), 0644))
+	expiredTime = time.Now().Add(-2 * quarantineExpiry)
+	require.NoError(t, os.Chtimes(quarantined, expiredTime, expiredTime))
+
+	cacheDir := image.LayerCacheDir(storage)
+	require.NoError(t, os.MkdirAll(cacheDir, 0755))
+	usedLayer := filepath.Join(cacheDir, "1111111111111111111111111111111111111111111111111111111111111111")
+	require.NoError(t, ioutil.WriteFile(usedLayer, []byte("used layer"), 0644))
+	unusedLayer := filepath.Join(cacheDir, "2222222222222222222222222222222222222222222222222222222222222222")
+	require.NoError(t, ioutil.WriteFile(unusedLayer, []byte("unused layer"), 0644))
+	good.Layers = []string{"sha256:1111111111111111111111111111111111111111111111111111111111111111"}
+
+	infoPath := filepath.Join(storage, registryInfoFile)
+	err = writeRegistryInfo(infoPath, []*image.Info{good, missing, corrupted})
+	require.NoError(t, err)
+
+	expect := &FsckReport{
+		TempFiles:       []string{tempFile},
+		Unreferenced:    []string{unreferenced.Path, unusedLayer},
+		Missing:         []string{missing.ID},
+		CorruptedImages: []string{corrupted.ID},
+		Expired:         []string{expiredPartial, quarantined},
+	}
+
+	t.Run("check", func(t *testing.T) {
+		report, err := Fsck(storage, false)
+		require.NoError(t, err)
+		require.Equal(t, expect, report)
+		require.FileExists(t, tempFile, "check must not change storage")
+		require.FileExists(t, unreferenced.Path, "check must not change storage")
+		require.FileExists(t, expiredPartial, "check must not change storage")
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		report, err := Fsck(storage, true)
+		require.NoError(t, err)
+		require.Equal(t, expect, report)
+
+		images, err := readRegistryInfo(infoPath)
+		require.NoError(t, err)
+		require.Len(t, images, 1)
+		require.Equal(t, good.ID, images[0].ID)
+		require.FileExists(t, usedLayer, "used layer is removed")
+		require.FileExists(t, freshPartial, "partial download is removed before it expires")
+		_, err = os.Stat(expiredPartial)
+		require.True(t, os.IsNotExist(err), "expired partial download is left")
+	})
+
+	t.Run("check after repair", func(t *testing.T) {
+		report, err := Fsck(storage, false)
+		require.NoError(t, err)
+		require.True(t, report.IsClean(), "unexpected problems: %+v", report)
+	})
+
+	t.Run("corrupted registry info", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(infoPath, []byte(`{"version":1,"ima`), 0644))
+
+		leftover := filepath.Join(storage, ".registry.json.tmp")
+		require.NoError(t, ioutil.WriteFile(leftover, []byte("{}"), 0644))
+
+		report, err := Fsck(storage, false)
+		require.NoError(t, err)
+		require.True(t, report.Corrupted)
+		require.Equal(t, []string{leftover}, report.TempFiles, "check should go on after corrupted registry info")
+		data, err := ioutil.ReadFile(infoPath)
+		require.NoError(t, err)
+		require.Equal(t, `{"version":1,"ima`, string(data), "check must not change storage")
+
+		report, err = Fsck(storage, true)
+		require.NoError(t, err)
+		require.True(t, report.Corrupted)
+		require.Equal(t, []string{leftover}, report.TempFiles)
+
+		images, err := readRegistryInfo(infoPath)
+		require.NoError(t, err)
+		require.Len(t, images, 1)
+		require.Equal(t, good.ID, images[0].ID)
+		require.Equal(t, good.Layers, images[0].Layers, "cached layers are not retained by rescanned image")
+		require.FileExists(t, usedLayer, "cached layer is removed after rescan")
+	})
+}
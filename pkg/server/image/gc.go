@@ -0,0 +1,130 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+const (
+	// gcInterval is the interval between removals
+	// of expired files from image storage.
+	gcInterval = time.Hour
+
+	// partialExpiry is how long partially downloaded image is kept
+	// to be resumed since it was last written to.
+	partialExpiry = 24 * time.Hour
+
+	// quarantineExpiry is how long image with unexpected digest is kept
+	// in quarantine for inspection since it was quarantined.
+	quarantineExpiry = 7 * 24 * time.Hour
+)
+
+// startGC removes expired files from image storage once
+// and then periodically until Shutdown is called.
+func (s *SingularityRegistry) startGC() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.gcCancel = cancel
+
+	s.collectGarbage()
+	s.gcDone = make(chan struct{})
+	go func() {
+		defer close(s.gcDone)
+
+		ticker := time.NewTicker(gcInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.collectGarbage()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopGC stops periodic garbage collection and waits for the current one, if any.
+func (s *SingularityRegistry) stopGC() {
+	if s.gcCancel == nil {
+		return
+	}
+	s.gcCancel()
+	<-s.gcDone
+}
+
+// collectGarbage removes expired partial downloads and quarantined images.
+func (s *SingularityRegistry) collectGarbage() {
+	expired, err := expiredFiles(s.storage, time.Now())
+	if err != nil {
+		glog.Errorf("Could not collect image storage garbage: %v", err)
+		return
+	}
+	for _, path := range expired {
+		removeFile(path)
+	}
+}
+
+// expiredFiles returns paths to partially downloaded images along with their
+// validators and to quarantined images found in storage that are kept longer
+// than allowed at the moment now. Partial download expires when none of its
+// files were written to for partialExpiry. Quarantined images get modification
+// time set when they are quarantined, so it is used to tell their expiry.
+func expiredFiles(storage string, now time.Time) ([]string, error) {
+	fii, err := ioutil.ReadDir(storage)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read storage directory: %v", err)
+	}
+	partials := make(map[string][]string)
+	lastWrite := make(map[string]time.Time)
+	for _, fi := range fii {
+		partial, ok := image.PartialFile(fi.Name())
+		if !ok || !fi.Mode().IsRegular() {
+			continue
+		}
+		partials[partial] = append(partials[partial], filepath.Join(storage, fi.Name()))
+		if fi.ModTime().After(lastWrite[partial]) {
+			lastWrite[partial] = fi.ModTime()
+		}
+	}
+	var expired []string
+	for partial, paths := range partials {
+		if now.Sub(lastWrite[partial]) > partialExpiry {
+			expired = append(expired, paths...)
+		}
+	}
+
+	quarantineDir := image.QuarantineDir(storage)
+	fii, err = ioutil.ReadDir(quarantineDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read quarantine directory: %v", err)
+	}
+	for _, fi := range fii {
+		if now.Sub(fi.ModTime()) > quarantineExpiry {
+			expired = append(expired, filepath.Join(quarantineDir, fi.Name()))
+		}
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+func TestExpiredFiles(t *testing.T) {
+	storage, err := ioutil.TempDir("", "gc-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	now := time.Now()
+	writeFile := func(path string, modTime time.Time) string {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte("content"), 0644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+		return path
+	}
+	old := now.Add(-2 * partialExpiry)
+
+	expiredPartial := writeFile(filepath.Join(storage, ".partial-expired"), old)
+	expiredValidator := writeFile(filepath.Join(storage, ".partial-expired.validator"), old)
+	orphanValidator := writeFile(filepath.Join(storage, ".partial-orphan.validator"), old)
+	// validator is written once when download starts, partial file is kept updated
+	writeFile(filepath.Join(storage, ".partial-active"), now)
+	writeFile(filepath.Join(storage, ".partial-active.validator"), old)
+	writeFile(filepath.Join(storage, ".partial-fresh"), now)
+	writeFile(filepath.Join(storage, "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"), old)
+
+	quarantineDir := image.QuarantineDir(storage)
+	expiredQuarantined := writeFile(filepath.Join(quarantineDir, "expired"), now.Add(-2*quarantineExpiry))
+	writeFile(filepath.Join(quarantineDir, "fresh"), old)
+
+	expired, err := expiredFiles(storage, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{expiredPartial, expiredValidator, orphanValidator, expiredQuarantined}, expired)
+
+	expired, err = expiredFiles(filepath.Join(storage, "missing"), now)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+}
@@ -16,9 +16,7 @@ package image
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -32,25 +30,51 @@ import (
 	"github.com/sylabs/singularity-cri/pkg/image"
 	"github.com/sylabs/singularity-cri/pkg/index"
 	"github.com/sylabs/singularity-cri/pkg/singularity"
+	"github.com/sylabs/singularity-cri/pkg/slice"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
 )
 
-const registryInfoFile = "registry.json"
+// PlatformAnnotation is a pod annotation that overrides platform images
+// of the pod are pulled for, e.g. linux/arm64/v8 or amd64.
+const PlatformAnnotation = "sycri.sylabs.io/platform"
 
 // SingularityRegistry implements k8s ImageService interface.
 type SingularityRegistry struct {
 	storage string // path to image storage without trailing slash
 	images  *index.ImageIndex
+	pulls   *pullGroup
 
-	m        sync.Mutex
-	infoFile *os.File
+	platform    image.Platform
+	pullPolicy  *image.PullPolicy
+	admission   *image.AdmissionPolicy
+	verify      *image.VerifyPolicy
+	registries  *image.Registries
+	libraries   *image.Libraries
+	credentials *image.Credentials
+
+	m sync.Mutex // protects registry info file and layer references below
+
+	// layers maps cached docker layers to IDs of indexed images using them.
+	layers map[string]map[string]bool
+	// layerPulls is a number of pulls in progress. Layers that are left
+	// unused meanwhile are collected in unusedLayers and are removed
+	// only when all pulls finish, since they may be needed by any of them.
+	layerPulls   int
+	unusedLayers []string
+
+	gcCancel context.CancelFunc
+	gcDone   chan struct{}
 }
 
+// Option is used to pass optional arguments to
+// SingularityRegistry constructor in a clear way.
+type Option func(s *SingularityRegistry)
+
 // NewSingularityRegistry initializes and returns SingularityRuntime.
 // Singularity must be installed on the host otherwise it will return an error.
-func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*SingularityRegistry, error) {
+func NewSingularityRegistry(storePath string, index *index.ImageIndex, opts ...Option) (*SingularityRegistry, error) {
 	_, err := exec.LookPath(singularity.RuntimeName)
 	if err != nil {
 		return nil, fmt.Errorf("could not find %s on this machine: %v", singularity.RuntimeName, err)
@@ -64,46 +88,139 @@ func NewSingularityRegistry(storePath string, index *index.ImageIndex) (*Singula
 	registry := SingularityRegistry{
 		storage: storePath,
 		images:  index,
+		pulls:   newPullGroup(),
+	}
+	for _, opt := range opts {
+		opt(&registry)
 	}
 
 	if err := os.MkdirAll(storePath, 0755); err != nil {
 		return nil, fmt.Errorf("could not create storage directory: %v", err)
 	}
-	registry.infoFile, err = os.OpenFile(filepath.Join(storePath, registryInfoFile), os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("could not open registry backup file: %v", err)
-	}
-	err = registry.loadInfo()
-	if err != nil {
+	if err := registry.loadInfo(); err != nil {
 		return nil, err
 	}
+	// dump right away to store migrated or rebuilt registry info
+	if err := registry.dumpInfo(); err != nil {
+		return nil, fmt.Errorf("could not dump registry info: %v", err)
+	}
+	registry.startGC()
 	return &registry, nil
 }
 
+// WithPlatform sets platform images are pulled for unless overridden
+// with PlatformAnnotation. By default it is the one sycri is running on.
+func WithPlatform(platform image.Platform) Option {
+	return func(s *SingularityRegistry) {
+		s.platform = platform
+	}
+}
+
+// WithPullPolicy sets policy that limits and retries image pulls.
+// By default each image is pulled with a single attempt and no limits.
+func WithPullPolicy(policy *image.PullPolicy) Option {
+	return func(s *SingularityRegistry) {
+		s.pullPolicy = policy
+	}
+}
+
+// WithAdmissionPolicy sets policy that decides which images may be
+// pulled. By default all images are allowed.
+func WithAdmissionPolicy(policy *image.AdmissionPolicy) Option {
+	return func(s *SingularityRegistry) {
+		s.admission = policy
+	}
+}
+
+// WithVerifyPolicy sets policy signatures of pulled images are verified
+// with. By default unsigned images are admitted with a warning.
+func WithVerifyPolicy(policy *image.VerifyPolicy) Option {
+	return func(s *SingularityRegistry) {
+		s.verify = policy
+	}
+}
+
+// WithRegistries sets per registry mirrors, TLS settings and
+// reference rewrites used when images are pulled.
+func WithRegistries(registries *image.Registries) Option {
+	return func(s *SingularityRegistry) {
+		s.registries = registries
+	}
+}
+
+// WithLibraries sets library endpoints, token and additional library
+// domains. It should match libraries image index is created with.
+func WithLibraries(libraries *image.Libraries) Option {
+	return func(s *SingularityRegistry) {
+		s.libraries = libraries
+	}
+}
+
+// WithCredentials sets node credentials used for image pulls
+// that come without authentication config.
+func WithCredentials(credentials *image.Credentials) Option {
+	return func(s *SingularityRegistry) {
+		s.credentials = credentials
+	}
+}
+
 // Shutdown should be called whenever SingularityRegistry is no longer
 // used to make sure allocated resources are freed.
 func (s *SingularityRegistry) Shutdown() error {
+	s.stopGC()
 	s.m.Lock()
 	defer s.m.Unlock()
-
-	if err := s.infoFile.Close(); err != nil {
-		return fmt.Errorf("could not close infoFile: %v", err)
-	}
 	return nil
 }
 
-// PullImage pulls an image with authentication config.
+// PullImage pulls an image with authentication config. Concurrent
+// pulls of the same image reference are coalesced into a single one.
 func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageRequest) (*k8s.PullImageResponse, error) {
-	ref, err := image.ParseRef(req.Image.Image)
+	ref, err := s.libraries.ParseRef(req.Image.Image)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "could not parse image reference: %v", err)
 	}
+	platform := s.defaultPlatform()
+	if annotation, ok := req.GetSandboxConfig().GetAnnotations()[PlatformAnnotation]; ok {
+		platform, err = image.ParsePlatform(annotation)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "could not parse %s annotation: %v", PlatformAnnotation, err)
+		}
+	}
+	namespace := req.GetSandboxConfig().GetMetadata().GetNamespace()
+	if err := s.admission.Admit(s.pullContext(ctx, platform), ref, req.GetAuth(), namespace); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	key := pullKey(ref, platform, req.GetAuth())
+	return s.pulls.do(ctx, key, func(ctx context.Context) (*k8s.PullImageResponse, error) {
+		return s.pullImage(s.pullContext(ctx, platform), ref, req.GetAuth())
+	})
+}
+
+// pullContext returns a copy of ctx holding settings
+// images are pulled for platform with.
+func (s *SingularityRegistry) pullContext(ctx context.Context, platform image.Platform) context.Context {
+	ctx = image.WithPlatform(ctx, platform)
+	ctx = image.WithRegistries(ctx, s.registries)
+	ctx = image.WithLibraries(ctx, s.libraries)
+	return image.WithCredentials(ctx, s.credentials)
+}
 
-	info, err := image.LibraryInfo(ctx, ref, req.GetAuth())
+// defaultPlatform returns platform images are pulled
+// for when pod has no PlatformAnnotation.
+func (s *SingularityRegistry) defaultPlatform() image.Platform {
+	if s.platform.Architecture == "" {
+		return image.DefaultPlatform()
+	}
+	return s.platform
+}
+
+func (s *SingularityRegistry) pullImage(ctx context.Context, ref *image.Reference, auth *k8s.AuthConfig) (*k8s.PullImageResponse, error) {
+	info, err := image.ResolveInfo(ctx, ref, auth)
 	if err == image.ErrNotFound {
 		return nil, status.Errorf(codes.NotFound, "image %s is not found", ref)
 	}
-	if err != nil && err != image.ErrNotLibrary {
+	if err != nil && err != image.ErrNotSupported {
 		return nil, status.Errorf(codes.Internal, "could not get %s image metadata: %v", ref, err)
 	}
 	if info != nil {
@@ -114,20 +231,52 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 				ImageRef: info.ID,
 			}, nil
 		}
+	} else {
+		found, err := s.findByDigest(ctx, ref, auth)
+		if err != nil {
+			return nil, err
+		}
+		if found != nil {
+			glog.V(2).Infof("Image %s is already present with the same digest, skipping pull", ref)
+			return &k8s.PullImageResponse{
+				ImageRef: found.ID,
+			}, nil
+		}
 	}
 
-	info, err = image.Pull(ctx, s.storage, ref, req.GetAuth())
+	// metadata resolved in advance, e.g. library image hash or ORAS layer digest,
+	// pins the image we are about to pull; HTTP refs are pinned by digest fragment
+	var expected string
+	if info != nil {
+		expected = info.Sha256
+	}
+	var pulled []string
+	s.beginLayerPull()
+	defer func() {
+		s.endLayerPull(pulled)
+	}()
+	info, pulled, err = image.Pull(ctx, s.pullPolicy, s.storage, ref, auth, expected)
+	if err == image.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "image %s is not found", ref)
+	}
+	if _, ok := err.(*image.DigestMismatchError); ok {
+		return nil, status.Error(codes.DataLoss, err.Error())
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not pull image: %v", err)
 	}
-	if err := info.Verify(); err != nil {
+	if err := info.Verify(ctx, s.verify, auth); err != nil {
 		info.Remove()
-		return nil, status.Errorf(codes.InvalidArgument, "could not verify image: %v", err)
+		if _, ok := err.(*image.VerificationError); ok {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "could not verify image: %v", err)
 	}
 	if err = s.images.Add(info); err != nil {
 		info.Remove()
 		return nil, status.Errorf(codes.Internal, "could not index image: %v", err)
 	}
+	s.retainLayers(info)
 	if err = s.dumpInfo(); err != nil {
 		glog.Errorf("Could not dump registry info: %v", err)
 	}
@@ -136,6 +285,58 @@ func (s *SingularityRegistry) PullImage(ctx context.Context, req *k8s.PullImageR
 	}, nil
 }
 
+// findByDigest resolves digests ref currently points to, e.g. docker manifest digest,
+// and returns already pulled image with any of them, if any. Resolved digests are
+// recorded in ref so that they are reported for the image pulled afterwards. If image
+// is found, but under another tag, ref tags are added to it. Failure to resolve digests
+// is not fatal since image may still be pulled, e.g. from a mirror. Images
+// selected for platform other than the one in ctx are skipped.
+func (s *SingularityRegistry) findByDigest(ctx context.Context, ref *image.Reference, auth *k8s.AuthConfig) (*image.Info, error) {
+	digests, err := image.ResolveDigests(ctx, ref, auth)
+	if err == image.ErrNotSupported {
+		return nil, nil
+	}
+	if err == image.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "image %s is not found", ref)
+	}
+	if err != nil {
+		glog.Warningf("Could not resolve %s image digest: %v", ref, err)
+		return nil, nil
+	}
+	ref.AddDigests(digests)
+
+	platform := image.PlatformFrom(ctx).String()
+	for _, digest := range digests {
+		info, err := s.images.Find(digest)
+		if err != nil {
+			continue
+		}
+		if info.Platform != "" && info.Platform != platform {
+			glog.V(2).Infof("Image %s is present for %s, but %s is requested", ref, info.Platform, platform)
+			continue
+		}
+		tagged := true
+		for _, tag := range ref.Tags() {
+			tagged = tagged && slice.ContainsString(info.Ref.Tags(), tag)
+		}
+		if tagged {
+			return info, nil
+		}
+		err = s.images.Add(&image.Info{
+			ID:  info.ID,
+			Ref: ref,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not index image: %v", err)
+		}
+		if err = s.dumpInfo(); err != nil {
+			glog.Errorf("Could not dump registry info: %v", err)
+		}
+		return info, nil
+	}
+	return nil, nil
+}
+
 // RemoveImage removes the image.
 // This call is idempotent, and does not return an error if the image has already been removed.
 func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveImageRequest) (*k8s.RemoveImageResponse, error) {
@@ -156,6 +357,7 @@ func (s *SingularityRegistry) RemoveImage(ctx context.Context, req *k8s.RemoveIm
 	if err := s.images.Remove(info.ID); err != nil {
 		return nil, status.Errorf(codes.Internal, "could not remove image from index: %v", err)
 	}
+	s.releaseLayers(info)
 	if err = s.dumpInfo(); err != nil {
 		glog.Errorf("Could not dump registry info: %v", err)
 	}
@@ -178,6 +380,9 @@ func (s *SingularityRegistry) ImageStatus(ctx context.Context, req *k8s.ImageSta
 		verboseInfo = map[string]string{
 			"usedBy": fmt.Sprintf("%v", info.UsedBy()),
 		}
+		if info.Platform != "" {
+			verboseInfo["platform"] = info.Platform
+		}
 	}
 
 	var uid *k8s.Int64Value
@@ -235,13 +440,24 @@ func (s *SingularityRegistry) ListImages(ctx context.Context, req *k8s.ListImage
 
 // ImageFsInfo returns information of the filesystem that is used to store images.
 // Note that local SIF images that were not pulled by CRI are not counted in this stat.
+// Kubelet takes only the first entry into account, so a single one is returned
+// and cached docker layers, which are kept inside storage directory, are counted in it.
 func (s *SingularityRegistry) ImageFsInfo(context.Context, *k8s.ImageFsInfoRequest) (*k8s.ImageFsInfoResponse, error) {
-	fsInfo, err := fs.Usage(s.storage)
+	fsUsage, err := usage(s.storage)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not get fs usage: %v", err)
 	}
+	return &k8s.ImageFsInfoResponse{
+		ImageFilesystems: []*k8s.FilesystemUsage{fsUsage},
+	}, nil
+}
 
-	fsUsage := &k8s.FilesystemUsage{
+func usage(path string) (*k8s.FilesystemUsage, error) {
+	fsInfo, err := fs.Usage(path)
+	if err != nil {
+		return nil, err
+	}
+	return &k8s.FilesystemUsage{
 		Timestamp: time.Now().UnixNano(),
 		FsId: &k8s.FilesystemIdentifier{
 			Mountpoint: fsInfo.MountPoint,
@@ -252,38 +468,106 @@ func (s *SingularityRegistry) ImageFsInfo(context.Context, *k8s.ImageFsInfoReque
 		InodesUsed: &k8s.UInt64Value{
 			Value: uint64(fsInfo.Inodes),
 		},
+	}, nil
+}
+
+// beginLayerPull protects unused cached docker layers from removal until
+// endLayerPull is called, since layers needed by the pull are not known in advance.
+func (s *SingularityRegistry) beginLayerPull() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.layerPulls++
+}
+
+// endLayerPull finishes pull started with beginLayerPull. Passed layers of the
+// pulled image are removed from cache, unless image was indexed and retained
+// them, along with other unused layers once no pulls are left in progress.
+func (s *SingularityRegistry) endLayerPull(layers []string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.layerPulls--
+	s.unusedLayers = append(s.unusedLayers, layers...)
+	if s.layerPulls > 0 {
+		return
+	}
+	var unused []string
+	for _, layer := range s.unusedLayers {
+		if len(s.layers[layer]) == 0 && !slice.ContainsString(unused, layer) {
+			unused = append(unused, layer)
+		}
+	}
+	s.unusedLayers = nil
+	image.RemoveLayers(s.storage, unused)
+}
+
+// retainLayers marks cached docker layers of the indexed image as used by it.
+func (s *SingularityRegistry) retainLayers(info *image.Info) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.useLayers(info)
+}
+
+// useLayers does the same as retainLayers, but expects caller to hold s.m.
+func (s *SingularityRegistry) useLayers(info *image.Info) {
+	if len(info.Layers) == 0 {
+		return
 	}
+	if s.layers == nil {
+		s.layers = make(map[string]map[string]bool)
+	}
+	for _, layer := range info.Layers {
+		if s.layers[layer] == nil {
+			s.layers[layer] = make(map[string]bool)
+		}
+		s.layers[layer][info.ID] = true
+	}
+}
 
-	return &k8s.ImageFsInfoResponse{
-		ImageFilesystems: []*k8s.FilesystemUsage{fsUsage},
-	}, nil
+// releaseLayers removes cached docker layers of the removed image unless they
+// are still used by other images. Removal is postponed while pulls are in progress.
+func (s *SingularityRegistry) releaseLayers(info *image.Info) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var unused []string
+	for _, layer := range info.Layers {
+		delete(s.layers[layer], info.ID)
+		if len(s.layers[layer]) == 0 {
+			delete(s.layers, layer)
+			unused = append(unused, layer)
+		}
+	}
+	if s.layerPulls > 0 {
+		s.unusedLayers = append(s.unusedLayers, unused...)
+		return
+	}
+	image.RemoveLayers(s.storage, unused)
 }
 
 // loadInfo reads backup file and restores registry according to it.
+// If backup file is corrupted it is moved aside and registry is
+// rebuilt from image files found in storage directory.
 func (s *SingularityRegistry) loadInfo() error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	_, err := s.infoFile.Seek(0, io.SeekStart)
+	path := filepath.Join(s.storage, registryInfoFile)
+	images, err := readRegistryInfo(path)
+	if _, ok := err.(errCorrupted); ok {
+		glog.Errorf("Could not load registry info: %v", err)
+		images, err = recoverRegistryInfo(s.storage)
+	}
 	if err != nil {
-		return fmt.Errorf("could not seek registry info file: %v", err)
+		return fmt.Errorf("could not read registry info: %v", err)
 	}
-	dec := json.NewDecoder(s.infoFile)
 
-	// while the array contains values
-	for dec.More() {
-		var info *image.Info
-		// decode an array value (Message)
-		err := dec.Decode(&info)
-		if err != nil {
-			return fmt.Errorf("could not decode image: %v", err)
-		}
-		err = s.images.Add(info)
-		if err != nil {
+	for _, info := range images {
+		if err := s.images.Add(info); err != nil {
 			return fmt.Errorf("could not add decoded image to index: %v", err)
 		}
+		s.useLayers(info)
 	}
-
 	return nil
 }
 
@@ -292,21 +576,12 @@ func (s *SingularityRegistry) dumpInfo() error {
 	s.m.Lock()
 	defer s.m.Unlock()
 
-	_, err := s.infoFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return fmt.Errorf("could not seek registry info file: %v", err)
-	}
-	err = s.infoFile.Truncate(0)
-	if err != nil {
-		return fmt.Errorf("could not reset file: %v", err)
-	}
-	enc := json.NewEncoder(s.infoFile)
-	encodeToFile := func(info *image.Info) {
+	var images []*image.Info
+	s.images.Iterate(func(info *image.Info) {
 		if info.Ref.URI() == singularity.LocalFileDomain {
 			return
 		}
-		_ = enc.Encode(info)
-	}
-	s.images.Iterate(encodeToFile)
-	return nil
+		images = append(images, info)
+	})
+	return writeRegistryInfo(filepath.Join(s.storage, registryInfoFile), images)
 }
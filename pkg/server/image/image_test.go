@@ -0,0 +1,435 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imgspecs "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// digestSource resolves digests of images, but fails to pull them.
+type digestSource struct {
+	digests map[string]string
+}
+
+func (digestSource) Info(context.Context, *image.Reference, *k8s.AuthConfig) (*image.Info, error) {
+	return nil, image.ErrNotSupported
+}
+
+func (digestSource) Pull(context.Context, *image.Reference, *k8s.AuthConfig, string) ([]string, error) {
+	return nil, fmt.Errorf("unexpected pull")
+}
+
+func (s digestSource) Digests(_ context.Context, ref *image.Reference, _ *k8s.AuthConfig) ([]string, error) {
+	dgst, ok := s.digests[ref.String()]
+	if !ok {
+		return nil, image.ErrNotFound
+	}
+	return []string{dgst}, nil
+}
+
+// tamperedSource reports checksum of content, but pulls something else.
+type tamperedSource struct {
+	content []byte
+}
+
+func (s tamperedSource) Info(_ context.Context, ref *image.Reference, _ *k8s.AuthConfig) (*image.Info, error) {
+	checksum := fmt.Sprintf("%x", sha256.Sum256(s.content))
+	return &image.Info{
+		ID:     checksum,
+		Sha256: checksum,
+		Size:   uint64(len(s.content)),
+		Ref:    ref,
+	}, nil
+}
+
+func (s tamperedSource) Pull(_ context.Context, _ *image.Reference, _ *k8s.AuthConfig, pullPath string) ([]string, error) {
+	return nil, ioutil.WriteFile(pullPath, append(s.content, "tampered"...), 0644)
+}
+
+func (tamperedSource) Digests(context.Context, *image.Reference, *k8s.AuthConfig) ([]string, error) {
+	return nil, image.ErrNotSupported
+}
+
+// authSource records credentials images are pulled with
+// and blocks pulls until released.
+type authSource struct {
+	mu      sync.Mutex
+	users   []string
+	release chan struct{}
+}
+
+func (*authSource) Info(context.Context, *image.Reference, *k8s.AuthConfig) (*image.Info, error) {
+	return nil, image.ErrNotSupported
+}
+
+func (s *authSource) Pull(_ context.Context, _ *image.Reference, auth *k8s.AuthConfig, _ string) ([]string, error) {
+	s.mu.Lock()
+	s.users = append(s.users, auth.GetUsername())
+	s.mu.Unlock()
+	<-s.release
+	return nil, fmt.Errorf("unauthorized")
+}
+
+func (*authSource) Digests(context.Context, *image.Reference, *k8s.AuthConfig) ([]string, error) {
+	return nil, image.ErrNotSupported
+}
+
+func (s *authSource) pulled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.users...)
+}
+
+func TestPullImage_DifferentAuth(t *testing.T) {
+	src := &authSource{release: make(chan struct{})}
+	image.Register("authed", src)
+
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	s := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(nil),
+		pulls:   newPullGroup(),
+	}
+
+	auths := []*k8s.AuthConfig{
+		nil,
+		{Username: "tenant-a", Password: "secret-a"},
+		{Username: "tenant-b", Password: "secret-b"},
+		{Username: "tenant-b", Password: "secret-b"},
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(auths))
+	for _, auth := range auths {
+		go func(auth *k8s.AuthConfig) {
+			defer wg.Done()
+			_, err := s.PullImage(context.Background(), &k8s.PullImageRequest{
+				Image: &k8s.ImageSpec{Image: "authed://repo/app.sif"},
+				Auth:  auth,
+			})
+			require.Error(t, err)
+		}(auth)
+	}
+
+	// callers with different credentials should not wait for each other
+	require.Eventually(t, func() bool { return len(src.pulled()) == 3 }, 5*time.Second, time.Millisecond)
+	// while callers with the same credentials share a pull
+	ref, err := image.ParseRef("authed://repo/app.sif")
+	require.NoError(t, err)
+	waitWaiters(t, s.pulls, pullKey(ref, image.DefaultPlatform(), auths[2]), 2)
+	close(src.release)
+	wg.Wait()
+	require.ElementsMatch(t, []string{"", "tenant-a", "tenant-b"}, src.pulled())
+}
+
+func TestPullImage_DigestMismatch(t *testing.T) {
+	image.Register("tampered", tamperedSource{content: []byte("pretend this is a SIF file")})
+
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	s := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(nil),
+		pulls:   newPullGroup(),
+	}
+	_, err = s.PullImage(context.Background(), &k8s.PullImageRequest{
+		Image: &k8s.ImageSpec{Image: "tampered://repo/app.sif"},
+	})
+	require.Equal(t, codes.DataLoss, status.Code(err))
+
+	quarantined, err := ioutil.ReadDir(image.QuarantineDir(storage))
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1, "tampered image should be quarantined")
+	_, err = s.images.Find("tampered://repo/app.sif")
+	require.Error(t, err, "tampered image should not be indexed")
+}
+
+func TestPullImage_OrasDigestMismatch(t *testing.T) {
+	// tag is moved to another SIF after its digest is resolved
+	var (
+		mu        sync.Mutex
+		manifests int
+	)
+	layers := [][]byte{[]byte("pretend this is a SIF file"), []byte("pretend this is another SIF file")}
+	manifest := func(sif []byte) []byte {
+		config := []byte("{}")
+		data, err := json.Marshal(specs.Manifest{
+			Versioned: imgspecs.Versioned{SchemaVersion: 2},
+			Config: specs.Descriptor{
+				MediaType: "application/vnd.sylabs.sif.config.v1+json",
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+			},
+			Layers: []specs.Descriptor{
+				{
+					MediaType: image.SIFLayerMediaType,
+					Digest:    digest.FromBytes(sif),
+					Size:      int64(len(sif)),
+				},
+			},
+		})
+		require.NoError(t, err)
+		return data
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/sylabs/app/manifests/1.0":
+			mu.Lock()
+			sif := layers[manifests%len(layers)]
+			manifests++
+			mu.Unlock()
+			w.Header().Set("Content-Type", specs.MediaTypeImageManifest)
+			w.Write(manifest(sif))
+		case "/v2/sylabs/app/blobs/" + digest.FromBytes(layers[0]).String():
+			w.Write(layers[0])
+		case "/v2/sylabs/app/blobs/" + digest.FromBytes(layers[1]).String():
+			w.Write(layers[1])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	registries, err := image.NewRegistries(image.RegistryConfig{
+		Hosts: map[string]image.HostConfig{
+			host: {PlainHTTP: true},
+		},
+	})
+	require.NoError(t, err)
+
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	s := &SingularityRegistry{
+		storage:    storage,
+		images:     index.NewImageIndex(nil),
+		pulls:      newPullGroup(),
+		registries: registries,
+	}
+	_, err = s.PullImage(context.Background(), &k8s.PullImageRequest{
+		Image: &k8s.ImageSpec{Image: "oras://" + host + "/sylabs/app:1.0"},
+	})
+	require.Equal(t, codes.DataLoss, status.Code(err), "layer digest resolved in advance should be expected")
+
+	quarantined, err := ioutil.ReadDir(image.QuarantineDir(storage))
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1, "moved image should be quarantined")
+}
+
+func TestPullImage_SkipSameDigest(t *testing.T) {
+	const (
+		digest    = "digest://repo/app@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		newDigest = "digest://repo/new@sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	image.Register("digest", digestSource{
+		digests: map[string]string{
+			"digest://repo/app":   digest,
+			"digest://repo/alias": digest,
+			"digest://repo/new":   newDigest,
+		},
+	})
+
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	ref, err := image.ParseRef("digest://repo/app")
+	require.NoError(t, err)
+	ref.AddDigests([]string{digest})
+	pulled := &image.Info{
+		ID:  "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Ref: ref,
+	}
+	s := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(nil),
+		pulls:   newPullGroup(),
+	}
+	require.NoError(t, s.images.Add(pulled))
+
+	pull := func(imgRef string) (*k8s.PullImageResponse, error) {
+		return s.PullImage(context.Background(), &k8s.PullImageRequest{
+			Image: &k8s.ImageSpec{Image: imgRef},
+		})
+	}
+
+	t.Run("same tag", func(t *testing.T) {
+		resp, err := pull("digest://repo/app")
+		require.NoError(t, err)
+		require.Equal(t, pulled.ID, resp.ImageRef)
+	})
+
+	t.Run("another tag", func(t *testing.T) {
+		resp, err := pull("digest://repo/alias")
+		require.NoError(t, err)
+		require.Equal(t, pulled.ID, resp.ImageRef)
+
+		found, err := s.images.Find("digest://repo/alias")
+		require.NoError(t, err)
+		require.Equal(t, pulled.ID, found.ID)
+		require.ElementsMatch(t, []string{"digest://repo/app", "digest://repo/alias"}, found.Ref.Tags())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := pull("digest://repo/missing")
+		require.Equal(t, codes.NotFound, status.Code(err))
+	})
+
+	t.Run("new digest", func(t *testing.T) {
+		ref, err := image.ParseRef("digest://repo/new")
+		require.NoError(t, err)
+		found, err := s.findByDigest(context.Background(), ref, nil)
+		require.NoError(t, err)
+		require.Nil(t, found)
+		require.Equal(t, []string{newDigest}, ref.Digests(), "digest should be recorded for pull")
+	})
+}
+
+func TestPullImage_Platform(t *testing.T) {
+	const digest = "digest://repo/multiarch@sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	image.Register("digest", digestSource{
+		digests: map[string]string{
+			"digest://repo/multiarch": digest,
+		},
+	})
+
+	storage, err := ioutil.TempDir("", "registry-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	ref, err := image.ParseRef("digest://repo/multiarch")
+	require.NoError(t, err)
+	ref.AddDigests([]string{digest})
+	pulled := &image.Info{
+		ID:       "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210",
+		Ref:      ref,
+		Platform: "linux/arm64/v8",
+	}
+	s := &SingularityRegistry{
+		storage: storage,
+		images:  index.NewImageIndex(nil),
+		pulls:   newPullGroup(),
+	}
+	require.NoError(t, s.images.Add(pulled))
+
+	pull := func(platform string) (*k8s.PullImageResponse, error) {
+		return s.PullImage(context.Background(), &k8s.PullImageRequest{
+			Image: &k8s.ImageSpec{Image: "digest://repo/multiarch"},
+			SandboxConfig: &k8s.PodSandboxConfig{
+				Annotations: map[string]string{
+					PlatformAnnotation: platform,
+				},
+			},
+		})
+	}
+
+	t.Run("same platform", func(t *testing.T) {
+		resp, err := pull("linux/arm64/v8")
+		require.NoError(t, err)
+		require.Equal(t, pulled.ID, resp.ImageRef)
+	})
+
+	t.Run("another platform", func(t *testing.T) {
+		ref, err := image.ParseRef("digest://repo/multiarch")
+		require.NoError(t, err)
+		amd64, err := image.ParsePlatform("linux/amd64")
+		require.NoError(t, err)
+		found, err := s.findByDigest(image.WithPlatform(context.Background(), amd64), ref, nil)
+		require.NoError(t, err)
+		require.Nil(t, found)
+	})
+
+	t.Run("invalid annotation", func(t *testing.T) {
+		_, err := pull("linux")
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("verbose status", func(t *testing.T) {
+		resp, err := s.ImageStatus(context.Background(), &k8s.ImageStatusRequest{
+			Image:   &k8s.ImageSpec{Image: pulled.ID},
+			Verbose: true,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "linux/arm64/v8", resp.Info["platform"])
+	})
+}
+
+func TestLayerReferences(t *testing.T) {
+	storage, err := ioutil.TempDir("", "layers-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(storage)
+
+	cacheDir := image.LayerCacheDir(storage)
+	require.NoError(t, os.MkdirAll(cacheDir, 0755))
+	layer := func(c string) string {
+		hex := strings.Repeat(c, 64)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(cacheDir, hex), []byte(c), 0644))
+		return "sha256:" + hex
+	}
+	cached := func(layer string) bool {
+		_, err := os.Stat(filepath.Join(cacheDir, strings.TrimPrefix(layer, "sha256:")))
+		return err == nil
+	}
+	a, b, c, failed := layer("a"), layer("b"), layer("c"), layer("d")
+
+	first := &image.Info{ID: strings.Repeat("1", 64), Layers: []string{a, b}}
+	second := &image.Info{ID: strings.Repeat("2", 64), Layers: []string{b, c}}
+	s := &SingularityRegistry{storage: storage}
+	s.retainLayers(first)
+	s.retainLayers(first)
+	s.retainLayers(second)
+
+	s.beginLayerPull()
+	s.releaseLayers(first)
+	require.True(t, cached(a), "layer is removed while pull is in progress")
+	s.endLayerPull([]string{failed})
+	require.False(t, cached(a), "unused layer is left after pull")
+	require.False(t, cached(failed), "layer of not indexed image is left")
+	require.True(t, cached(b), "layer used by another image is removed")
+	require.True(t, cached(c), "layer used by another image is removed")
+
+	s.releaseLayers(second)
+	require.False(t, cached(b), "unused layer is left")
+	require.False(t, cached(c), "unused layer is left")
+	require.Empty(t, s.layers)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+const sifExt = ".sif"
+
+// importer keeps SIF images found in a directory indexed. Files are used in
+// place and are tagged according to their names, see importTag.
+type importer struct {
+	dir    string
+	images *index.ImageIndex
+}
+
+// WatchImportDir imports all SIF images found in dir and keeps watching it until
+// ctx is done, importing new images and removing ones whose files disappear.
+// Images are tagged after their file names, e.g. app_v3.sif is tagged app:v3,
+// the same way singularity pull names files. Files that cannot be tagged, or which
+// tag is taken by a pulled image, are imported by their local.file path only.
+// Files that appear later are imported once they are closed after writing or
+// are moved in. Nested directories are ignored.
+func (s *SingularityRegistry) WatchImportDir(ctx context.Context, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("could not get absolute import directory path: %v", err)
+	}
+	imp := &importer{
+		dir:    dir,
+		images: s.images,
+	}
+	// start watching first so that no file is missed during the initial scan
+	watcher, err := fs.NewWatcher(dir)
+	if err != nil {
+		return fmt.Errorf("could not watch import directory: %v", err)
+	}
+	if err := imp.scan(); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for event := range watcher.Watch(ctx) {
+			imp.handle(event)
+		}
+	}()
+	return nil
+}
+
+// scan imports all SIF images currently present in import directory.
+func (imp *importer) scan() error {
+	files, err := ioutil.ReadDir(imp.dir)
+	if err != nil {
+		return fmt.Errorf("could not read import directory: %v", err)
+	}
+	for _, fi := range files {
+		if fi.Mode().IsRegular() && isImportable(fi.Name()) {
+			imp.importFile(filepath.Join(imp.dir, fi.Name()))
+		}
+	}
+	return nil
+}
+
+// handle reacts on a single import directory change. Files are imported once
+// they are complete, i.e. closed after writing or moved in, created files are
+// waited for to be closed. Removed and moved away files are unindexed.
+func (imp *importer) handle(event fs.WatchEvent) {
+	if filepath.Dir(event.Path) != imp.dir || !isImportable(filepath.Base(event.Path)) {
+		return
+	}
+	switch event.Op {
+	case fs.OpCloseWrite, fs.OpMoveIn:
+		imp.importFile(event.Path)
+	case fs.OpRemove, fs.OpRename:
+		imp.removeFile(event.Path)
+	}
+}
+
+// importFile indexes image at path replacing image previously imported from
+// the same path, if any. Errors are logged since file may be invalid or
+// changed right away, in which case it is imported again. File that is
+// changed while being imported is skipped, since its checksum may be wrong.
+func (imp *importer) importFile(path string) {
+	before, err := os.Stat(path)
+	if err != nil {
+		glog.Errorf("Could not import %s: %v", path, err)
+		return
+	}
+	var tags []string
+	tag, err := importTag(path)
+	if err != nil {
+		glog.Warningf("Importing %s without tag: %v", path, err)
+	} else if owner, err := imp.images.Find(image.NormalizedImageRef(tag)); err == nil && !imp.isImported(owner) {
+		// image pulled by kubelet is never shadowed by the imported one
+		glog.Warningf("Importing %s without tag: tag %s is taken by image %s", path, tag, owner.ID)
+	} else {
+		tags = append(tags, tag)
+	}
+	info, err := image.Import(path, tags...)
+	if err != nil {
+		glog.Errorf("Could not import %s: %v", path, err)
+		return
+	}
+	after, err := os.Stat(path)
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		glog.Warningf("Skipping import of %s: file is changed while being imported", path)
+		return
+	}
+
+	old, err := imp.images.Find(singularity.LocalFileDomain + path)
+	if err == nil && old.ID != info.ID {
+		imp.removeFile(path)
+	}
+	if err := imp.images.Add(info); err != nil {
+		glog.Errorf("Could not index imported image %s: %v", path, err)
+		return
+	}
+	glog.V(2).Infof("Imported %s as %v", path, info.Ref.Tags())
+}
+
+// removeFile removes tags of image imported from path. Image itself
+// is removed from index once it has no tags left.
+func (imp *importer) removeFile(path string) {
+	pathTag := singularity.LocalFileDomain + path
+	info, err := imp.images.Find(pathTag)
+	if err != nil {
+		return
+	}
+	tags := []string{pathTag}
+	if tag, err := importTag(path); err == nil {
+		tags = append(tags, image.NormalizedImageRef(tag))
+	}
+	err = imp.images.Untag(info.ID, tags...)
+	if err == nil && len(info.Ref.Tags()) == 0 && len(info.Ref.Digests()) == 0 {
+		err = imp.images.Remove(info.ID)
+	}
+	if err != nil {
+		glog.Errorf("Could not remove image imported from %s: %v", path, err)
+		return
+	}
+	glog.V(2).Infof("Removed image imported from %s", path)
+}
+
+// isImportable returns true for SIF files that are not hidden,
+// which is usually the case for temporary files.
+func isImportable(name string) bool {
+	return strings.HasSuffix(name, sifExt) && !strings.HasPrefix(name, ".")
+}
+
+// importTag returns tag image at path is imported with. File name is
+// expected to be in <name>_<tag>.sif form, e.g. app_v3.sif is tagged
+// app:v3, name without tag is tagged latest, e.g. tool.sif is tagged
+// tool:latest. Note that kubelet pulls latest images unless pod sets
+// imagePullPolicy explicitly, see WatchImportDir.
+func importTag(path string) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(path), sifExt)
+	if i := strings.LastIndexByte(name, '_'); i > 0 && i < len(name)-1 {
+		name = name[:i] + ":" + name[i+1:]
+	}
+	ref, err := image.ParseRef(name)
+	if err != nil {
+		return "", err
+	}
+	if ref.URI() != singularity.DockerDomain {
+		return "", fmt.Errorf("file name %s does not map to image tag", filepath.Base(path))
+	}
+	return ref.Tags()[0], nil
+}
+
+// isImported returns true if info describes image imported from import directory.
+func (imp *importer) isImported(info *image.Info) bool {
+	for _, tag := range info.Ref.Tags() {
+		if strings.HasPrefix(tag, singularity.LocalFileDomain+imp.dir+"/") {
+			return true
+		}
+	}
+	return false
+}
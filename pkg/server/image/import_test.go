@@ -0,0 +1,181 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/sif/pkg/sif"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/singularity"
+)
+
+func TestImportTag(t *testing.T) {
+	tt := []struct {
+		file        string
+		expectTag   string
+		expectError bool
+	}{
+		{file: "app_v3.sif", expectTag: "app:v3"},
+		{file: "alpine_3.9.sif", expectTag: "alpine:3.9"},
+		{file: "tool.sif", expectTag: "tool:latest"},
+		{file: "tool_latest.sif", expectTag: "tool:latest"},
+		{file: "my_app_1.0.sif", expectTag: "my_app:1.0"},
+		{file: "app_.sif", expectError: true},
+		{file: "App_v3.sif", expectError: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.file, func(t *testing.T) {
+			tag, err := importTag(filepath.Join("/images", tc.file))
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expectTag, tag)
+		})
+	}
+}
+
+// sifHeader makes content look like SIF image.
+var sifHeader = fmt.Sprintf("%-*s%s\x00", sif.HdrLaunchLen, sif.HdrLaunch, sif.HdrMagic)
+
+func TestImporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(sifHeader+content), 0644), "could not write image")
+		return path
+	}
+	app := write("app_v3.sif", "app v3")
+	write("tool_v1.sif", "tool")
+	untagged := write("untagged.sif", "untagged")
+	write(".app_v4.sif", "partial app v4")
+	write("notes.txt", "not an image")
+	invalid := filepath.Join(dir, "invalid_v1.sif")
+	require.NoError(t, ioutil.WriteFile(invalid, []byte("not a SIF"), 0644))
+
+	imp := &importer{
+		dir:    dir,
+		images: index.NewImageIndex(nil),
+	}
+	require.NoError(t, imp.scan())
+
+	found := func(ref string) bool {
+		_, err := imp.images.Find(ref)
+		return err == nil
+	}
+
+	t.Run("scan", func(t *testing.T) {
+		info, err := imp.images.Find("app:v3")
+		require.NoError(t, err)
+		require.Equal(t, app, info.Path)
+		require.Equal(t, singularity.LocalFileDomain, info.Ref.URI())
+		require.ElementsMatch(t, []string{singularity.LocalFileDomain + app, "app:v3"}, info.Ref.Tags())
+		require.True(t, found("tool:v1"))
+		require.True(t, found("untagged"), "files without tag should be imported as latest")
+		require.True(t, found(singularity.LocalFileDomain+untagged))
+		require.False(t, found("app:v4"), "hidden files should not be imported")
+		require.False(t, found("invalid:v1"), "files without SIF header should not be imported")
+	})
+
+	t.Run("created", func(t *testing.T) {
+		path := filepath.Join(dir, "app_v4.sif")
+		require.NoError(t, ioutil.WriteFile(path, nil, 0644))
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpCreate})
+		require.False(t, found("app:v4"), "import should wait for file to be closed")
+
+		write("app_v4.sif", "app v4")
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpWrite})
+		require.False(t, found("app:v4"), "import should wait for file to be closed")
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpCloseWrite})
+		require.True(t, found("app:v4"))
+	})
+
+	t.Run("moved in", func(t *testing.T) {
+		tmp := write(".app_v5.sif", "app v5")
+		path := filepath.Join(dir, "app_v5.sif")
+		require.NoError(t, os.Rename(tmp, path))
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpMoveIn})
+		require.True(t, found("app:v5"))
+	})
+
+	t.Run("rewritten", func(t *testing.T) {
+		old, err := imp.images.Find("tool:v1")
+		require.NoError(t, err)
+		path := write("tool_v1.sif", "new tool")
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpCloseWrite})
+		info, err := imp.images.Find("tool:v1")
+		require.NoError(t, err)
+		require.NotEqual(t, old.ID, info.ID)
+		require.False(t, found(old.ID), "previous image should be removed")
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		require.NoError(t, os.Remove(app))
+		imp.handle(fs.WatchEvent{Path: app, Op: fs.OpRemove})
+		require.False(t, found("app:v3"))
+		require.False(t, found(singularity.LocalFileDomain+app))
+	})
+
+	t.Run("pulled tag", func(t *testing.T) {
+		ref, err := image.ParseRef("busybox:1.30")
+		require.NoError(t, err)
+		pulled := &image.Info{
+			ID:  "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			Ref: ref,
+		}
+		require.NoError(t, imp.images.Add(pulled))
+
+		path := write("busybox_1.30.sif", "imported busybox")
+		imp.importFile(path)
+		info, err := imp.images.Find("busybox:1.30")
+		require.NoError(t, err)
+		require.Equal(t, pulled.ID, info.ID, "pulled image should not be shadowed")
+		imported, err := imp.images.Find(singularity.LocalFileDomain + path)
+		require.NoError(t, err, "file should be imported by path")
+		require.Equal(t, []string{singularity.LocalFileDomain + path}, imported.Ref.Tags())
+
+		imp.handle(fs.WatchEvent{Path: path, Op: fs.OpRemove})
+		require.False(t, found(singularity.LocalFileDomain+path))
+		require.True(t, found("busybox:1.30"), "pulled image should be kept")
+	})
+
+	t.Run("same content", func(t *testing.T) {
+		first := write("copy_1.sif", "same")
+		second := write("copy_2.sif", "same")
+		imp.importFile(first)
+		imp.importFile(second)
+
+		info, err := imp.images.Find("copy:1")
+		require.NoError(t, err)
+		require.Len(t, info.Ref.Tags(), 4)
+
+		imp.handle(fs.WatchEvent{Path: first, Op: fs.OpRename})
+		require.False(t, found("copy:1"))
+		require.True(t, found("copy:2"), "image should stay while another file has it")
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/image"
+	"google.golang.org/grpc/status"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// pullFunc performs actual image pull.
+type pullFunc func(ctx context.Context) (*k8s.PullImageResponse, error)
+
+// pullCall is an image pull shared between concurrent callers.
+type pullCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	resp *k8s.PullImageResponse
+	err  error
+}
+
+// pullGroup coalesces concurrent pulls of the same image. It is similar
+// to singleflight but each caller may give up waiting on its own, and the
+// shared pull is cancelled only when no one waits for it anymore.
+type pullGroup struct {
+	mu    sync.Mutex
+	calls map[string]*pullCall
+}
+
+// pullKey returns key concurrent pulls of ref for platform are coalesced by.
+// Only callers with identical credentials share a pull, otherwise a caller
+// could be handed an image fetched with someone else's secret, or an error
+// caused by another caller lacking credentials. Credentials are hashed so
+// that they never show up in logs.
+func pullKey(ref *image.Reference, platform image.Platform, auth *k8s.AuthConfig) string {
+	key := ref.String() + " for " + platform.String()
+	if auth != nil && auth.Size() > 0 {
+		data, err := auth.Marshal()
+		if err != nil {
+			// should never happen, but never share a pull in such case
+			data = []byte(fmt.Sprintf("%p", auth))
+		}
+		key += fmt.Sprintf(" with auth %x", sha256.Sum256(data))
+	}
+	return key
+}
+
+func newPullGroup() *pullGroup {
+	return &pullGroup{
+		calls: make(map[string]*pullCall),
+	}
+}
+
+// do calls pull for key unless the same key is already being pulled, in which
+// case it waits for the running pull to complete and returns its result. Pull is
+// called with a context that is independent from ctx of any single caller.
+func (g *pullGroup) do(ctx context.Context, key string, pull pullFunc) (*k8s.PullImageResponse, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if ok {
+		glog.V(2).Infof("Image %s is already being pulled, waiting for it", key)
+	} else {
+		pullCtx, cancel := context.WithCancel(context.Background())
+		call = &pullCall{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		g.calls[key] = call
+		go g.run(pullCtx, key, call, pull)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			glog.V(2).Infof("No one waits for %s anymore, cancelling pull", key)
+			call.cancel()
+			g.forget(key, call)
+		}
+		g.mu.Unlock()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (g *pullGroup) run(ctx context.Context, key string, call *pullCall, pull pullFunc) {
+	call.resp, call.err = pull(ctx)
+	call.cancel()
+
+	g.mu.Lock()
+	g.forget(key, call)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// forget removes call from the group so that further callers start
+// a new pull. Must be called with g.mu held.
+func (g *pullGroup) forget(key string, call *pullCall) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+func TestPullGroup(t *testing.T) {
+	const key = "busybox:1.31"
+
+	t.Run("concurrent pulls are shared", func(t *testing.T) {
+		g := newPullGroup()
+		var calls int32
+		release := make(chan struct{})
+		pull := func(ctx context.Context) (*k8s.PullImageResponse, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return &k8s.PullImageResponse{ImageRef: "foo"}, nil
+		}
+
+		const callers = 5
+		var wg sync.WaitGroup
+		wg.Add(callers)
+		for i := 0; i < callers; i++ {
+			go func() {
+				defer wg.Done()
+				resp, err := g.do(context.Background(), key, pull)
+				require.NoError(t, err)
+				require.Equal(t, "foo", resp.ImageRef)
+			}()
+		}
+		waitWaiters(t, g, key, callers)
+		close(release)
+		wg.Wait()
+		require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		require.Empty(t, g.calls)
+	})
+
+	t.Run("cancelled waiter doesn't cancel pull", func(t *testing.T) {
+		g := newPullGroup()
+		release := make(chan struct{})
+		pull := func(ctx context.Context) (*k8s.PullImageResponse, error) {
+			select {
+			case <-release:
+				return &k8s.PullImageResponse{ImageRef: "foo"}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		done := make(chan error)
+		go func() {
+			_, err := g.do(context.Background(), key, pull)
+			done <- err
+		}()
+		waitWaiters(t, g, key, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := g.do(ctx, key, pull)
+		require.Equal(t, codes.Canceled, status.Code(err))
+
+		close(release)
+		require.NoError(t, <-done)
+	})
+
+	t.Run("pull is cancelled when no one waits", func(t *testing.T) {
+		g := newPullGroup()
+		var calls int32
+		cancelled := make(chan struct{})
+		pull := func(ctx context.Context) (*k8s.PullImageResponse, error) {
+			if atomic.AddInt32(&calls, 1) > 1 {
+				return &k8s.PullImageResponse{ImageRef: "foo"}, nil
+			}
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := g.do(ctx, key, pull)
+		require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		<-cancelled
+
+		resp, err := g.do(context.Background(), key, pull)
+		require.NoError(t, err)
+		require.Equal(t, "foo", resp.ImageRef)
+		require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	})
+}
+
+// waitWaiters blocks until n callers wait for the pull of key.
+func waitWaiters(t *testing.T, g *pullGroup, key string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		call, ok := g.calls[key]
+		waiters := 0
+		if ok {
+			waiters = call.waiters
+		}
+		g.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers", n)
+}
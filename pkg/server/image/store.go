@@ -0,0 +1,206 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/fs"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+const (
+	registryInfoFile = "registry.json"
+
+	// registryInfoVersion is the current version of registry info file schema.
+	// Version 0 is a legacy format with a plain stream of image info objects.
+	registryInfoVersion = 1
+)
+
+// errCorrupted is returned when registry info file cannot be decoded.
+type errCorrupted struct {
+	err error
+}
+
+func (e errCorrupted) Error() string {
+	return fmt.Sprintf("registry info file is corrupted: %v", e.err)
+}
+
+// registryInfo is a content of registry info file.
+type registryInfo struct {
+	Version int           `json:"version"`
+	Images  []*image.Info `json:"images"`
+}
+
+// readRegistryInfo reads images stored in registry info file at path migrating
+// older schema versions if needed. If file doesn't exist no error is returned.
+// If file content cannot be decoded errCorrupted is returned.
+func readRegistryInfo(path string) ([]*image.Info, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read registry info file: %v", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var first json.RawMessage
+	if err := dec.Decode(&first); err != nil {
+		return nil, errCorrupted{err}
+	}
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal(first, &header); err != nil {
+		return nil, errCorrupted{err}
+	}
+
+	if header.Version == nil {
+		return migrateLegacyInfo(first, dec)
+	}
+	if *header.Version > registryInfoVersion {
+		return nil, fmt.Errorf("unsupported registry info version %d", *header.Version)
+	}
+	if dec.More() {
+		return nil, errCorrupted{fmt.Errorf("unexpected data after registry info")}
+	}
+	var info registryInfo
+	if err := json.Unmarshal(first, &info); err != nil {
+		return nil, errCorrupted{err}
+	}
+	return info.Images, nil
+}
+
+// migrateLegacyInfo decodes registry info stored in version 0 format, i.e. plain
+// stream of image info objects. The first object is already read from dec.
+func migrateLegacyInfo(first json.RawMessage, dec *json.Decoder) ([]*image.Info, error) {
+	var images []*image.Info
+	var info *image.Info
+	if err := json.Unmarshal(first, &info); err != nil {
+		return nil, errCorrupted{err}
+	}
+	images = append(images, info)
+	for dec.More() {
+		var info *image.Info
+		if err := dec.Decode(&info); err != nil {
+			return nil, errCorrupted{err}
+		}
+		images = append(images, info)
+	}
+	return images, nil
+}
+
+// writeRegistryInfo atomically replaces registry info file at path with the
+// passed images, so a crash at any moment leaves either old or new file content.
+func writeRegistryInfo(path string, images []*image.Info) error {
+	info := registryInfo{
+		Version: registryInfoVersion,
+		Images:  images,
+	}
+	err := fs.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(info)
+	})
+	if err != nil {
+		return fmt.Errorf("could not write registry info: %v", err)
+	}
+	return nil
+}
+
+// recoverRegistryInfo moves corrupted registry info file found in storage
+// directory aside and rebuilds registry by rescanning image files.
+func recoverRegistryInfo(storage string) ([]*image.Info, error) {
+	path := filepath.Join(storage, registryInfoFile)
+	quarantinePath := fmt.Sprintf("%s.corrupted.%d", path, time.Now().Unix())
+	if err := os.Rename(path, quarantinePath); err != nil {
+		return nil, fmt.Errorf("could not quarantine registry info file: %v", err)
+	}
+	glog.Warningf("Corrupted registry info file is moved to %s, rebuilding registry from %s",
+		quarantinePath, storage)
+	return rescanStorage(storage)
+}
+
+// rescanStorage builds image info for each image file found in storage directory.
+// Since original references are lost, images are referenced by their IDs only.
+// Files that cannot be loaded are skipped. Cached docker layers cannot be attributed
+// to images built from them, so each image conservatively retains all of them. This
+// way no layer is removed from cache until all rescanned images are removed.
+func rescanStorage(dir string) ([]*image.Info, error) {
+	fii, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read storage directory: %v", err)
+	}
+	layers, err := cachedLayers(dir)
+	if err != nil {
+		return nil, err
+	}
+	var images []*image.Info
+	for _, fi := range fii {
+		if !fi.Mode().IsRegular() || !isImageFile(fi.Name()) {
+			continue
+		}
+		info, err := image.Load(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			glog.Errorf("Could not load image %s: %v", fi.Name(), err)
+			continue
+		}
+		info.Layers = layers
+		images = append(images, info)
+	}
+	return images, nil
+}
+
+// cachedLayers returns digests of docker layers found in cache of storage directory.
+func cachedLayers(dir string) ([]string, error) {
+	fii, err := ioutil.ReadDir(image.LayerCacheDir(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read layer cache directory: %v", err)
+	}
+	var layers []string
+	for _, fi := range fii {
+		if fi.Mode().IsRegular() && isImageFile(fi.Name()) {
+			layers = append(layers, "sha256:"+fi.Name())
+		}
+	}
+	return layers, nil
+}
+
+// isImageFile returns true if name looks like a pulled image
+// file name, i.e. a hex encoded sha256 checksum.
+func isImageFile(name string) bool {
+	if len(name) != image.IDLen {
+		return false
+	}
+	for _, r := range name {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
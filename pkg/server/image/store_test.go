@@ -0,0 +1,153 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/image"
+)
+
+func TestReadRegistryInfo(t *testing.T) {
+	tt := []struct {
+		name        string
+		content     string
+		expectIDs   []string
+		expectError string
+		isCorrupted bool
+	}{
+		{
+			name:    "empty file",
+			content: "",
+		},
+		{
+			name: "legacy format",
+			content: `{"id":"7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0","ref":{"uri":"docker.io","tags":["busybox:latest"],"digests":null}}
+{"id":"3c1d4ce6b2e1f51b10bc33e5ca6f1b1c4eaf6e1a3a0b2e0c9e0a8c8cbe4f2d21","ref":{"uri":"docker.io","tags":["alpine:3.8"],"digests":null}}
+`,
+			expectIDs: []string{
+				"7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0",
+				"3c1d4ce6b2e1f51b10bc33e5ca6f1b1c4eaf6e1a3a0b2e0c9e0a8c8cbe4f2d21",
+			},
+		},
+		{
+			name:      "current format",
+			content:   `{"version":1,"images":[{"id":"7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0","ref":{"uri":"docker.io","tags":["busybox:latest"],"digests":null}}]}`,
+			expectIDs: []string{"7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0"},
+		},
+		{
+			name:        "future format",
+			content:     `{"version":2,"images":[]}`,
+			expectError: "unsupported registry info version 2",
+		},
+		{
+			name:        "truncated legacy format",
+			content:     `{"id":"7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0"}{"id":"3c1d4ce6b2e1f51b`,
+			isCorrupted: true,
+		},
+		{
+			name:        "truncated current format",
+			content:     `{"version":1,"images":[{"id":"7cd2a0c8bd1b3d1a3b`,
+			isCorrupted: true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "registry-info-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, registryInfoFile)
+			err := ioutil.WriteFile(path, []byte(tc.content), 0644)
+			require.NoError(t, err, "could not write registry info")
+
+			images, err := readRegistryInfo(path)
+			if tc.isCorrupted {
+				require.IsType(t, errCorrupted{}, err)
+				return
+			}
+			if tc.expectError != "" {
+				require.EqualError(t, err, tc.expectError)
+				return
+			}
+			require.NoError(t, err)
+			var ids []string
+			for _, info := range images {
+				ids = append(ids, info.ID)
+			}
+			require.Equal(t, tc.expectIDs, ids)
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		images, err := readRegistryInfo(filepath.Join(dir, "missing.json"))
+		require.NoError(t, err)
+		require.Empty(t, images)
+	})
+}
+
+func TestWriteRegistryInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry-info-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	ref, err := image.ParseRef("busybox:1.29")
+	require.NoError(t, err, "could not parse busybox ref")
+	images := []*image.Info{
+		{
+			ID:     "7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0",
+			Sha256: "7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0",
+			Size:   42,
+			Ref:    ref,
+		},
+	}
+
+	path := filepath.Join(dir, registryInfoFile)
+	require.NoError(t, writeRegistryInfo(path, images))
+	// second write must replace file content rather than append to it
+	require.NoError(t, writeRegistryInfo(path, images))
+
+	actual, err := readRegistryInfo(path)
+	require.NoError(t, err)
+	require.Len(t, actual, 1)
+	require.Equal(t, images[0].ID, actual[0].ID)
+	require.Equal(t, images[0].Size, actual[0].Size)
+	require.Equal(t, images[0].Ref.Tags(), actual[0].Ref.Tags())
+
+	fii, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, fii, 1, "temporary files are left in storage directory")
+}
+
+func TestIsImageFile(t *testing.T) {
+	tt := []struct {
+		name   string
+		expect bool
+	}{
+		{name: "7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a0", expect: true},
+		{name: "7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a", expect: false},
+		{name: "7CD2A0C8BD1B3D1A3B3A8A1D1DDB8D5BBD0B2A9A1FDC2CCB5E51B3E8B0B1D9A0", expect: false},
+		{name: ".7cd2a0c8bd1b3d1a3b3a8a1d1ddb8d5bbd0b2a9a1fdc2ccb5e51b3e8b0b1d9a", expect: false},
+		{name: registryInfoFile, expect: false},
+	}
+	for _, tc := range tt {
+		require.Equal(t, tc.expect, isImageFile(tc.name), tc.name)
+	}
+}
@@ -58,7 +58,7 @@ func (s *SingularityRuntime) CreateContainer(_ context.Context, req *k8s.CreateC
 			glog.Errorf("Could not remove container from index: %v", err)
 		}
 	}
-	contBaseDir := filepath.Join(s.baseRunDir, "containers", cont.ID())
+	contBaseDir := filepath.Join(s.baseRunDir, containersDir, cont.ID())
 	if err := cont.Create(contBaseDir); err != nil {
 		cleanupOnFailure()
 		return nil, status.Errorf(codes.Internal, "could not create container: %v", err)
@@ -0,0 +1,307 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/kube"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+	"github.com/sylabs/singularity/pkg/ociruntime"
+)
+
+const (
+	// DefaultGCInterval is the default interval between garbage collections.
+	DefaultGCInterval = 10 * time.Minute
+
+	// gcGracePeriod protects recently created pods and containers that
+	// are not yet added to index from being collected.
+	gcGracePeriod = time.Minute
+
+	// gcKillTimeout is the time given to an orphaned instance
+	// to exit after it was killed.
+	gcKillTimeout = 5 * time.Second
+
+	// gcKillPollInterval is the interval between state checks
+	// of an orphaned instance that is being killed.
+	gcKillPollInterval = 100 * time.Millisecond
+)
+
+// instanceClient is a part of runtime.CLIClient garbage collector relies on.
+type instanceClient interface {
+	List() ([]string, error)
+	State(id string) (*ociruntime.State, error)
+	Kill(id string, force bool) error
+	Delete(id string) error
+}
+
+// gcReport holds IDs of everything removed during a single garbage collection.
+type gcReport struct {
+	pods       []string
+	containers []string
+	instances  []string
+}
+
+// WithGCInterval sets interval between garbage collections of orphaned
+// pod and container artifacts. If interval is 0 DefaultGCInterval is used.
+func WithGCInterval(interval time.Duration) Option {
+	return func(r *SingularityRuntime) {
+		if interval == 0 {
+			interval = DefaultGCInterval
+		}
+		r.gcInterval = interval
+	}
+}
+
+// startGC runs garbage collection once and then periodically
+// until Shutdown is called.
+func (s *SingularityRuntime) startGC() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.gcCancel = cancel
+
+	cli := runtime.NewCLIClient()
+	s.collectGarbage(ctx, cli)
+	if s.gcInterval <= 0 {
+		return
+	}
+
+	s.gcDone = make(chan struct{})
+	go func() {
+		defer close(s.gcDone)
+
+		ticker := time.NewTicker(s.gcInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.collectGarbage(ctx, cli)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopGC stops periodic garbage collection and waits for the current one, if any.
+func (s *SingularityRuntime) stopGC() {
+	if s.gcCancel == nil {
+		return
+	}
+	s.gcCancel()
+	if s.gcDone != nil {
+		<-s.gcDone
+	}
+}
+
+// collectGarbage compares pods and containers found in base run directory and
+// Singularity OCI instances reported by cli with the ones that are stored in indexes
+// and removes any orphaned artifacts along with corresponding instances. Pods and
+// containers that could not be restored are left alone while their instances run.
+func (s *SingularityRuntime) collectGarbage(ctx context.Context, cli instanceClient) {
+	var report gcReport
+	// IDs of pods and containers that have directories, orphaned or not
+	seen := make(map[string]bool)
+
+	contDirs, err := readDirNames(filepath.Join(s.baseRunDir, containersDir))
+	if err != nil {
+		glog.Errorf("Could not read containers directory: %v", err)
+	}
+	for _, dir := range contDirs {
+		id := filepath.Base(dir)
+		seen[id] = true
+		if _, err := s.containers.Find(id); err != index.ErrNotFound || !isStale(dir) || s.keepUnrestored(cli, id) {
+			continue
+		}
+		glog.V(3).Infof("Removing orphaned container %s", id)
+		removed, err := removeInstance(ctx, cli, id)
+		if err != nil {
+			glog.Errorf("Could not remove orphaned container instance %s: %v", id, err)
+			continue
+		}
+		if removed {
+			report.instances = append(report.instances, id)
+		}
+		if err := kube.CleanupContainerDir(dir); err != nil {
+			glog.Errorf("Could not remove orphaned container %s: %v", id, err)
+			continue
+		}
+		report.containers = append(report.containers, id)
+	}
+
+	podDirs, err := readDirNames(filepath.Join(s.baseRunDir, podsDir))
+	if err != nil {
+		glog.Errorf("Could not read pods directory: %v", err)
+	}
+	for _, dir := range podDirs {
+		id := filepath.Base(dir)
+		seen[id] = true
+		if _, err := s.pods.Find(id); err != index.ErrNotFound || !isStale(dir) || s.keepUnrestored(cli, id) {
+			continue
+		}
+		glog.V(3).Infof("Removing orphaned pod %s", id)
+		removed, err := removeInstance(ctx, cli, id)
+		if err != nil {
+			glog.Errorf("Could not remove orphaned pod instance %s: %v", id, err)
+			continue
+		}
+		if removed {
+			report.instances = append(report.instances, id)
+		}
+		if err := kube.CleanupPodDir(dir, s.networkManager); err != nil {
+			glog.Errorf("Could not remove orphaned pod %s: %v", id, err)
+			continue
+		}
+		report.pods = append(report.pods, id)
+	}
+
+	ids, err := cli.List()
+	if err != nil {
+		glog.Errorf("Could not list instances: %v", err)
+	}
+	for _, id := range ids {
+		if seen[id] || s.isIndexed(id) || !s.isOrphanInstance(cli, id) {
+			continue
+		}
+		glog.V(3).Infof("Removing orphaned instance %s", id)
+		removed, err := removeInstance(ctx, cli, id)
+		if err != nil {
+			glog.Errorf("Could not remove orphaned instance %s: %v", id, err)
+			continue
+		}
+		if removed {
+			report.instances = append(report.instances, id)
+		}
+	}
+
+	if len(report.pods) == 0 && len(report.containers) == 0 && len(report.instances) == 0 {
+		glog.V(4).Infof("Garbage collection found nothing to remove")
+		return
+	}
+	glog.Infof("Garbage collection removed %d pods %v, %d containers %v and %d instances %v",
+		len(report.pods), report.pods,
+		len(report.containers), report.containers,
+		len(report.instances), report.instances)
+}
+
+// isIndexed returns true if id is a known pod or container.
+func (s *SingularityRuntime) isIndexed(id string) bool {
+	if _, err := s.pods.Find(id); err != index.ErrNotFound {
+		return true
+	}
+	_, err := s.containers.Find(id)
+	return err != index.ErrNotFound
+}
+
+// isOrphanInstance returns true if instance with passed id has no pod or container
+// directory, but was created by CRI, i.e. its bundle is in base run directory, and
+// was not created during gcGracePeriod. Instances created by others are never touched.
+func (s *SingularityRuntime) isOrphanInstance(cli instanceClient, id string) bool {
+	if s.unrestored[id] {
+		return false
+	}
+	state, err := cli.State(id)
+	if err != nil {
+		if err != runtime.ErrNotFound {
+			glog.Errorf("Could not get instance %s state: %v", id, err)
+		}
+		return false
+	}
+	baseRunDir := filepath.Clean(s.baseRunDir) + string(filepath.Separator)
+	if !strings.HasPrefix(filepath.Clean(state.Bundle), baseRunDir) {
+		return false
+	}
+	if state.CreatedAt != nil && time.Since(time.Unix(0, *state.CreatedAt)) <= gcGracePeriod {
+		return false
+	}
+	return true
+}
+
+// keepUnrestored returns true if id is a pod or container that could not be
+// restored after CRI restart, e.g. due to missing image, and which instance is
+// still running. Such workloads are left for inspection instead of being killed.
+func (s *SingularityRuntime) keepUnrestored(cli instanceClient, id string) bool {
+	if !s.unrestored[id] {
+		return false
+	}
+	state, err := cli.State(id)
+	if err == runtime.ErrNotFound {
+		return false
+	}
+	if err == nil && runtime.StatusToState(state.Status) == runtime.StateExited {
+		return false
+	}
+	glog.V(2).Infof("Leaving %s that could not be restored while its instance runs", id)
+	return true
+}
+
+// isStale returns true if dir was not modified during gcGracePeriod.
+func isStale(dir string) bool {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return false
+	}
+	return time.Since(fi.ModTime()) > gcGracePeriod
+}
+
+// removeInstance kills and deletes Singularity OCI instance with passed id.
+// It returns false if no such instance is found.
+func removeInstance(ctx context.Context, cli instanceClient, id string) (bool, error) {
+	state, err := cli.State(id)
+	if err == runtime.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if runtime.StatusToState(state.Status) != runtime.StateExited {
+		if err := cli.Kill(id, true); err != nil {
+			return false, fmt.Errorf("could not kill instance: %v", err)
+		}
+		timeout := time.NewTimer(gcKillTimeout)
+		defer timeout.Stop()
+		ticker := time.NewTicker(gcKillPollInterval)
+		defer ticker.Stop()
+		for runtime.StatusToState(state.Status) != runtime.StateExited {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-timeout.C:
+				return false, fmt.Errorf("instance is still running after kill")
+			case <-ticker.C:
+			}
+			state, err = cli.State(id)
+			if err == runtime.ErrNotFound {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	err = cli.Delete(id)
+	if err != nil && err != runtime.ErrNotFound {
+		return false, fmt.Errorf("could not delete instance: %v", err)
+	}
+	return true, nil
+}
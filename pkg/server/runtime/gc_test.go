@@ -0,0 +1,202 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/kube"
+	"github.com/sylabs/singularity-cri/pkg/singularity/runtime"
+	"github.com/sylabs/singularity/pkg/ociruntime"
+	k8s "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+)
+
+// fakeInstances pretends to be Singularity OCI engine running passed instances.
+// Killed instances exit right away unless they ignore signals.
+type fakeInstances struct {
+	mu       sync.Mutex
+	states   map[string]*ociruntime.State
+	immortal map[string]bool
+	killed   []string
+	deleted  []string
+}
+
+func (f *fakeInstances) List() ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for id := range f.states {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (f *fakeInstances) State(id string) (*ociruntime.State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	state, ok := f.states[id]
+	if !ok {
+		return nil, runtime.ErrNotFound
+	}
+	st := *state
+	return &st, nil
+}
+
+func (f *fakeInstances) Kill(id string, _ bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.killed = append(f.killed, id)
+	if !f.immortal[id] {
+		f.states[id].Status = "stopped"
+	}
+	return nil
+}
+
+func (f *fakeInstances) Delete(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.states[id]; !ok {
+		return runtime.ErrNotFound
+	}
+	delete(f.states, id)
+	f.deleted = append(f.deleted, id)
+	return nil
+}
+
+func instanceState(bundle, status string, created time.Time) *ociruntime.State {
+	createdAt := created.UnixNano()
+	return &ociruntime.State{
+		State: specs.State{
+			Status: status,
+			Bundle: bundle,
+		},
+		CreatedAt: &createdAt,
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	baseRunDir, err := ioutil.TempDir("", "gc-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(baseRunDir)
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	mkdir := func(kind, id string, modTime time.Time) string {
+		dir := filepath.Join(baseRunDir, kind, id)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.Chtimes(dir, modTime, modTime))
+		return dir
+	}
+	bundle := func(kind, id string) string {
+		return filepath.Join(baseRunDir, kind, id, "bundle")
+	}
+
+	pod := kube.NewPod(&k8s.PodSandboxConfig{})
+	s := &SingularityRuntime{
+		pods:       index.NewPodIndex(),
+		containers: index.NewContainerIndex(),
+		baseRunDir: baseRunDir,
+		unrestored: map[string]bool{"unrestored": true, "exited-unrestored": true},
+	}
+	require.NoError(t, s.pods.Add(pod))
+
+	indexed := mkdir(podsDir, pod.ID(), old)
+	orphanCont := mkdir(containersDir, "orphan-cont", old)
+	freshCont := mkdir(containersDir, "fresh-cont", time.Now())
+	orphanPod := mkdir(podsDir, "orphan-pod", old)
+	unrestored := mkdir(podsDir, "unrestored", old)
+	exitedUnrestored := mkdir(containersDir, "exited-unrestored", old)
+
+	cli := &fakeInstances{
+		states: map[string]*ociruntime.State{
+			pod.ID():            instanceState(bundle(podsDir, pod.ID()), "running", old),
+			"orphan-cont":       instanceState(bundle(containersDir, "orphan-cont"), "running", old),
+			"fresh-cont":        instanceState(bundle(containersDir, "fresh-cont"), "created", time.Now()),
+			"unrestored":        instanceState(bundle(podsDir, "unrestored"), "running", old),
+			"exited-unrestored": instanceState(bundle(containersDir, "exited-unrestored"), "stopped", old),
+			"dirless":           instanceState(bundle(containersDir, "dirless"), "running", old),
+			"dirless-new":       instanceState(bundle(containersDir, "dirless-new"), "creating", time.Now()),
+			"foreign":           instanceState("/home/user/bundle", "running", old),
+		},
+	}
+
+	s.collectGarbage(context.Background(), cli)
+
+	require.ElementsMatch(t, []string{"orphan-cont", "dirless"}, cli.killed)
+	require.ElementsMatch(t, []string{"orphan-cont", "exited-unrestored", "dirless"}, cli.deleted)
+	for _, dir := range []string{orphanCont, orphanPod, exitedUnrestored} {
+		_, err := os.Stat(dir)
+		require.True(t, os.IsNotExist(err), "orphaned %s is left", dir)
+	}
+	for _, dir := range []string{indexed, freshCont, unrestored} {
+		_, err := os.Stat(dir)
+		require.NoError(t, err, "%s should be kept", dir)
+	}
+
+	t.Run("instance ignores kill", func(t *testing.T) {
+		cli := &fakeInstances{
+			states: map[string]*ociruntime.State{
+				"immortal": instanceState(bundle(containersDir, "immortal"), "running", old),
+			},
+			immortal: map[string]bool{"immortal": true},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*gcKillPollInterval)
+		defer cancel()
+		removed, err := removeInstance(ctx, cli, "immortal")
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.False(t, removed)
+		require.Empty(t, cli.deleted)
+	})
+}
+
+func TestIsStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stale-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	require.False(t, isStale(dir), "new directory should not be stale")
+
+	old := time.Now().Add(-2 * gcGracePeriod)
+	require.NoError(t, os.Chtimes(dir, old, old))
+	require.True(t, isStale(dir))
+
+	require.False(t, isStale(filepath.Join(dir, "missing")), "missing directory should not be stale")
+}
+
+func TestReadDirNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirs-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "pod1"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "pod2"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	dirs, err := readDirNames(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{filepath.Join(dir, "pod1"), filepath.Join(dir, "pod2")}, dirs)
+
+	dirs, err = readDirNames(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	require.Empty(t, dirs)
+}
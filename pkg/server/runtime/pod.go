@@ -41,7 +41,7 @@ func (s *SingularityRuntime) RunPodSandbox(_ context.Context, req *k8s.RunPodSan
 			glog.Errorf("Could not remove pod from index: %v", err)
 		}
 	}
-	podBaseDir := filepath.Join(s.baseRunDir, "pods", pod.ID())
+	podBaseDir := filepath.Join(s.baseRunDir, podsDir, pod.ID())
 	if err := pod.Run(podBaseDir); err != nil {
 		cleanupOnFailure()
 		return nil, status.Errorf(codes.Internal, "could not run pod: %v", err)
@@ -0,0 +1,97 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/sylabs/singularity-cri/pkg/kube"
+)
+
+const (
+	podsDir       = "pods"
+	containersDir = "containers"
+)
+
+// restore rebuilds pod and container indexes from the info saved
+// in base run directory, so that pods and containers that were
+// running before CRI restart are managed again. Pods and containers
+// that cannot be restored are skipped and are recorded as unrestored.
+func (s *SingularityRuntime) restore() error {
+	s.unrestored = make(map[string]bool)
+	podDirs, err := readDirNames(filepath.Join(s.baseRunDir, podsDir))
+	if err != nil {
+		return fmt.Errorf("could not read pods directory: %v", err)
+	}
+	for _, dir := range podDirs {
+		pod, err := kube.RestorePod(dir, s.networkManager)
+		if err == kube.ErrRemoved {
+			glog.V(3).Infof("Skipping removed pod in %s, it is left for garbage collection", dir)
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Could not restore pod from %s: %v", dir, err)
+			s.unrestored[filepath.Base(dir)] = true
+			continue
+		}
+		if err := s.pods.Add(pod); err != nil {
+			glog.Errorf("Could not add restored pod %s to index: %v", pod.ID(), err)
+		}
+	}
+
+	contDirs, err := readDirNames(filepath.Join(s.baseRunDir, containersDir))
+	if err != nil {
+		return fmt.Errorf("could not read containers directory: %v", err)
+	}
+	for _, dir := range contDirs {
+		cont, err := kube.RestoreContainer(dir, s.pods.Find, s.imageIndex.Find)
+		if err == kube.ErrRemoved {
+			glog.V(3).Infof("Skipping removed container in %s, it is left for garbage collection", dir)
+			continue
+		}
+		if err != nil {
+			glog.Errorf("Could not restore container from %s: %v", dir, err)
+			s.unrestored[filepath.Base(dir)] = true
+			continue
+		}
+		if err := s.containers.Add(cont); err != nil {
+			glog.Errorf("Could not add restored container %s to index: %v", cont.ID(), err)
+		}
+	}
+	return nil
+}
+
+// readDirNames returns absolute paths of all directories found in dir.
+// If dir doesn't exist no error is returned.
+func readDirNames(dir string) ([]string, error) {
+	fii, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, fi := range fii {
+		if fi.IsDir() {
+			dirs = append(dirs, filepath.Join(dir, fi.Name()))
+		}
+	}
+	return dirs, nil
+}
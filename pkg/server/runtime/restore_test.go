@@ -0,0 +1,58 @@
+// Copyright (c) 2018-2019 Sylabs, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/sylabs/singularity-cri/pkg/index"
+	"github.com/sylabs/singularity-cri/pkg/kube"
+)
+
+func TestSingularityRuntime_Restore(t *testing.T) {
+	baseRunDir, err := ioutil.TempDir("", "restore-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(baseRunDir)
+
+	writeInfo := func(kind, id, file, content string) {
+		dir := filepath.Join(baseRunDir, kind, id)
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, file), []byte(content), 0644))
+	}
+	writeInfo(podsDir, "corrupted-pod", "pod.json", `{"id":`)
+	writeInfo(podsDir, "removed-pod", "pod.json", `{"id":"removed-pod","config":{},"stopped":true,"removed":true}`)
+	writeInfo(containersDir, "orphan-cont", "container.json", `{"id":"orphan-cont","podID":"missing","config":{}}`)
+	writeInfo(containersDir, "removed-cont", "container.json", `{"id":"removed-cont","podID":"missing","config":{},"removed":true}`)
+
+	s := &SingularityRuntime{
+		pods:       index.NewPodIndex(),
+		containers: index.NewContainerIndex(),
+		imageIndex: index.NewImageIndex(nil),
+		baseRunDir: baseRunDir,
+	}
+	require.NoError(t, s.restore())
+
+	var pods, containers int
+	s.pods.Iterate(func(*kube.Pod) { pods++ })
+	s.containers.Iterate(func(*kube.Container) { containers++ })
+	require.Zero(t, pods, "no pods should be restored")
+	require.Zero(t, containers, "no containers should be restored")
+	require.Equal(t, map[string]bool{"corrupted-pod": true, "orphan-cont": true}, s.unrestored,
+		"removed pods and containers should be left for garbage collection")
+}
@@ -50,6 +50,14 @@ type SingularityRuntime struct {
 	containers  *index.ContainerIndex
 	baseRunDir  string
 	trashDir    string
+	liveRestore bool
+	// unrestored holds IDs of pods and containers that were
+	// found in base run directory, but could not be restored
+	unrestored map[string]bool
+
+	gcInterval time.Duration
+	gcCancel   context.CancelFunc
+	gcDone     chan struct{}
 
 	streaming streaming.Server
 
@@ -80,6 +88,10 @@ func NewSingularityRuntime(imgIndex *index.ImageIndex, opts ...Option) (*Singula
 	for _, opt := range opts {
 		opt(runtime)
 	}
+	if err := runtime.restore(); err != nil {
+		return nil, fmt.Errorf("could not restore pods and containers: %v", err)
+	}
+	runtime.startGC()
 	return runtime, nil
 }
 
@@ -150,13 +162,28 @@ func WithTrashDir(dir string) Option {
 	}
 }
 
+// WithLiveRestore makes Shutdown leave all pods and containers running
+// so that they may be restored by a new SingularityRuntime instance later.
+func WithLiveRestore(enable bool) Option {
+	return func(r *SingularityRuntime) {
+		r.liveRestore = enable
+	}
+}
+
 // Shutdown shuts down any running background tasks created by SingularityRuntime.
 // This methods should be called when SingularityRuntime will no longer be used.
+// Unless live restore is enabled all pods are stopped and removed.
 func (s *SingularityRuntime) Shutdown() error {
+	s.stopGC()
 	if err := s.streaming.Stop(); err != nil {
 		return fmt.Errorf("could not stop streaming server: %v", err)
 	}
 
+	if s.liveRestore {
+		glog.V(4).Infof("Live restore is enabled, leaving all pods running")
+		return nil
+	}
+
 	var cleanupErr error
 	glog.V(4).Infof("Stopping all running pods")
 	s.pods.Iterate(func(pod *kube.Pod) {
@@ -23,6 +23,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"strings"
 	"syscall"
 
@@ -31,6 +33,7 @@ import (
 	"github.com/opencontainers/runtime-spec/specs-go"
 	syio "github.com/sylabs/singularity-cri/pkg/io"
 	"github.com/sylabs/singularity/pkg/ociruntime"
+	"github.com/sylabs/singularity/pkg/syfs"
 )
 
 // ErrNotFound us returned when Singularity OCI engine responds with
@@ -74,6 +77,44 @@ func (c *CLIClient) State(id string) (*ociruntime.State, error) {
 	return state, nil
 }
 
+// List returns IDs of all Singularity OCI instances run by the current user on this
+// host. Singularity has no command to list OCI instances, so instance files it keeps
+// for each of them are enumerated instead.
+func (c *CLIClient) List() ([]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("could not get hostname: %v", err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("could not get current user: %v", err)
+	}
+	return listInstances(filepath.Join(syfs.ConfigDir(), "instances", "oci", hostname, u.Username))
+}
+
+// listInstances returns names of instances which files are found in dir.
+// Each instance has its own directory with <name>/<name>.json file in it.
+func listInstances(dir string) ([]string, error) {
+	fii, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read instances directory: %v", err)
+	}
+	var ids []string
+	for _, fi := range fii {
+		if !fi.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, fi.Name(), fi.Name()+".json"))
+		if err == nil {
+			ids = append(ids, fi.Name())
+		}
+	}
+	return ids, nil
+}
+
 // Delete asks runtime to delete container with passed id. If runtime fails
 // to find object with given id, ErrNotFound is returned.
 func (c *CLIClient) Delete(id string) error {
@@ -15,6 +15,9 @@
 package runtime
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -71,3 +74,23 @@ SINGULARITY_CONFDIR=/usr/local/etc/singularity
 		})
 	}
 }
+
+func TestListInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instances-")
+	require.NoError(t, err, "could not create temp directory")
+	defer os.RemoveAll(dir)
+
+	for _, path := range []string{"pod1/pod1.json", "cont1/cont1.json", "broken/other.json", "stray.json"} {
+		path = filepath.Join(dir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte("{}"), 0644))
+	}
+
+	ids, err := listInstances(dir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"pod1", "cont1"}, ids)
+
+	ids, err = listInstances(filepath.Join(dir, "missing"))
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
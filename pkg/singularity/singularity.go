@@ -29,8 +29,29 @@ const (
 	// DockerDomain holds docker primary domain to pull images from.
 	DockerDomain = "docker.io"
 
-	// DockerProtocol holds docker hub base URI.
-	DockerProtocol = "docker"
+	// OrasDomain is a special case domain that is used for SIF images
+	// stored in OCI registries as ORAS artifacts, e.g. oras://harbor.local/foo/bar:1.0.
+	// For more info refer to https://github.com/deislabs/oras.
+	OrasDomain = "oras"
+
+	// HTTPDomain is a special case domain that is used for SIF images downloaded
+	// directly from web servers, e.g. https://example.com/images/app.sif.
+	HTTPDomain = "http"
+
+	// OCILayoutProtocol is used to build SIF images from OCI image layouts.
+	// It is also a special case domain for images imported from local OCI
+	// layouts, e.g. oci:/path/to/layout:tag.
+	OCILayoutProtocol = "oci"
+
+	// OCIArchiveProtocol is used to build SIF images from OCI layouts archived
+	// into a tarball. It is also a special case domain for images imported from
+	// such archives, e.g. oci-archive:/path/to/image.tar.
+	OCIArchiveProtocol = "oci-archive"
+
+	// DockerArchiveProtocol is used to build SIF images from tarballs created with
+	// docker save. It is also a special case domain for images imported from
+	// such archives, e.g. docker-archive:/path/to/image.tar.
+	DockerArchiveProtocol = "docker-archive"
 
 	// KeysServer is a default singularity key management and verification server.
 	KeysServer = "https://keys.sylabs.io"
@@ -42,12 +63,4 @@ const (
 	// RunScript is a path to a shell script that should be used as a default container
 	// entrypoint based on a native SIF image.
 	RunScript = "/.singularity.d/actions/run"
-
-	// EnvDockerUsername should be used to set Docker username for
-	// build engine when building from a private registry.
-	EnvDockerUsername = "SINGULARITY_DOCKER_USERNAME"
-
-	// EnvDockerPassword should be used to set Docker password for
-	// build engine when building from a private registry.
-	EnvDockerPassword = "SINGULARITY_DOCKER_PASSWORD"
 )
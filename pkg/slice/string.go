@@ -38,3 +38,13 @@ func RemoveFromString(a []string, v string) []string {
 	}
 	return a
 }
+
+// ContainsString returns true if passed slice contains element v.
+func ContainsString(a []string, v string) bool {
+	for _, str := range a {
+		if str == v {
+			return true
+		}
+	}
+	return false
+}
@@ -83,3 +83,36 @@ func TestRemoveFromString(t *testing.T) {
 		})
 	}
 }
+
+func TestContainsString(t *testing.T) {
+	tt := []struct {
+		name   string
+		s      []string
+		v      string
+		expect bool
+	}{
+		{
+			name:   "empty",
+			v:      "gcr.io/cri-tools/test-image-tags:1",
+			expect: false,
+		},
+		{
+			name:   "not found",
+			s:      []string{"gcr.io/cri-tools/test-image-tags:1", "gcr.io/cri-tools/test-image-tags:2"},
+			v:      "gcr.io/cri-tools/test-image-tags:3",
+			expect: false,
+		},
+		{
+			name:   "found",
+			s:      []string{"gcr.io/cri-tools/test-image-tags:1", "gcr.io/cri-tools/test-image-tags:2"},
+			v:      "gcr.io/cri-tools/test-image-tags:2",
+			expect: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, ContainsString(tc.s, tc.v))
+		})
+	}
+}